@@ -0,0 +1,230 @@
+package kadht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+/*
+ * Bencode encoder and decoder as used by the BitTorrent protocols.
+ * Decoded values are represented with the following Go types:
+ * 1. integer    : int64
+ * 2. byte string: string
+ * 3. list       : []interface{}
+ * 4. dictionary : map[string]interface{}
+ * The encoder additionally accepts int, uint16, uint32 and []byte.
+ */
+
+const (
+	// Max nesting of lists and dictionaries accepted by the decoder.
+	// KRPC messages never go beyond 3 levels.
+	bencodeMaxDepth = 32
+)
+
+var errBencodeTruncated = errors.New("bencode: unexpected end of data")
+
+/*
+ * BencodeMarshal : Encodes the value in bencode format.
+ * Parameters:
+ * [in] value : The value to encode
+ * [out] []byte : The encoded bytes
+ * [out] error : If the value (or something nested in it) is not encodable
+ */
+func BencodeMarshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := BencodeEncode(&buf, value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+ * BencodeEncode : Writes the bencoded value into the writer.
+ * Dictionary keys are written in sorted order as required
+ * by the specification.
+ */
+func BencodeEncode(writer io.Writer, value interface{}) error {
+	var err error
+
+	switch v := value.(type) {
+	case int64:
+		_, err = fmt.Fprintf(writer, "i%de", v)
+	case int:
+		_, err = fmt.Fprintf(writer, "i%de", v)
+	case uint16:
+		_, err = fmt.Fprintf(writer, "i%de", v)
+	case uint32:
+		_, err = fmt.Fprintf(writer, "i%de", v)
+	case string:
+		_, err = fmt.Fprintf(writer, "%d:%s", len(v), v)
+	case []byte:
+		_, err = fmt.Fprintf(writer, "%d:%s", len(v), v)
+	case []interface{}:
+		if _, err = io.WriteString(writer, "l"); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err = BencodeEncode(writer, elem); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(writer, "e")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if _, err = io.WriteString(writer, "d"); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = BencodeEncode(writer, key); err != nil {
+				return err
+			}
+			if err = BencodeEncode(writer, v[key]); err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(writer, "e")
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", value)
+	}
+	return err
+}
+
+/*
+ * BencodeUnmarshal : Decodes exactly one bencoded value.
+ * Parameters:
+ * [in] data : The encoded bytes. Trailing bytes are an error.
+ * [out] interface{} : The decoded value
+ * [out] error : If the data is not valid bencode
+ */
+func BencodeUnmarshal(data []byte) (interface{}, error) {
+	decoder := bencodeDecoder{data: data}
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.pos != len(data) {
+		return nil, fmt.Errorf("bencode: %d trailing bytes", len(data)-decoder.pos)
+	}
+	return value, nil
+}
+
+type bencodeDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (this *bencodeDecoder) decode(depth int) (interface{}, error) {
+	if this.pos >= len(this.data) {
+		return nil, errBencodeTruncated
+	}
+	if depth > bencodeMaxDepth {
+		return nil, errors.New("bencode: nesting too deep")
+	}
+
+	switch c := this.data[this.pos]; {
+	case c == 'i':
+		this.pos++
+		return this.decodeInt('e')
+
+	case c >= '0' && c <= '9':
+		return this.decodeString()
+
+	case c == 'l':
+		this.pos++
+		list := make([]interface{}, 0)
+		for {
+			if this.pos >= len(this.data) {
+				return nil, errBencodeTruncated
+			}
+			if this.data[this.pos] == 'e' {
+				this.pos++
+				return list, nil
+			}
+			elem, err := this.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+
+	case c == 'd':
+		this.pos++
+		dict := make(map[string]interface{})
+		last_key := ""
+		for {
+			if this.pos >= len(this.data) {
+				return nil, errBencodeTruncated
+			}
+			if this.data[this.pos] == 'e' {
+				this.pos++
+				return dict, nil
+			}
+			key, err := this.decodeString()
+			if err != nil {
+				return nil, err
+			}
+			if len(dict) > 0 && key <= last_key {
+				return nil, fmt.Errorf("bencode: dictionary key %q out of order", key)
+			}
+			last_key = key
+
+			value, err := this.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = value
+		}
+
+	default:
+		return nil, fmt.Errorf("bencode: invalid byte %q at offset %d", c, this.pos)
+	}
+}
+
+// decodeInt: Parses a base 10 integer up to the terminator byte.
+// Leading zeros and negative zero are rejected as the specification
+// requires a canonical form.
+func (this *bencodeDecoder) decodeInt(terminator byte) (int64, error) {
+	end := bytes.IndexByte(this.data[this.pos:], terminator)
+	if end < 0 {
+		return 0, errBencodeTruncated
+	}
+	digits := string(this.data[this.pos : this.pos+end])
+
+	if len(digits) == 0 || digits == "-" || digits == "-0" ||
+		(len(digits) > 1 && digits[0] == '0') ||
+		(len(digits) > 2 && digits[0] == '-' && digits[1] == '0') {
+		return 0, fmt.Errorf("bencode: invalid integer %q", digits)
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: invalid integer %q", digits)
+	}
+	this.pos += end + 1
+	return value, nil
+}
+
+func (this *bencodeDecoder) decodeString() (string, error) {
+	if this.pos >= len(this.data) || this.data[this.pos] < '0' || this.data[this.pos] > '9' {
+		return "", fmt.Errorf("bencode: expected string at offset %d", this.pos)
+	}
+	length, err := this.decodeInt(':')
+	if err != nil {
+		return "", err
+	}
+	if length > int64(len(this.data)-this.pos) {
+		return "", errBencodeTruncated
+	}
+	str := string(this.data[this.pos : this.pos+int(length)])
+	this.pos += int(length)
+	return str, nil
+}
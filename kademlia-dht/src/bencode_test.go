@@ -0,0 +1,52 @@
+package kadht
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBencodeRoundTrip(t *testing.T) {
+	value := map[string]interface{}{
+		"spam": []interface{}{"a", int64(-3), []interface{}{}},
+		"cow":  "moo",
+		"n":    int64(0),
+		"dict": map[string]interface{}{"k": "v"},
+	}
+	data, err := BencodeMarshal(value)
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+	expected := "d3:cow3:moo4:dictd1:k1:ve1:ni0e4:spaml1:ai-3eleee"
+	if string(data) != expected {
+		t.Error("Unexpected encoding: ", string(data))
+	}
+
+	decoded, err := BencodeUnmarshal(data)
+	if err != nil {
+		t.Fatal("Unmarshal failed: ", err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Error("Value did not survive the round trip: ", decoded)
+	}
+}
+
+func TestBencodeInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"i03e",
+		"i-0e",
+		"ie",
+		"i12",
+		"5:abc",
+		"l1:a",
+		"d1:bi1e1:ai2ee", // keys out of order
+		"d1:ai1e1:ai2ee", // duplicate key
+		"i1ei2e",         // trailing data
+		"x",
+	}
+	for _, data := range invalid {
+		if _, err := BencodeUnmarshal([]byte(data)); err == nil {
+			t.Error("Invalid bencode accepted: ", data)
+		}
+	}
+}
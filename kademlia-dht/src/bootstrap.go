@@ -0,0 +1,95 @@
+package kadht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+/*
+ * Joining the network.
+ *
+ * A new node knows the addresses of a few seed nodes. It pings them to
+ * learn their IDs and adds them to its routing table, then looks up
+ * its own ID: the nodes queried on the way fill its closest buckets,
+ * and learn about the new node. Last, the buckets farther than its
+ * closest neighbour are refreshed with a lookup of a random ID in
+ * their range, as the kademlia paper prescribes.
+ */
+
+var errNoSeedAnswered = errors.New("No seed answered")
+
+/*
+ * Bootstrap : Joins the network through the seed nodes.
+ * Parameters:
+ * [in] ctx : Bounds the procedure
+ * [in] seeds : Addresses of nodes already in the network
+ * [out] error : If no seed answered, or the self lookup failed.
+ *               Failed refreshes of the farther buckets are not errors.
+ */
+func (this *DHT) Bootstrap(ctx context.Context, seeds []net.Addr) error {
+	if len(seeds) == 0 {
+		return errors.New("Bootstrap failed: no seed given")
+	}
+
+	var lock sync.Mutex
+	var answered int
+	var seed_errs []error
+	var pings sync.WaitGroup
+	for _, seed := range seeds {
+		pings.Add(1)
+		go func(seed net.Addr) {
+			defer pings.Done()
+			contact, _, err := this.server.Ping(ctx, seed)
+			if err == nil && contact.Id == this.Id() {
+				err = errors.New("Seed is the local node")
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				seed_errs = append(seed_errs, fmt.Errorf("%s: %w", seed, err))
+				return
+			}
+			this.routing_table.UpdateEntry(CreateNode(contact.Addr.UDPAddr(), contact.Id))
+			answered++
+		}(seed)
+	}
+	pings.Wait()
+	if answered == 0 {
+		return fmt.Errorf("Bootstrap failed: %w (%v)", errNoSeedAnswered, seed_errs)
+	}
+
+	if _, _, err := this.FindNode(ctx, this.Id()); err != nil {
+		return fmt.Errorf("Bootstrap failed: self lookup: %w", err)
+	}
+
+	// Refresh the buckets farther than the closest neighbour
+	closest := this.routing_table.LookupClosestContacts(this.Id(), 1)
+	if len(closest) == 0 {
+		return fmt.Errorf("Bootstrap failed: %w", errNoContacts)
+	}
+	nearest_bucket := commonBits(this.Id(), closest[0].Id)
+	for bucket := 0; bucket < nearest_bucket; bucket++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Bootstrap failed: %w", err)
+		}
+		this.FindNode(ctx, randomIdInBucket(this.Id(), bucket))
+	}
+	return nil
+}
+
+// randomIdInBucket: A random ID sharing exactly 'bucket' leading bits
+// with 'id', which falls into that bucket of its routing table
+func randomIdInBucket(id NodeId, bucket int) NodeId {
+	random := generateRandomNodeId()
+	result := id
+	byte_idx, bit := bucket/8, uint(7-bucket%8)
+	result[byte_idx] ^= 1 << bit
+	// Random bits after the flipped one
+	mask := byte(1<<bit) - 1
+	result[byte_idx] = result[byte_idx]&^mask | random[byte_idx]&mask
+	copy(result[byte_idx+1:], random[byte_idx+1:])
+	return result
+}
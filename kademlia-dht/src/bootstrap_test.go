@@ -0,0 +1,80 @@
+package kadht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRandomIdInBucket(t *testing.T) {
+	id := generateRandomNodeId()
+	for _, bucket := range []int{0, 5, 8, 77, numBitsID - 1} {
+		if common := commonBits(id, randomIdInBucket(id, bucket)); common != bucket {
+			t.Error("ID of bucket ", bucket, " shares ", common, " bits")
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	network := NewMemNetwork()
+	// Buckets with room for the whole network, which replies to FIND_NODE
+	// carry entirely: a lookup is then sure to find the closest nodes.
+	// Retries absorb the scheduling delays of a loaded machine.
+	config := Config{BucketSize: alphaNodes, RequestTimeout: time.Second, RequestRetries: 5}
+	var nodes []*DHT
+	for i := 0; i <= alphaNodes; i++ {
+		transport, _ := network.Listen(nil)
+		config.Transport = transport
+		node, err := New(config)
+		if err != nil {
+			t.Fatal("Failed to create the DHT: ", err)
+		}
+		// All the nodes share one IP address
+		node.Server().SetRateLimits(RateLimit{}, RateLimit{})
+		node.Start()
+		defer node.Stop()
+		// Each node joins through the first one
+		if i > 0 {
+			if err := node.Bootstrap(context.Background(), []net.Addr{nodes[0].Addr()}); err != nil {
+				t.Fatal("Bootstrap failed: ", err)
+			}
+			if !node.RoutingTable().Contains(nodes[0].Id()) {
+				t.Fatal("Seed not added to the routing table")
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	// The first node learned everyone, the others find the closest nodes
+	target := generateRandomNodeId()
+	found, _, err := nodes[len(nodes)-1].FindNode(context.Background(), target)
+	if err != nil {
+		t.Fatal("Lookup failed: ", err)
+	}
+	expected := closestIds(nodes[:len(nodes)-1], target, config.BucketSize)
+	for idx := range expected {
+		if idx >= len(found) || found[idx].Id != expected[idx] {
+			t.Error("Closest contacts not found at ", idx)
+		}
+	}
+}
+
+func TestBootstrapFailure(t *testing.T) {
+	node := newTestDHT(t, Config{RequestTimeout: 10 * time.Millisecond, RequestRetries: -1})
+	defer node.Stop()
+
+	seeds := []net.Addr{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}}
+	err := node.Bootstrap(context.Background(), seeds)
+	if !errors.Is(err, errNoSeedAnswered) {
+		t.Error("Unreachable seeds not reported: ", err)
+	}
+	err = node.Bootstrap(context.Background(), []net.Addr{node.Addr()})
+	if !errors.Is(err, errNoSeedAnswered) {
+		t.Error("Local node accepted as seed: ", err)
+	}
+	if node.Bootstrap(context.Background(), nil) == nil {
+		t.Error("Bootstrap without seeds succeeded")
+	}
+}
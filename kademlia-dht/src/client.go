@@ -0,0 +1,173 @@
+package kadht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+/*
+ * Blocking client API of the RPC server. Every call waits for the
+ * reply of the peer, retrying as configured in the PendingTracker,
+ * and returns early with the error of the context once it is
+ * cancelled or its deadline passes. Calls wait for a slot of the
+ * OutboundLimiter before sending, see congestion.go.
+ *
+ * A peer which does not know the local node yet rejects the requests
+ * whose reply is too large with ERR_CODE_UNVERIFIED, see ratelimit.go.
+ * The call then pings the peer, which pings back and so verifies the
+ * local node, and sends the request again once.
+ */
+
+var errUnexpectedReply = errors.New("Unexpected reply type")
+
+/*
+ * call : Sends a request and waits for its reply.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the peer
+ * [in] req : The request
+ * [out] IMessage : The reply
+ * [out] error : The context error, errRequestTimeout, or the ErrorReply
+ *               of the peer
+ */
+func (this *RpcServer) call(ctx context.Context, addr net.Addr, req IMessage) (IMessage, error) {
+	reply, _, err := this.exchange(ctx, addr, req)
+	if error_reply, ok := err.(*ErrorReply); ok && error_reply.Code == ERR_CODE_UNVERIFIED &&
+		req.Header().MsgType != PING_REQ {
+		if _, _, err := this.Ping(ctx, addr); err != nil {
+			return nil, err
+		}
+		// The peer dropped the RandomId already received
+		header := req.Header()
+		header.RandomId = generateRandomNodeId()
+		header.EpochTime = time.Now().Unix()
+		reply, _, err = this.exchange(ctx, addr, req)
+	}
+	return reply, err
+}
+
+// exchange: As call, also returns the round trip time of the request,
+// without the time spent waiting for an outbound slot
+func (this *RpcServer) exchange(ctx context.Context, addr net.Addr, req IMessage) (IMessage, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	slot, err := this.outbound.Acquire(ctx, addr.String(), priorityOf(ctx, req))
+	if err != nil {
+		return nil, 0, err
+	}
+	pending, err := this.Request(addr, req)
+	if err != nil {
+		slot.Release(err)
+		return nil, 0, err
+	}
+	select {
+	case <-pending.Done():
+	case <-ctx.Done():
+		pending.Cancel()
+	}
+	reply, err := pending.Wait()
+	if err == errRequestCancelled {
+		err = ctx.Err()
+		reply = nil
+	}
+	slot.Release(err)
+	return reply, pending.RoundTrip(), err
+}
+
+/*
+ * Ping : Checks that a node is alive.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the node
+ * [out] RemoteNode : ID and address of the node
+ * [out] time.Duration : Round trip time of the request
+ * [out] error : If the node did not answer
+ */
+func (this *RpcServer) Ping(ctx context.Context, addr net.Addr) (RemoteNode, time.Duration, error) {
+	reply, rtt, err := this.exchange(ctx, addr, NewPingRequest(this.server_ctx.node_id))
+	if err != nil {
+		return RemoteNode{}, 0, err
+	}
+	if _, ok := reply.(*PingReply); !ok {
+		return RemoteNode{}, 0, errUnexpectedReply
+	}
+	udp_addr, err := udpAddrOf(addr)
+	if err != nil {
+		return RemoteNode{}, 0, err
+	}
+	return RemoteNode{Id: reply.Header().SenderId, Addr: NewIpv4Addr(udp_addr)}, rtt, nil
+}
+
+/*
+ * FindNode : Asks a node for the contacts it knows closest to the target.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the node
+ * [in] target : The ID looked up
+ * [out] []RemoteNode : The contacts
+ * [out] error : If the node did not answer
+ */
+func (this *RpcServer) FindNode(ctx context.Context, addr net.Addr, target NodeId) ([]RemoteNode, error) {
+	reply, err := this.call(ctx, addr, NewFindNodeRequest(this.server_ctx.node_id, target))
+	if err != nil {
+		return nil, err
+	}
+	find_node_resp, ok := reply.(*FindNodeReply)
+	if !ok {
+		return nil, errUnexpectedReply
+	}
+	return find_node_resp.Nodes, nil
+}
+
+/*
+ * FindValue : Asks a node for a value.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the node
+ * [in] key : ID of the value
+ * [out] []byte : The value, nil if the node does not hold it
+ * [out] []RemoteNode : The contacts closest to the key, if the value is not found
+ * [out] error : If the node did not answer
+ */
+func (this *RpcServer) FindValue(ctx context.Context, addr net.Addr, key NodeId) ([]byte, []RemoteNode, error) {
+	reply, err := this.call(ctx, addr, NewFindValueRequest(this.server_ctx.node_id, key))
+	if err != nil {
+		return nil, nil, err
+	}
+	find_value_resp, ok := reply.(*FindValueReply)
+	if !ok {
+		return nil, nil, errUnexpectedReply
+	}
+	if find_value_resp.Found {
+		return find_value_resp.Value, nil, nil
+	}
+	return nil, find_value_resp.Nodes, nil
+}
+
+/*
+ * Store : Asks a node to store a value.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the node
+ * [in] key : ID of the value
+ * [in] value : The value
+ * [in] ttl : Seconds the value must be kept, 0 for the default of the node
+ * [out] error : If the node did not answer or did not store the value
+ */
+func (this *RpcServer) Store(ctx context.Context, addr net.Addr, key NodeId, value []byte, ttl uint32) error {
+	reply, err := this.call(ctx, addr, NewStoreRequest(this.server_ctx.node_id, key, value, ttl))
+	if err != nil {
+		return err
+	}
+	store_resp, ok := reply.(*StoreReply)
+	if !ok {
+		return errUnexpectedReply
+	}
+	if !store_resp.Stored {
+		return errors.New("Value not stored by the node")
+	}
+	return nil
+}
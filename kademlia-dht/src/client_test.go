@@ -0,0 +1,70 @@
+package kadht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientCalls(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	node, rtt, err := a.Ping(ctx, b.LocalAddr())
+	if err != nil || node.Id != b.server_ctx.node_id || rtt <= 0 {
+		t.Fatal("Ping failed: ", err)
+	}
+
+	b.routing_table.AddEntryOnly(CreateNode(a.LocalAddr().(*net.UDPAddr), a.server_ctx.node_id))
+	nodes, err := a.FindNode(ctx, b.LocalAddr(), generateRandomNodeId())
+	if err != nil || len(nodes) != 1 || nodes[0].Id != a.server_ctx.node_id {
+		t.Error("Find node failed: ", err)
+	}
+
+	key := generateRandomNodeId()
+	if err := a.Store(ctx, b.LocalAddr(), key, []byte("value"), 60); err != nil {
+		t.Fatal("Store failed: ", err)
+	}
+	value, _, err := a.FindValue(ctx, b.LocalAddr(), key)
+	if err != nil || !bytes.Equal(value, []byte("value")) {
+		t.Error("Find value failed: ", err)
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	a := newTestServer(t)
+	defer a.Close()
+
+	// Nobody answers there
+	silent, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = a.Ping(ctx, silent.LocalAddr())
+	if err != context.DeadlineExceeded {
+		t.Error("Deadline not honored: ", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Call outlived its deadline")
+	}
+	if a.tracker.Pending() != 0 {
+		t.Error("Abandoned request still tracked")
+	}
+
+	cancel()
+	if _, err := a.FindNode(ctx, silent.LocalAddr(), generateRandomNodeId()); err != context.DeadlineExceeded {
+		t.Error("Call made with an expired context: ", err)
+	}
+}
@@ -0,0 +1,269 @@
+package kadht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Fixed layout binary format written by the Serialize
+	// interface API of the messages.
+	WIRE_VERSION_BINARY = 1
+	// Self describing JSON format. Meant for debugging and for
+	// inspecting the traffic with standard tools.
+	WIRE_VERSION_JSON = 2
+)
+
+const (
+	// Every encoding starts with the header version as
+	// a big endian uint32, which selects the codec.
+	wireVersionLen = 4
+)
+
+/*
+ * Codec interface that every wire encoding of the messages
+ * must satisfy.
+ * Interface API's:
+ * 1. Encode :
+ *    Encodes the message, header included, into a datagram.
+ * 2. Decode :
+ *    Decodes a complete datagram into the message class of
+ *    the type found in the header.
+ */
+type ICodec interface {
+	Encode(msg IMessage) ([]byte, error)
+	Decode(data []byte) (IMessage, error)
+}
+
+var (
+	codecRegistryLock sync.RWMutex
+	codecRegistry     = map[uint32]ICodec{
+		WIRE_VERSION_BINARY: binaryCodec{},
+		WIRE_VERSION_JSON:   jsonCodec{},
+	}
+)
+
+/*
+ * RegisterCodec : Registers the codec used for messages of a header version.
+ * Parameters:
+ * [in] version : The header version
+ * [in] codec : The codec encoding and decoding that version
+ * [out] error : If the version already has a codec
+ */
+func RegisterCodec(version uint32, codec ICodec) error {
+	codecRegistryLock.Lock()
+	defer codecRegistryLock.Unlock()
+
+	if _, found := codecRegistry[version]; found {
+		return fmt.Errorf("Codec for version %d already registered", version)
+	}
+	codecRegistry[version] = codec
+	return nil
+}
+
+// CodecForVersion: Finds the codec of the header version
+func CodecForVersion(version uint32) (ICodec, bool) {
+	codecRegistryLock.RLock()
+	defer codecRegistryLock.RUnlock()
+
+	codec, found := codecRegistry[version]
+	return codec, found
+}
+
+/*
+ * EncodeMessage : Encodes the message with the codec selected by
+ * the version in its header.
+ * Parameters:
+ * [in] msg : The message to encode
+ * [out] []byte : The datagram
+ * [out] error : If the version is unknown or encoding failed
+ */
+func EncodeMessage(msg IMessage) ([]byte, error) {
+	version := msg.Header().Version
+	codec, found := CodecForVersion(version)
+	if !found {
+		return nil, fmt.Errorf("No codec for message version %d", version)
+	}
+	return codec.Encode(msg)
+}
+
+/*
+ * DecodeMessage : Decodes a datagram with the codec selected by
+ * the version it starts with.
+ * Parameters:
+ * [in] data : The datagram
+ * [out] IMessage : The decoded message
+ * [out] error : If the version is unknown or decoding failed
+ */
+func DecodeMessage(data []byte) (IMessage, error) {
+	if len(data) < wireVersionLen {
+		return nil, errors.New("Datagram too short for a message")
+	}
+	version := binary.BigEndian.Uint32(data)
+	codec, found := CodecForVersion(version)
+	if !found {
+		return nil, fmt.Errorf("No codec for message version %d", version)
+	}
+	return codec.Decode(data)
+}
+
+// decodeMessageHeader: Reads only the header of an encoded message,
+// for datagrams which could not be decoded completely.
+func decodeMessageHeader(data []byte) (BasicMsgHeader, error) {
+	var header BasicMsgHeader
+	if len(data) < wireVersionLen {
+		return header, errors.New("Datagram too short for a message")
+	}
+	switch binary.BigEndian.Uint32(data) {
+	case WIRE_VERSION_BINARY:
+		if _, ok := parseHeader(data, &header); !ok {
+			return header, errors.New("Failed to read message header from n/w")
+		}
+		return header, nil
+	case WIRE_VERSION_JSON:
+		var envelope jsonEnvelope
+		err := json.Unmarshal(data[wireVersionLen:], &envelope)
+		return envelope.Header, err
+	}
+	return header, errors.New("Unknown message version")
+}
+
+/*
+ * appendMessage : Appends the encoding of the message, in the version
+ * of its header, to 'buf'. Same as EncodeMessage, without allocating
+ * for the messages of wire.go in the binary version.
+ */
+func appendMessage(buf []byte, msg IMessage) ([]byte, error) {
+	version := msg.Header().Version
+	if version == WIRE_VERSION_BINARY {
+		return appendBinaryMessage(buf, msg)
+	}
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+/*
+ * binaryCodec : The original fixed layout format. The version is
+ * the first field of the serialized header. The extensions of the
+ * header, if any, follow the message body.
+ */
+type binaryCodec struct{}
+
+func (binaryCodec) Encode(msg IMessage) ([]byte, error) {
+	return appendBinaryMessage(nil, msg)
+}
+
+func (binaryCodec) Decode(data []byte) (IMessage, error) {
+	var header BasicMsgHeader
+	offset, ok := parseHeader(data, &header)
+	if !ok {
+		return nil, errors.New("Failed to read message header from n/w")
+	}
+	msg, err := NewMessage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if wire, ok := msg.(wireMessage); ok {
+		used, ok := wire.parseBody(data[offset:])
+		if !ok {
+			return nil, errors.New("Failed to parse " + MsgType2Str(header.MsgType))
+		}
+		offset += used
+	} else {
+		reader := bytes.NewReader(data[offset:])
+		if !msg.Deserialize(reader) {
+			return nil, errors.New("Failed to parse " + MsgType2Str(header.MsgType))
+		}
+		offset = len(data) - reader.Len()
+	}
+
+	extensions, err := parseExtensions(data[offset:])
+	if err != nil {
+		return nil, err
+	}
+	msg.Header().Extensions = extensions
+	return msg, nil
+}
+
+func appendBinaryMessage(buf []byte, msg IMessage) ([]byte, error) {
+	if wire, ok := msg.(wireMessage); ok {
+		buf = appendHeader(buf, msg.Header())
+		buf, ok = wire.appendBody(buf)
+		if !ok {
+			return nil, errors.New("Failed to serialize " + MsgType2Str(msg.Header().MsgType))
+		}
+	} else {
+		var out bytes.Buffer
+		if !msg.Serialize(&out) {
+			return nil, errors.New("Failed to serialize " + MsgType2Str(msg.Header().MsgType))
+		}
+		buf = append(buf, out.Bytes()...)
+	}
+	return appendExtensions(buf, msg.Header())
+}
+
+/*
+ * jsonCodec : Self describing format. The version is followed by
+ * a JSON document holding the header and the exported fields of
+ * the message class, for example:
+ *
+ *   {"Type":"FIND_NODE_REQ","Header":{...},"Body":{"LookupNodeId":"2f1c..."}}
+ */
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type   string // Name of the message type, informational only
+	Header BasicMsgHeader
+	Body   json.RawMessage
+}
+
+func (jsonCodec) Encode(msg IMessage) ([]byte, error) {
+	header := msg.Header()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := json.Marshal(&jsonEnvelope{
+		Type:   MsgType2Str(header.MsgType),
+		Header: *header,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, wireVersionLen, wireVersionLen+len(doc))
+	binary.BigEndian.PutUint32(data, header.Version)
+	return append(data, doc...), nil
+}
+
+func (jsonCodec) Decode(data []byte) (IMessage, error) {
+	var envelope jsonEnvelope
+	err := json.Unmarshal(data[wireVersionLen:], &envelope)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.Header.Version != binary.BigEndian.Uint32(data) {
+		return nil, errors.New("JSON message header does not match its version")
+	}
+
+	msg, err := NewMessage(envelope.Header)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Body) > 0 {
+		err = json.Unmarshal(envelope.Body, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
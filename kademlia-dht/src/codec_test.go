@@ -0,0 +1,92 @@
+package kadht
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testMessages() []IMessage {
+	sender := generateRandomNodeId()
+	addr, _ := net.ResolveUDPAddr("udp", "10.0.3.2:8989")
+	nodes := []RemoteNode{{Id: generateRandomNodeId(), Addr: NewIpv4Addr(addr)}}
+
+	find_node_req := NewFindNodeRequest(sender, generateRandomNodeId())
+	find_value_req := NewFindValueRequest(sender, generateRandomNodeId())
+	store_req := NewStoreRequest(sender, generateRandomNodeId(), []byte("value"), 3600)
+	return []IMessage{
+		NewPingRequest(sender),
+		NewPingReply(sender, NewPingRequest(generateRandomNodeId())),
+		find_node_req,
+		NewFindNodeReply(sender, nodes, find_node_req),
+		find_value_req,
+		NewFindValueReply(sender, find_value_req, []byte("value"), nil),
+		NewFindValueReply(sender, find_value_req, nil, nodes),
+		store_req,
+		NewStoreReply(sender, store_req, true),
+		NewErrorReply(sender, store_req.Header(), ERR_CODE_VALUE_TOO_LARGE, "value too large"),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, version := range []uint32{WIRE_VERSION_BINARY, WIRE_VERSION_JSON} {
+		for _, msg := range testMessages() {
+			msg.Header().Version = version
+			data, err := EncodeMessage(msg)
+			if err != nil {
+				t.Fatal("Failed to encode: ", err)
+			}
+
+			decoded, err := DecodeMessage(data)
+			if err != nil {
+				t.Fatal("Failed to decode: ", err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Version %d: %s did not survive the round trip",
+					version, MsgType2Str(msg.Header().MsgType))
+			}
+		}
+	}
+}
+
+func TestInvalidNodeCount(t *testing.T) {
+	find_node_req := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	reply := NewFindNodeReply(generateRandomNodeId(), nil, find_node_req)
+	reply.TotalNodes = -1
+	data, _ := EncodeMessage(reply)
+	if _, err := DecodeMessage(data); err == nil {
+		t.Error("Negative node count accepted")
+	}
+}
+
+func TestJsonCodecReadable(t *testing.T) {
+	msg := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	msg.Header().Version = WIRE_VERSION_JSON
+
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal("Failed to encode: ", err)
+	}
+	text := string(data[wireVersionLen:])
+	lookup_id, _ := msg.LookupNodeId.MarshalText()
+	if !strings.Contains(text, "FIND_NODE_REQ") || !strings.Contains(text, string(lookup_id)) {
+		t.Error("JSON message is not readable: ", text)
+	}
+}
+
+func TestDecodeUnknownVersion(t *testing.T) {
+	msg := NewPingRequest(generateRandomNodeId())
+	data, _ := EncodeMessage(msg)
+	data[0] = 0x7f
+
+	if _, err := DecodeMessage(data); err == nil {
+		t.Error("Message with unknown version decoded")
+	}
+	if _, err := DecodeMessage(data[:2]); err == nil {
+		t.Error("Truncated datagram decoded")
+	}
+	if err := NewServerConfig(msg.Header().SenderId).SetWireVersion(0x7f000000); err == nil {
+		t.Error("Wire version without codec accepted")
+	}
+}
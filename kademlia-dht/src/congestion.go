@@ -0,0 +1,279 @@
+package kadht
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+/*
+ * Outbound congestion control.
+ *
+ * The blocking client calls (see client.go) take a slot from the
+ * OutboundLimiter before sending, and give it back once the request
+ * completed. The number of requests in flight is bounded per peer and
+ * for the whole node. The node wide bound is a congestion window, which
+ * grows by one slot per window of successful requests and is halved
+ * when a request times out or a peer answers ERR_CODE_RATE_LIMITED
+ * (AIMD, as TCP). Only one loss per window of requests shrinks it, the
+ * losses of requests sent before the last decrease are ignored.
+ *
+ * Requests without slot wait in a queue, served by priority, and in
+ * order within a priority.
+ */
+
+const (
+	// Default max number of requests in flight from the node
+	DefaultMaxInFlight = 64
+	// Default max number of requests in flight to one peer
+	DefaultMaxInFlightPerPeer = 4
+	// Congestion window of a new limiter
+	initialWindow = 8
+)
+
+// Priorities of the outbound requests
+const (
+	PRIORITY_HIGH   = iota // Liveness checks
+	PRIORITY_NORMAL        // Lookups
+	PRIORITY_LOW           // Stores and refreshes
+)
+
+// Context key of the priority set by WithPriority
+type priorityKey struct{}
+
+/*
+ * WithPriority : Sets the priority of the requests sent with the context,
+ * instead of the default of their type.
+ */
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityOf: Priority of a request sent with the context
+func priorityOf(ctx context.Context, req IMessage) int {
+	if priority, ok := ctx.Value(priorityKey{}).(int); ok {
+		return priority
+	}
+	switch req.Header().MsgType {
+	case PING_REQ:
+		return PRIORITY_HIGH
+	case STORE_REQ:
+		return PRIORITY_LOW
+	}
+	return PRIORITY_NORMAL
+}
+
+// A request waiting for a slot
+type outboundWaiter struct {
+	priority int
+	seq      uint64
+	addr     string
+	ready    chan struct{} // Closed once the slot is granted
+	granted  bool
+	epoch    uint64 // Window decreases when the slot was granted
+}
+
+/*
+ * OutboundSlot : Permission to have one request in flight
+ */
+type OutboundSlot struct {
+	limiter *OutboundLimiter
+	addr    string
+	epoch   uint64 // Window decreases when the slot was granted
+}
+
+/*
+ * OutboundLimiter : Bounds the requests in flight
+ */
+type OutboundLimiter struct {
+	lock          sync.Mutex
+	max_in_flight int
+	max_per_peer  int
+	window        float64
+	epoch         uint64 // Incremented on every window decrease
+	in_flight     int
+	per_peer      map[string]int
+	queue         []*outboundWaiter
+	seq           uint64
+}
+
+/*
+ * NewOutboundLimiter : Creates a new limiter.
+ * Parameters:
+ * [in] max_in_flight : Max requests in flight from the node, the
+ *                      largest congestion window
+ * [in] max_per_peer : Max requests in flight to one peer
+ * [out] *OutboundLimiter : Pointer to the newly created OutboundLimiter
+ */
+func NewOutboundLimiter(max_in_flight, max_per_peer int) *OutboundLimiter {
+	if max_in_flight < 1 {
+		max_in_flight = 1
+	}
+	if max_per_peer < 1 {
+		max_per_peer = 1
+	}
+	window := float64(initialWindow)
+	if window > float64(max_in_flight) {
+		window = float64(max_in_flight)
+	}
+	return &OutboundLimiter{
+		max_in_flight: max_in_flight,
+		max_per_peer:  max_per_peer,
+		window:        window,
+		per_peer:      make(map[string]int),
+	}
+}
+
+/*
+ * Acquire : Waits for a slot to send a request.
+ * Parameters:
+ * [in] ctx : Bounds the wait
+ * [in] addr : Address of the peer
+ * [in] priority : One of the PRIORITY_* values
+ * [out] *OutboundSlot : The slot, to release once the request completed
+ * [out] error : The context error if it ended before a slot was free
+ */
+func (this *OutboundLimiter) Acquire(ctx context.Context, addr string, priority int) (*OutboundSlot, error) {
+	this.lock.Lock()
+	if len(this.queue) == 0 && this.canSend(addr) {
+		slot := this.take(addr)
+		this.lock.Unlock()
+		return slot, nil
+	}
+	this.seq++
+	waiter := &outboundWaiter{
+		priority: priority,
+		seq:      this.seq,
+		addr:     addr,
+		ready:    make(chan struct{}),
+	}
+	this.queue = append(this.queue, waiter)
+	// Waiters queued for peers at their limit must not hold it back
+	this.grant()
+	this.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return &OutboundSlot{limiter: this, addr: addr, epoch: waiter.epoch}, nil
+	case <-ctx.Done():
+	}
+
+	this.lock.Lock()
+	if waiter.granted {
+		// Granted meanwhile, give it to the next one
+		this.untake(addr)
+	} else {
+		this.dequeue(waiter)
+	}
+	this.grant()
+	this.lock.Unlock()
+	return nil, ctx.Err()
+}
+
+/*
+ * Release : Gives back the slot once its request completed.
+ * Parameters:
+ * [in] err : Result of the request, timeouts and rate limiting shrink
+ *            the window, other results grow it
+ */
+func (this *OutboundSlot) Release(err error) {
+	limiter := this.limiter
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.untake(this.addr)
+	var error_reply *ErrorReply
+	switch {
+	case errors.Is(err, errRequestTimeout),
+		errors.As(err, &error_reply) && error_reply.Code == ERR_CODE_RATE_LIMITED:
+		if this.epoch == limiter.epoch {
+			limiter.window /= 2
+			if limiter.window < 1 {
+				limiter.window = 1
+			}
+			limiter.epoch++
+		}
+	case errors.Is(err, errRequestCancelled), errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		// Says nothing about the network
+	default:
+		limiter.window += 1 / limiter.window
+		if limiter.window > float64(limiter.max_in_flight) {
+			limiter.window = float64(limiter.max_in_flight)
+		}
+	}
+	limiter.grant()
+}
+
+// InFlight: Number of slots in use
+func (this *OutboundLimiter) InFlight() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.in_flight
+}
+
+// Window: Current max number of slots in use
+func (this *OutboundLimiter) Window() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return int(this.window)
+}
+
+// canSend: If a request to the peer fits in the window. Called with
+// the lock held.
+func (this *OutboundLimiter) canSend(addr string) bool {
+	return this.in_flight < int(this.window) && this.per_peer[addr] < this.max_per_peer
+}
+
+// take: Uses a slot. Called with the lock held.
+func (this *OutboundLimiter) take(addr string) *OutboundSlot {
+	this.in_flight++
+	this.per_peer[addr]++
+	return &OutboundSlot{limiter: this, addr: addr, epoch: this.epoch}
+}
+
+// untake: Frees a slot. Called with the lock held.
+func (this *OutboundLimiter) untake(addr string) {
+	this.in_flight--
+	this.per_peer[addr]--
+	if this.per_peer[addr] <= 0 {
+		delete(this.per_peer, addr)
+	}
+}
+
+// grant: Hands the free slots to the waiters, highest priority first.
+// Waiters for a peer at its limit let the others pass. Called with the
+// lock held.
+func (this *OutboundLimiter) grant() {
+	for this.in_flight < int(this.window) {
+		var next *outboundWaiter
+		for _, waiter := range this.queue {
+			if this.per_peer[waiter.addr] >= this.max_per_peer {
+				continue
+			}
+			if next == nil || waiter.priority < next.priority ||
+				(waiter.priority == next.priority && waiter.seq < next.seq) {
+				next = waiter
+			}
+		}
+		if next == nil {
+			return
+		}
+		this.dequeue(next)
+		this.in_flight++
+		this.per_peer[next.addr]++
+		next.granted = true
+		next.epoch = this.epoch
+		close(next.ready)
+	}
+}
+
+// dequeue: Removes a waiter from the queue. Called with the lock held.
+func (this *OutboundLimiter) dequeue(waiter *outboundWaiter) {
+	for idx, queued := range this.queue {
+		if queued == waiter {
+			this.queue = append(this.queue[:idx], this.queue[idx+1:]...)
+			return
+		}
+	}
+}
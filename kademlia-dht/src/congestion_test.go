@@ -0,0 +1,119 @@
+package kadht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutboundLimits(t *testing.T) {
+	limiter := NewOutboundLimiter(16, 2)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.Acquire(ctx, "10.0.0.1:4000", PRIORITY_NORMAL); err != nil {
+			t.Fatal("Slot not granted: ", err)
+		}
+	}
+
+	// The peer is at its limit, not the others
+	short_ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(short_ctx, "10.0.0.1:4000", PRIORITY_NORMAL); err != context.DeadlineExceeded {
+		t.Error("Slot over the peer limit granted: ", err)
+	}
+	if _, err := limiter.Acquire(ctx, "10.0.0.2:4000", PRIORITY_NORMAL); err != nil {
+		t.Error("Slot to another peer not granted: ", err)
+	}
+	if limiter.InFlight() != 3 {
+		t.Error("Wrong number of requests in flight: ", limiter.InFlight())
+	}
+}
+
+func TestOutboundBusyPeer(t *testing.T) {
+	limiter := NewOutboundLimiter(64, 1)
+	ctx := context.Background()
+	limiter.Acquire(ctx, "10.0.0.1:4000", PRIORITY_NORMAL)
+	waiter_ctx, stop_waiter := context.WithCancel(ctx)
+	defer stop_waiter()
+	go limiter.Acquire(waiter_ctx, "10.0.0.1:4000", PRIORITY_NORMAL)
+	waitFor(func() bool {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		return len(limiter.queue) == 1
+	})
+
+	// The waiter for the busy peer does not hold back the others
+	short_ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Acquire(short_ctx, "10.0.0.2:4000", PRIORITY_NORMAL); err != nil {
+		t.Error("Slot to another peer not granted: ", err)
+	}
+}
+
+func TestOutboundPriority(t *testing.T) {
+	limiter := NewOutboundLimiter(1, 1)
+	ctx := context.Background()
+	slot, _ := limiter.Acquire(ctx, "10.0.0.1:4000", PRIORITY_NORMAL)
+
+	order := make(chan int, 2)
+	queued := 0
+	queue := func(priority int) {
+		go func() {
+			next, err := limiter.Acquire(ctx, "10.0.0.2:4000", priority)
+			if err == nil {
+				order <- priority
+				next.Release(nil)
+			}
+		}()
+		// Wait for it to be queued, to know the order of arrival
+		queued++
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			limiter.lock.Lock()
+			waiting := len(limiter.queue)
+			limiter.lock.Unlock()
+			if waiting == queued {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue(PRIORITY_LOW)
+	queue(PRIORITY_HIGH)
+
+	slot.Release(nil)
+	if first, second := <-order, <-order; first != PRIORITY_HIGH || second != PRIORITY_LOW {
+		t.Error("Queue not served by priority: ", first, second)
+	}
+}
+
+func TestOutboundWindow(t *testing.T) {
+	limiter := NewOutboundLimiter(64, 64)
+	ctx := context.Background()
+	var slots []*OutboundSlot
+	for i := 0; i < initialWindow; i++ {
+		slot, _ := limiter.Acquire(ctx, "10.0.0.1:4000", PRIORITY_NORMAL)
+		slots = append(slots, slot)
+	}
+
+	// Losses of the same window halve it once
+	slots[0].Release(errRequestTimeout)
+	slots[1].Release(errRequestTimeout)
+	if limiter.Window() != initialWindow/2 {
+		t.Fatal("Window not halved once: ", limiter.Window())
+	}
+
+	// One more slot per window of successes
+	for _, slot := range slots[2:7] {
+		slot.Release(nil)
+	}
+	if limiter.Window() != initialWindow/2+1 {
+		t.Error("Window not grown by successes: ", limiter.Window())
+	}
+
+	// Sent after the decrease, a rate limited request halves it again
+	slot, _ := limiter.Acquire(ctx, "10.0.0.1:4000", PRIORITY_NORMAL)
+	slot.Release(&ErrorReply{Code: ERR_CODE_RATE_LIMITED})
+	if limiter.Window() != (initialWindow/2+1)/2 {
+		t.Error("Window not halved by rate limiting: ", limiter.Window())
+	}
+}
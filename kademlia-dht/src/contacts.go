@@ -0,0 +1,92 @@
+package kadht
+
+import (
+	"net"
+)
+
+/*
+ * Contact learning.
+ *
+ * Every valid message received tells that its sender is alive at the
+ * datagram source address: the requests once they pass the rate limits,
+ * and the replies which answer one of our requests. The sender is
+ * recorded in the routing table as the kademlia paper prescribes. When
+ * its bucket is full, the least recently seen entry is pinged: it is
+ * kept if it answers, and the new contact is dropped, otherwise it is
+ * replaced by the new contact. Long lived nodes are thus preferred, and
+ * a flood of new IDs cannot flush the routing table.
+ *
+ * A known node seen at another address is only moved there if the new
+ * address is verified, see ratelimit.go, or if the node no longer
+ * answers at its known address. Otherwise one datagram with a spoofed
+ * source would redirect the traffic meant for the node.
+ */
+
+/*
+ * learnContact : Records that a node was seen.
+ * Parameters:
+ * [in] id : ID of the node
+ * [in] from : Address the node sent from
+ */
+func (this *RpcServer) learnContact(id NodeId, from net.Addr) {
+	if id == this.server_ctx.node_id {
+		return
+	}
+	udp_addr, err := udpAddrOf(from)
+	if err != nil || udp_addr.IP.To4() == nil {
+		// Contacts are exchanged as IPv4 addresses
+		return
+	}
+	node := CreateNode(udp_addr, id)
+	if known, found := this.routing_table.Entry(id); found && known.address.String() != udp_addr.String() {
+		if this.verified.contains(from) {
+			this.routing_table.MoveEntry(id, udp_addr)
+			return
+		}
+		this.checkContact(known, func(alive bool) {
+			if !alive {
+				this.routing_table.MoveEntry(id, udp_addr)
+			}
+		})
+		return
+	}
+
+	oldest, added := this.routing_table.UpdateEntry(node)
+	if added || oldest == nil {
+		return
+	}
+	this.checkContact(*oldest, func(alive bool) {
+		if alive {
+			// It moves to the tail of its bucket
+			this.routing_table.UpdateEntry(oldest)
+		} else {
+			this.routing_table.ReplaceEntry(oldest.id, node)
+		}
+	})
+}
+
+// checkContact: Pings an entry at its known address, then calls 'done'
+// with 'true' if it answered. One check of an entry at a time, the
+// others are dropped.
+func (this *RpcServer) checkContact(entry Node, done func(alive bool)) {
+	this.lock.Lock()
+	if this.evicting[entry.id] {
+		this.lock.Unlock()
+		return
+	}
+	this.evicting[entry.id] = true
+	this.lock.Unlock()
+
+	addr := entry.address
+	pending, err := this.Request(&addr, NewPingRequest(this.server_ctx.node_id))
+	go func() {
+		var reply IMessage
+		if err == nil {
+			reply, err = pending.Wait()
+		}
+		done(err == nil && reply.Header().SenderId == entry.id)
+		this.lock.Lock()
+		delete(this.evicting, entry.id)
+		this.lock.Unlock()
+	}()
+}
@@ -0,0 +1,130 @@
+package kadht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor: Polls the condition until it holds or a second passed
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestLearnContacts(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	if _, _, err := a.Ping(context.Background(), b.LocalAddr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	// b learns a from the request, a learns b from the reply
+	if !b.routing_table.Contains(a.server_ctx.node_id) {
+		t.Error("Requester not learned")
+	}
+	if !a.routing_table.Contains(b.server_ctx.node_id) {
+		t.Error("Replying node not learned")
+	}
+	contacts := b.routing_table.LookupClosestContacts(a.server_ctx.node_id, 1)
+	if len(contacts) != 1 || contacts[0].Addr.UDPAddr().String() != a.LocalAddr().String() {
+		t.Error("Contact learned with the wrong address: ", contacts)
+	}
+}
+
+// sameBucketId: An ID in the same bucket of the routing table of
+// 'server' as 'id'
+func sameBucketId(server *RpcServer, id NodeId) NodeId {
+	other := id
+	other[bytesPerNodeiId-1] ^= 1
+	if commonBits(server.server_ctx.node_id, other) != commonBits(server.server_ctx.node_id, id) {
+		panic("Not in the same bucket")
+	}
+	return other
+}
+
+func TestContactEviction(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	c := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	b.routing_table.SetBucketSize(1)
+	b.tracker = NewPendingTracker(20*time.Millisecond, 1)
+
+	// The bucket of a holds a node which does not answer
+	dead_addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	dead_id := sameBucketId(b, a.server_ctx.node_id)
+	b.routing_table.AddEntryOnly(CreateNode(dead_addr, dead_id))
+
+	if _, _, err := a.Ping(context.Background(), b.LocalAddr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	if !waitFor(func() bool { return b.routing_table.Contains(a.server_ctx.node_id) }) {
+		t.Fatal("Unresponsive entry not replaced")
+	}
+	if b.routing_table.Contains(dead_id) {
+		t.Error("Unresponsive entry kept")
+	}
+
+	// c, with an ID of the same bucket, does not replace a which answers
+	c.server_ctx.node_id = sameBucketId(b, a.server_ctx.node_id)
+	if _, _, err := c.Ping(context.Background(), b.LocalAddr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	waitFor(func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return len(b.evicting) == 0
+	})
+	if !b.routing_table.Contains(a.server_ctx.node_id) || b.routing_table.Contains(c.server_ctx.node_id) {
+		t.Error("Live entry evicted")
+	}
+}
+
+func TestContactMove(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	c := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	b.tracker = NewPendingTracker(20*time.Millisecond, 1)
+	a_id := a.server_ctx.node_id
+	a_addr := a.LocalAddr().(*net.UDPAddr)
+	b.routing_table.AddEntryOnly(CreateNode(a_addr, a_id))
+	checked := func() bool {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return len(b.evicting) == 0
+	}
+
+	// c claims the ID of a, which still answers at its address
+	c.server_ctx.node_id = a_id
+	pending, _ := c.Request(b.LocalAddr(), NewFindNodeRequest(a_id, generateRandomNodeId()))
+	pending.Wait()
+	waitFor(checked)
+	if entry, _ := b.routing_table.Entry(a_id); entry.address.String() != a_addr.String() {
+		t.Fatal("Contact moved by an unverified source: ", entry.address.String())
+	}
+
+	// Once a is gone, its ID moves to the new address
+	a.Close()
+	pending, _ = c.Request(b.LocalAddr(), NewFindNodeRequest(a_id, generateRandomNodeId()))
+	pending.Wait()
+	if !waitFor(func() bool {
+		entry, _ := b.routing_table.Entry(a_id)
+		return entry.address.String() == c.LocalAddr().String()
+	}) {
+		t.Error("Contact not moved once its address stopped answering")
+	}
+}
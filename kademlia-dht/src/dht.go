@@ -0,0 +1,269 @@
+package kadht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * A kademlia node.
+ *
+ * The DHT owns the parts of a node: its ServerConfig, RoutingTable,
+ * transport, value store and RPC server, and runs the background
+ * maintenance. Create one with New, then Start it to serve requests
+ * until Stop, and join the network with Bootstrap.
+ *
+ * Maintenance runs every MaintenanceInterval. It removes the expired
+ * values and pings the contacts not seen for StaleContactAge: those
+ * which do not answer are removed from the routing table.
+ */
+
+const (
+	// Number of entries per bucket, the 'k' of kademlia
+	DefaultBucketSize = 20
+	// Default period of the background maintenance
+	DefaultMaintenanceInterval = time.Minute
+	// Default time after which a silent contact is checked
+	DefaultStaleContactAge = 15 * time.Minute
+	// Max number of stale contacts pinged at once
+	maxConcurrentChecks = 8
+)
+
+var errStopped = errors.New("DHT stopped, its transport and storage are closed")
+
+/*
+ * Config : Configuration of a DHT. The zero value of a field selects
+ * its default.
+ */
+type Config struct {
+	NodeId     NodeId             // ID of the node, random if zero and no SigningKey
+	SigningKey ed25519.PrivateKey // Signs the messages, the ID is derived from it
+	ListenAddr string             // UDP address to listen on, "host:port"
+	Transport  Transport          // Used instead of listening on ListenAddr
+	Storage    Storage            // Values stored for other nodes, in memory if nil
+
+	BucketSize          int           // Entries per bucket, DefaultBucketSize
+	Alpha               int           // Parallel queries of a lookup, DefaultLookupAlpha
+	RequestTimeout      time.Duration // Timeout of requests to unknown peers, DefaultRequestTimeout
+	RequestRetries      int           // Retries of a request, DefaultRequestRetries, -1 for none
+	MaintenanceInterval time.Duration // DefaultMaintenanceInterval
+	StaleContactAge     time.Duration // DefaultStaleContactAge
+}
+
+/*
+ * DHT : A node of the distributed hash table
+ */
+type DHT struct {
+	config        Config
+	server_ctx    *ServerConfig
+	routing_table *RoutingTable
+	store         Storage
+	server        *RpcServer
+
+	lock    sync.Mutex
+	started bool
+	stopped bool           // Set by Stop, the node cannot start again
+	stop    chan struct{}  // Closed by Stop
+	workers sync.WaitGroup // Background goroutines
+}
+
+/*
+ * New : Creates a DHT node and opens its transport.
+ * Parameters:
+ * [in] config : Configuration of the node
+ * [out] *DHT : Pointer to the newly created DHT
+ * [out] error : If the transport could not be opened
+ */
+func New(config Config) (*DHT, error) {
+	if config.BucketSize <= 0 {
+		config.BucketSize = DefaultBucketSize
+	}
+	if config.Alpha <= 0 {
+		config.Alpha = DefaultLookupAlpha
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	if config.RequestRetries == 0 {
+		config.RequestRetries = DefaultRequestRetries
+	} else if config.RequestRetries < 0 {
+		config.RequestRetries = 0
+	}
+	if config.MaintenanceInterval <= 0 {
+		config.MaintenanceInterval = DefaultMaintenanceInterval
+	}
+	if config.StaleContactAge <= 0 {
+		config.StaleContactAge = DefaultStaleContactAge
+	}
+
+	var server_ctx *ServerConfig
+	switch {
+	case config.SigningKey != nil:
+		server_ctx = NewSignedServerConfig(config.SigningKey)
+	case config.NodeId != NodeId{}:
+		server_ctx = NewServerConfig(config.NodeId)
+	default:
+		server_ctx = NewServerConfig(generateRandomNodeId())
+	}
+	config.NodeId = server_ctx.node_id
+
+	routing_table := NewRoutingTable(server_ctx.node_id)
+	routing_table.SetBucketSize(config.BucketSize)
+	if config.Storage == nil {
+		config.Storage = NewMemoryStore()
+	}
+	server := NewRpcServer(server_ctx, routing_table)
+	server.SetValueStore(config.Storage)
+	server.SetRequestPolicy(config.RequestTimeout, config.RequestRetries)
+
+	if config.Transport != nil {
+		server.SetTransport(config.Transport)
+	} else {
+		if config.ListenAddr == "" {
+			return nil, errors.New("No address to listen on")
+		}
+		if err := server.Listen(config.ListenAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DHT{
+		config:        config,
+		server_ctx:    server_ctx,
+		routing_table: routing_table,
+		store:         config.Storage,
+		server:        server,
+	}, nil
+}
+
+// Start: Serves requests and runs the maintenance in the background.
+// A stopped node cannot be started again, a new one must be created.
+func (this *DHT) Start() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped {
+		return errStopped
+	}
+	if this.started {
+		return errors.New("DHT already started")
+	}
+	if err := this.server.Start(); err != nil {
+		return err
+	}
+	this.started = true
+	this.stop = make(chan struct{})
+	this.workers.Add(1)
+	go this.maintain()
+	return nil
+}
+
+// Stop: Stops the maintenance, and closes the transport and the storage,
+// whether or not the node was started. Fails with errStopped if the
+// node is already stopped.
+func (this *DHT) Stop() error {
+	this.lock.Lock()
+	if this.stopped {
+		this.lock.Unlock()
+		return errStopped
+	}
+	this.stopped = true
+	if this.started {
+		this.started = false
+		close(this.stop)
+	}
+	this.lock.Unlock()
+
+	err := this.server.Close()
+	this.workers.Wait()
+	if store_err := this.store.Close(); err == nil {
+		err = store_err
+	}
+	return err
+}
+
+// Id: ID of the node
+func (this *DHT) Id() NodeId {
+	return this.server_ctx.node_id
+}
+
+// Addr: Address the node listens on
+func (this *DHT) Addr() net.Addr {
+	return this.server.LocalAddr()
+}
+
+// RoutingTable: Contacts of the node
+func (this *DHT) RoutingTable() *RoutingTable {
+	return this.routing_table
+}
+
+// Server: RPC server of the node, to register handlers and interceptors
+func (this *DHT) Server() *RpcServer {
+	return this.server
+}
+
+// maintain: Runs the maintenance every MaintenanceInterval until Stop
+func (this *DHT) maintain() {
+	defer this.workers.Done()
+	ticker := time.NewTicker(this.config.MaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.runMaintenance()
+		}
+	}
+}
+
+// runMaintenance: One round of the maintenance
+func (this *DHT) runMaintenance() {
+	this.store.Expire()
+	this.checkStaleContacts()
+}
+
+// checkStaleContacts: Pings the contacts not seen lately, and removes
+// those which do not answer. Those which do are refreshed by the reply.
+func (this *DHT) checkStaleContacts() {
+	ctx, cancel := this.stopContext()
+	defer cancel()
+
+	slots := make(chan struct{}, maxConcurrentChecks)
+	var checks sync.WaitGroup
+	for _, node := range this.routing_table.StaleContacts(this.config.StaleContactAge) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			checks.Wait()
+			return
+		}
+		checks.Add(1)
+		go func(node *Node) {
+			defer checks.Done()
+			defer func() { <-slots }()
+			_, _, err := this.server.Ping(ctx, &node.address)
+			if err != nil && ctx.Err() == nil {
+				this.routing_table.RemoveEntry(node)
+			}
+		}(node)
+	}
+	checks.Wait()
+}
+
+// stopContext: A context cancelled by Stop
+func (this *DHT) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-this.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,144 @@
+package kadht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDHT(t *testing.T, config Config) *DHT {
+	transport, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	config.Transport = transport
+	dht, err := New(config)
+	if err != nil {
+		t.Fatal("Failed to create the DHT: ", err)
+	}
+	if err := dht.Start(); err != nil {
+		t.Fatal("Failed to start the DHT: ", err)
+	}
+	return dht
+}
+
+func TestDHTStartStop(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("DHT created without address")
+	}
+
+	a := newTestDHT(t, Config{})
+	b := newTestDHT(t, Config{NodeId: generateRandomNodeId(), BucketSize: 5})
+	if a.Start() == nil {
+		t.Error("DHT started twice")
+	}
+
+	if _, _, err := a.Server().Ping(context.Background(), b.Addr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	if !a.RoutingTable().Contains(b.Id()) || !b.RoutingTable().Contains(a.Id()) {
+		t.Error("Nodes did not learn each other")
+	}
+	if b.RoutingTable().bucket_size != 5 || a.RoutingTable().bucket_size != DefaultBucketSize {
+		t.Error("Bucket size not configured")
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Error("Failed to stop: ", err)
+	}
+	if a.Stop() != errStopped {
+		t.Error("DHT stopped twice")
+	}
+	if a.Start() != errStopped {
+		t.Error("Stopped DHT started again")
+	}
+	b.Stop()
+}
+
+func TestDHTMaintenance(t *testing.T) {
+	config := Config{
+		RequestTimeout:      10 * time.Millisecond,
+		RequestRetries:      -1,
+		MaintenanceInterval: 10 * time.Millisecond,
+		StaleContactAge:     time.Millisecond,
+	}
+	a := newTestDHT(t, config)
+	b := newTestDHT(t, Config{})
+	defer a.Stop()
+	defer b.Stop()
+
+	dead := CreateNode(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}, generateRandomNodeId())
+	a.RoutingTable().AddEntryOnly(dead)
+	a.RoutingTable().AddEntryOnly(CreateNode(b.Addr().(*net.UDPAddr), b.Id()))
+	a.store.Put(generateRandomNodeId(), []byte("value"), time.Millisecond)
+
+	if !waitFor(func() bool { return !a.RoutingTable().Contains(dead.id) }) {
+		t.Error("Unresponsive contact not removed")
+	}
+	if !a.RoutingTable().Contains(b.Id()) {
+		t.Error("Live contact removed")
+	}
+	if !waitFor(func() bool { return a.store.Len() == 0 }) {
+		t.Error("Expired value not removed")
+	}
+}
+
+func TestDHTStopNotStarted(t *testing.T) {
+	store, err := OpenDiskStore(filepath.Join(t.TempDir(), "values.log"))
+	if err != nil {
+		t.Fatal("Failed to open the store: ", err)
+	}
+	transport, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	dht, err := New(Config{Transport: transport, Storage: store})
+	if err != nil {
+		t.Fatal("Failed to create the DHT: ", err)
+	}
+
+	if err := dht.Stop(); err != nil {
+		t.Fatal("Failed to stop: ", err)
+	}
+	if _, _, err := transport.ReadFrom(make([]byte, 1)); err == nil {
+		t.Error("Transport not closed")
+	}
+	if err := store.Put(generateRandomNodeId(), []byte("value"), time.Hour); err != errStorageClosed {
+		t.Error("Storage not closed: ", err)
+	}
+	if dht.Stop() != errStopped || dht.Start() != errStopped {
+		t.Error("Stopped DHT not rejected")
+	}
+}
+
+func TestDHTStorageRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("Failed to open the store: ", err)
+	}
+	a := newTestDHT(t, Config{Storage: store})
+	b := newTestDHT(t, Config{})
+	defer b.Stop()
+
+	key := generateRandomNodeId()
+	if err := b.Server().Store(context.Background(), a.Addr(), key, []byte("value"), 0); err != nil {
+		t.Fatal("Store failed: ", err)
+	}
+	a.Stop()
+
+	// The values stored are back after a restart
+	store, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("Failed to reopen the store: ", err)
+	}
+	a = newTestDHT(t, Config{NodeId: a.Id(), Storage: store})
+	defer a.Stop()
+	value, _, err := b.Server().FindValue(context.Background(), a.Addr(), key)
+	if err != nil || !bytes.Equal(value, []byte("value")) {
+		t.Error("Value lost by the restart: ", err)
+	}
+}
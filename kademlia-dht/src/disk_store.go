@@ -0,0 +1,519 @@
+package kadht
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+ * Values stored on disk.
+ *
+ * A DiskStore appends every Put and Delete to a log file, and keeps in
+ * memory an index of where the current value of each key lies in it.
+ * Record of the log:
+ *
+ *   length  uint32  Size of the body
+ *   crc     uint32  CRC-32 (IEEE) of the body
+ *   body:
+ *     op      byte    diskOpPut or diskOpDelete
+ *     key     [20]byte
+ *     stored  int64   Time of the Put, in Unix nanoseconds
+ *     expires int64   Expiry time, in Unix nanoseconds
+ *     value   []byte  Rest of the body, empty for a Delete
+ *
+ * All integers are big endian. On open the log is replayed to rebuild
+ * the index. A record cut short or with a wrong CRC is the trace of a
+ * crash during a write: the log is truncated before it.
+ *
+ * The total size of the values alive is capped, see SetMaxBytes.
+ * Replaced, deleted and expired values are garbage left in the log.
+ * Once it is over half of the file, the log is compacted: the values
+ * still alive are copied to a new file, which then atomically replaces
+ * the log. A crash during a compaction leaves the old log intact.
+ */
+
+const (
+	diskOpPut    = 1
+	diskOpDelete = 2
+	// Size of the length and CRC of a record
+	diskRecordHeaderSize = 8
+	// Size of the body of a record without its value
+	diskRecordFixedSize = 1 + bytesPerNodeiId + 8 + 8
+	// Max size of a stored value
+	maxDiskValueSize = 16 << 20
+	// Garbage in the log below which it is not compacted
+	minCompactionGarbage = 1 << 20
+)
+
+var (
+	errStorageClosed      = errors.New("Storage closed")
+	errCorruptedRecord    = errors.New("Corrupted log record")
+	errValueTooLargeStore = errors.New("Value too large to store")
+)
+
+// Location of a value in the log
+type diskEntry struct {
+	offset int64 // Offset of the value
+	size   int   // Size of the value
+	record int64 // Size of the whole record
+	meta   ValueMeta
+}
+
+/*
+ * DiskStore : Values stored for other nodes, in an append-only log
+ */
+type DiskStore struct {
+	lock        sync.RWMutex
+	path        string
+	file        *os.File
+	size        int64 // End of the log
+	index       map[NodeId]diskEntry
+	garbage     int64 // Bytes of the log used by dead records
+	bytes       int64 // Total size of the values in the index
+	max_bytes   int64
+	sync_writes bool
+	min_garbage int64
+	closed      bool
+}
+
+/*
+ * OpenDiskStore : Opens the log at 'path', created if missing, and
+ * loads the values stored in it.
+ * Parameters:
+ * [in] path : Path of the log file
+ * [out] *DiskStore : Pointer to the opened DiskStore
+ * [out] error : If the log could not be opened or read
+ */
+func OpenDiskStore(path string) (*DiskStore, error) {
+	// Left by a compaction interrupted by a crash
+	if err := os.Remove(compactionPath(path)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DiskStore{
+		path:        path,
+		file:        file,
+		index:       make(map[NodeId]diskEntry),
+		max_bytes:   DefaultMaxStoredBytes,
+		sync_writes: true,
+		min_garbage: minCompactionGarbage,
+	}
+	if err := store.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	store.expire(time.Now())
+	return store, nil
+}
+
+// SetSyncWrites: If every write is flushed to the disk before Put and
+// Delete return, the default. Without it a crash may lose the last writes.
+func (this *DiskStore) SetSyncWrites(sync_writes bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.sync_writes = sync_writes
+}
+
+// SetMaxBytes: Max total size of the values stored, DefaultMaxStoredBytes
+// by default. Values already stored are kept. The log itself may grow
+// to twice this size before it is compacted.
+func (this *DiskStore) SetMaxBytes(max_bytes int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.max_bytes = max_bytes
+}
+
+/*
+ * Get : Finds a value.
+ * Parameters:
+ * [in] key : ID of the value
+ * [out] []byte : The value
+ * [out] ValueMeta : Its metadata
+ * [out] bool : 'false' if the value is unknown, expired or unreadable
+ */
+func (this *DiskStore) Get(key NodeId) ([]byte, ValueMeta, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	entry, found := this.index[key]
+	if this.closed || !found || time.Now().After(entry.meta.Expires) {
+		return nil, ValueMeta{}, false
+	}
+	value, err := readDiskValue(this.file, entry)
+	if err != nil {
+		fmt.Println("ERROR: Failed to read value: ", err)
+		return nil, ValueMeta{}, false
+	}
+	return value, entry.meta, true
+}
+
+/*
+ * Put : Stores a value, replacing the previous one of the key.
+ * Parameters:
+ * [in] key : ID of the value
+ * [in] value : The value
+ * [in] ttl : Time the value is kept
+ * [out] error : errStorageFull if there is no room left, or the write failed
+ */
+func (this *DiskStore) Put(key NodeId, value []byte, ttl time.Duration) error {
+	if len(value) > maxDiskValueSize {
+		return errValueTooLargeStore
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return errStorageClosed
+	}
+	now := time.Now()
+	if !this.hasRoom(key, len(value)) {
+		this.expire(now)
+		if !this.hasRoom(key, len(value)) {
+			return errStorageFull
+		}
+	}
+	meta := ValueMeta{Stored: now, Expires: now.Add(ttl)}
+	return this.append(diskOpPut, key, meta, value)
+}
+
+// Delete: Removes the value of the key
+func (this *DiskStore) Delete(key NodeId) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return errStorageClosed
+	}
+	if _, found := this.index[key]; !found {
+		return nil
+	}
+	return this.append(diskOpDelete, key, ValueMeta{}, nil)
+}
+
+// Iterate: Calls 'fn' for every value not expired, until it returns 'false'
+func (this *DiskStore) Iterate(fn func(key NodeId, value []byte, meta ValueMeta) bool) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.closed {
+		return errStorageClosed
+	}
+	now := time.Now()
+	for key, entry := range this.index {
+		if now.After(entry.meta.Expires) {
+			continue
+		}
+		value, err := readDiskValue(this.file, entry)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value, entry.meta) {
+			break
+		}
+	}
+	return nil
+}
+
+// Expire: Removes the expired values, returns how many
+func (this *DiskStore) Expire() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return 0
+	}
+	removed := this.expire(time.Now())
+	this.maybeCompact()
+	return removed
+}
+
+// Len: Number of values stored, expired ones included
+func (this *DiskStore) Len() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.index)
+}
+
+// Compact: Rewrites the log with only the values alive
+func (this *DiskStore) Compact() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return errStorageClosed
+	}
+	return this.compact()
+}
+
+// Close: Closes the log file
+func (this *DiskStore) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return errStorageClosed
+	}
+	this.closed = true
+	return this.file.Close()
+}
+
+// replay: Rebuilds the index from the log, and truncates the log
+// after its last valid record
+func (this *DiskStore) replay() error {
+	reader := bufio.NewReader(this.file)
+	var offset int64
+	for {
+		op, key, meta, value_size, record_size, err := readDiskRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptedRecord {
+			fmt.Println("ERROR: Truncating log ", this.path, " at ", offset, ": ", err)
+			if err := this.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		this.apply(op, key, diskEntry{
+			offset: offset + record_size - int64(value_size),
+			size:   value_size,
+			record: record_size,
+			meta:   meta,
+		})
+		offset += record_size
+	}
+	this.size = offset
+	return nil
+}
+
+// append: Writes a record at the end of the log and applies it to the
+// index. Called with the lock held.
+func (this *DiskStore) append(op byte, key NodeId, meta ValueMeta, value []byte) error {
+	record := appendDiskRecord(nil, op, key, meta, value)
+	if _, err := this.file.WriteAt(record, this.size); err != nil {
+		// Do not leave a partial record behind
+		this.file.Truncate(this.size)
+		return err
+	}
+	if this.sync_writes {
+		if err := this.file.Sync(); err != nil {
+			return err
+		}
+	}
+	this.apply(op, key, diskEntry{
+		offset: this.size + int64(len(record)-len(value)),
+		size:   len(value),
+		record: int64(len(record)),
+		meta:   meta,
+	})
+	this.size += int64(len(record))
+	this.maybeCompact()
+	return nil
+}
+
+// apply: Updates the index with a record of the log
+func (this *DiskStore) apply(op byte, key NodeId, entry diskEntry) {
+	if previous, found := this.index[key]; found {
+		this.garbage += previous.record
+		this.bytes -= int64(previous.size)
+	}
+	if op == diskOpDelete {
+		delete(this.index, key)
+		this.garbage += entry.record
+		return
+	}
+	this.index[key] = entry
+	this.bytes += int64(entry.size)
+}
+
+// hasRoom: If a value of 'size' bytes can be stored for the key, in
+// place of its current one. Called with the lock held.
+func (this *DiskStore) hasRoom(key NodeId, size int) bool {
+	previous, found := this.index[key]
+	if !found && len(this.index) >= maxStoredValues {
+		return false
+	}
+	return this.bytes-int64(previous.size)+int64(size) <= this.max_bytes
+}
+
+// expire: Called with the lock held
+func (this *DiskStore) expire(now time.Time) int {
+	removed := 0
+	for key, entry := range this.index {
+		if now.After(entry.meta.Expires) {
+			delete(this.index, key)
+			this.garbage += entry.record
+			this.bytes -= int64(entry.size)
+			removed++
+		}
+	}
+	return removed
+}
+
+// maybeCompact: Compacts the log once garbage is most of it. Called
+// with the lock held.
+func (this *DiskStore) maybeCompact() {
+	if this.garbage < this.min_garbage || this.garbage*2 < this.size {
+		return
+	}
+	if err := this.compact(); err != nil {
+		fmt.Println("ERROR: Failed to compact log ", this.path, ": ", err)
+	}
+}
+
+// compact: Copies the values alive to a new log, which replaces the
+// current one. Called with the lock held.
+func (this *DiskStore) compact() error {
+	tmp_path := compactionPath(this.path)
+	tmp, err := os.OpenFile(tmp_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	failed := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp_path)
+		return err
+	}
+
+	now := time.Now()
+	index := make(map[NodeId]diskEntry, len(this.index))
+	writer := bufio.NewWriter(tmp)
+	var size, bytes int64
+	var record []byte
+	for key, entry := range this.index {
+		if now.After(entry.meta.Expires) {
+			continue
+		}
+		value, err := readDiskValue(this.file, entry)
+		if err != nil {
+			return failed(err)
+		}
+		record = appendDiskRecord(record[:0], diskOpPut, key, entry.meta, value)
+		if _, err := writer.Write(record); err != nil {
+			return failed(err)
+		}
+		index[key] = diskEntry{
+			offset: size + int64(len(record)-len(value)),
+			size:   len(value),
+			record: int64(len(record)),
+			meta:   entry.meta,
+		}
+		size += int64(len(record))
+		bytes += int64(len(value))
+	}
+	if err := writer.Flush(); err != nil {
+		return failed(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return failed(err)
+	}
+	if err := os.Rename(tmp_path, this.path); err != nil {
+		return failed(err)
+	}
+	syncDir(filepath.Dir(this.path))
+
+	this.file.Close()
+	this.file = tmp
+	this.index = index
+	this.size = size
+	this.bytes = bytes
+	this.garbage = 0
+	return nil
+}
+
+// readDiskValue: Reads the value of an entry from the log
+func readDiskValue(file *os.File, entry diskEntry) ([]byte, error) {
+	value := make([]byte, entry.size)
+	if _, err := file.ReadAt(value, entry.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// compactionPath: Path of the new log written by a compaction
+func compactionPath(path string) string {
+	return path + ".compact"
+}
+
+// syncDir: Makes a rename in the directory durable, where supported
+func syncDir(dir string) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	file.Sync()
+	file.Close()
+}
+
+// appendDiskRecord: Appends the encoded record to 'data'
+func appendDiskRecord(data []byte, op byte, key NodeId, meta ValueMeta, value []byte) []byte {
+	start := len(data)
+	data = append(data, make([]byte, diskRecordHeaderSize)...)
+	data = append(data, op)
+	data = append(data, key[:]...)
+	var times [16]byte
+	binary.BigEndian.PutUint64(times[:], uint64(meta.Stored.UnixNano()))
+	binary.BigEndian.PutUint64(times[8:], uint64(meta.Expires.UnixNano()))
+	data = append(data, times[:]...)
+	data = append(data, value...)
+
+	body := data[start+diskRecordHeaderSize:]
+	binary.BigEndian.PutUint32(data[start:], uint32(len(body)))
+	binary.BigEndian.PutUint32(data[start+4:], crc32.ChecksumIEEE(body))
+	return data
+}
+
+// readDiskRecord: Reads the next record of the log. Returns io.EOF at
+// the end of the log, io.ErrUnexpectedEOF if the record is cut short.
+func readDiskRecord(reader io.Reader) (op byte, key NodeId, meta ValueMeta,
+	value_size int, record_size int64, err error) {
+
+	var header [diskRecordHeaderSize]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return
+	}
+	body_size := binary.BigEndian.Uint32(header[:])
+	if body_size < diskRecordFixedSize || body_size > diskRecordFixedSize+maxDiskValueSize {
+		err = errCorruptedRecord
+		return
+	}
+	body := make([]byte, body_size)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		err = errCorruptedRecord
+		return
+	}
+
+	op = body[0]
+	if op != diskOpPut && op != diskOpDelete {
+		err = errCorruptedRecord
+		return
+	}
+	copy(key[:], body[1:])
+	fields := body[1+bytesPerNodeiId:]
+	meta.Stored = time.Unix(0, int64(binary.BigEndian.Uint64(fields)))
+	meta.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(fields[8:])))
+	value_size = int(body_size) - diskRecordFixedSize
+	record_size = diskRecordHeaderSize + int64(body_size)
+	return
+}
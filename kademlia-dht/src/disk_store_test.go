@@ -0,0 +1,152 @@
+package kadht
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDiskStore(t *testing.T, path string) *DiskStore {
+	store, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("Failed to open the store: ", err)
+	}
+	return store
+}
+
+func TestDiskStore(t *testing.T) {
+	store := openTestDiskStore(t, filepath.Join(t.TempDir(), "values.log"))
+	defer store.Close()
+	testStorage(t, store)
+}
+
+func TestDiskStoreMaxBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store := openTestDiskStore(t, path)
+	testStorageMaxBytes(t, store, store.SetMaxBytes)
+	store.Close()
+
+	// The values replayed from the log count
+	store = openTestDiskStore(t, path)
+	defer store.Close()
+	store.SetMaxBytes(10)
+	if err := store.Put(generateRandomNodeId(), []byte("x"), time.Hour); err != errStorageFull {
+		t.Error("Replayed values not counted: ", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatal("Compaction failed: ", err)
+	}
+	if err := store.Put(generateRandomNodeId(), []byte("x"), time.Hour); err != errStorageFull {
+		t.Error("Compacted values not counted: ", err)
+	}
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store := openTestDiskStore(t, path)
+	kept, deleted := generateRandomNodeId(), generateRandomNodeId()
+	store.Put(kept, []byte("old"), time.Hour)
+	store.Put(kept, []byte("kept"), time.Hour)
+	store.Put(deleted, []byte("deleted"), time.Hour)
+	store.Delete(deleted)
+	_, meta, _ := store.Get(kept)
+	store.Close()
+
+	store = openTestDiskStore(t, path)
+	defer store.Close()
+	value, reopened_meta, found := store.Get(kept)
+	if !found || !bytes.Equal(value, []byte("kept")) {
+		t.Fatal("Value lost on reopen: ", string(value))
+	}
+	if !reopened_meta.Expires.Equal(meta.Expires) || !reopened_meta.Stored.Equal(meta.Stored) {
+		t.Error("Metadata lost on reopen: ", reopened_meta)
+	}
+	if _, _, found := store.Get(deleted); found || store.Len() != 1 {
+		t.Error("Deleted value back on reopen")
+	}
+}
+
+func TestDiskStoreTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store := openTestDiskStore(t, path)
+	key := generateRandomNodeId()
+	store.Put(key, []byte("value"), time.Hour)
+	store.Close()
+	info, _ := os.Stat(path)
+
+	// A crash in the middle of the next write
+	record := appendDiskRecord(nil, diskOpPut, generateRandomNodeId(), ValueMeta{}, []byte("lost"))
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write(record[:len(record)-2])
+	file.Close()
+
+	store = openTestDiskStore(t, path)
+	if value, _, found := store.Get(key); !found || !bytes.Equal(value, []byte("value")) {
+		t.Fatal("Value before the torn write lost")
+	}
+	if truncated, _ := os.Stat(path); truncated.Size() != info.Size() {
+		t.Error("Torn record not truncated: ", truncated.Size())
+	}
+
+	// Writes go on after the last valid record
+	other := generateRandomNodeId()
+	store.Put(other, []byte("other"), time.Hour)
+	store.Close()
+	store = openTestDiskStore(t, path)
+	defer store.Close()
+	if store.Len() != 2 {
+		t.Error("Values written after recovery lost: ", store.Len())
+	}
+
+	// A corrupted record is dropped
+	store.Close()
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0600)
+	store = openTestDiskStore(t, path)
+	if _, _, found := store.Get(other); found || store.Len() != 1 {
+		t.Error("Corrupted record loaded")
+	}
+}
+
+func TestDiskStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store := openTestDiskStore(t, path)
+	defer store.Close()
+	store.SetSyncWrites(false)
+	store.min_garbage = 0
+
+	key := generateRandomNodeId()
+	for idx := 0; idx < 100; idx++ {
+		store.Put(key, testValue(1000), time.Hour)
+	}
+	expired := generateRandomNodeId()
+	store.Put(expired, testValue(1000), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	store.Expire()
+
+	// Only the last value of the key is left
+	info, _ := os.Stat(path)
+	if info.Size() > 2000 {
+		t.Error("Log not compacted: ", info.Size())
+	}
+	if value, _, found := store.Get(key); !found || !bytes.Equal(value, testValue(1000)) {
+		t.Error("Value lost by the compaction")
+	}
+	if err := store.Put(generateRandomNodeId(), []byte("value"), time.Hour); err != nil || store.Len() != 2 {
+		t.Error("Log not writable after the compaction: ", err)
+	}
+
+	// A compaction interrupted by a crash is ignored
+	os.WriteFile(compactionPath(path), []byte("partial"), 0600)
+	reopened := openTestDiskStore(t, path)
+	defer reopened.Close()
+	if reopened.Len() != 2 {
+		t.Error("Values lost on reopen after the compaction: ", reopened.Len())
+	}
+	if _, err := os.Stat(compactionPath(path)); !os.IsNotExist(err) {
+		t.Error("Interrupted compaction not removed")
+	}
+}
@@ -0,0 +1,191 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+ * Error replies.
+ *
+ * A request which is rejected is answered with an ErrorReply echoing
+ * its RandomId, so that the requester can tell a node which refused
+ * the request from a node which is not there anymore. Datagrams
+ * rejected while being received are answered with a fixed reason per
+ * code: the details of the failure are not given to unknown sources.
+ * No error is sent back for replies, for fragments, for replayed
+ * messages or for datagrams whose header cannot even be read.
+ */
+
+// Error codes carried by an ErrorReply
+const (
+	ERR_CODE_MALFORMED       = 1 // The request could not be decoded
+	ERR_CODE_UNKNOWN_TYPE    = 2 // The message type is not supported
+	ERR_CODE_RATE_LIMITED    = 3 // Too many requests, try again later
+	ERR_CODE_VALUE_TOO_LARGE = 4 // The message or the value is too large
+	ERR_CODE_UNAUTHORIZED    = 5 // Missing or invalid signature or session
+	ERR_CODE_UNVERIFIED      = 6 // Reply too large for an unverified source, PING then retry
+)
+
+const (
+	// Upper bound on the reason carried by an ErrorReply
+	maxErrorReasonLen = 256
+)
+
+func init() {
+	registerBuiltinMessageType(ERROR_RESP, "ERROR_RESP", func(header BasicMsgHeader) IMessage {
+		return &ErrorReply{base_msg: header}
+	})
+}
+
+func ErrorCode2Str(code uint16) string {
+	switch code {
+	case ERR_CODE_MALFORMED:
+		return "MALFORMED"
+	case ERR_CODE_UNKNOWN_TYPE:
+		return "UNKNOWN_TYPE"
+	case ERR_CODE_RATE_LIMITED:
+		return "RATE_LIMITED"
+	case ERR_CODE_VALUE_TOO_LARGE:
+		return "VALUE_TOO_LARGE"
+	case ERR_CODE_UNAUTHORIZED:
+		return "UNAUTHORIZED"
+	case ERR_CODE_UNVERIFIED:
+		return "UNVERIFIED"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", code)
+}
+
+/*
+ * ErrorReply : Tells the requester why its request was rejected.
+ * Implements the error interface.
+ */
+type ErrorReply struct {
+	base_msg BasicMsgHeader
+	Code     uint16 // One of the ERR_CODE_* values
+	Reason   string // Short human readable explanation
+}
+
+/*
+ * NewErrorReply : Creates a new error reply.
+ * Parameters:
+ * [in] sender_id : Node Id of the sending node.
+ * [in] req_header : Header of the rejected request.
+ * [in] code : The error code.
+ * [in] reason : Short explanation, truncated to maxErrorReasonLen bytes.
+ * [out] *ErrorReply : Pointer to the newly created ErrorReply
+ */
+func NewErrorReply(sender_id NodeId, req_header *BasicMsgHeader, code uint16, reason string) *ErrorReply {
+	if len(reason) > maxErrorReasonLen {
+		reason = reason[:maxErrorReasonLen]
+	}
+	return &ErrorReply{
+		base_msg: *NewBasicMsgHeader(ERROR_RESP, sender_id, req_header.RandomId),
+		Code:     code,
+		Reason:   reason,
+	}
+}
+
+func (this *ErrorReply) Error() string {
+	return fmt.Sprintf("Request rejected: %s: %s", ErrorCode2Str(this.Code), this.Reason)
+}
+
+// rejectionReason: The fixed reason sent with an error code
+func rejectionReason(code uint16) string {
+	switch code {
+	case ERR_CODE_MALFORMED:
+		return "Malformed request"
+	case ERR_CODE_UNKNOWN_TYPE:
+		return "Unknown message type"
+	case ERR_CODE_VALUE_TOO_LARGE:
+		return "Message too large"
+	case ERR_CODE_UNAUTHORIZED:
+		return "Missing or invalid signature or session"
+	}
+	return ErrorCode2Str(code)
+}
+
+// errorCodeFor: The error code telling the sender why its datagram
+// was rejected with 'err'. 'false' if the sender must not be told.
+func errorCodeFor(err error) (uint16, bool) {
+	switch {
+	case err == errFragmentPending, err == errStaleMessage,
+		err == errReplayedMessage, err == errSessionReplay:
+		return 0, false
+	case errors.Is(err, errUnknownMessageType):
+		return ERR_CODE_UNKNOWN_TYPE, true
+	case err == errTransferTooLarge:
+		return ERR_CODE_VALUE_TOO_LARGE, true
+	case err == errBadSignature, err == errSenderKeyMismatch, err == errUnsignedMessage,
+		err == errNoSession, err == errUnsignedHandshake, err == errEncryptionRequired:
+		return ERR_CODE_UNAUTHORIZED, true
+	}
+	return ERR_CODE_MALFORMED, true
+}
+
+// isReplyType: If the message type is an answer to a request,
+// which must never be answered itself.
+func isReplyType(mtype uint32) bool {
+	switch mtype {
+	case PING_RESP, FIND_NODE_RESP, FIND_VALUE_RESP, STORE_RESP,
+		SESSION_INIT_RESP, FRAGMENT_DATA, FRAGMENT_NACK, ERROR_RESP:
+		return true
+	}
+	return false
+}
+
+/*
+ * rejectionReply : Builds the error reply for a received datagram
+ * which was rejected.
+ * Parameters:
+ * [in] data : The rejected datagram
+ * [in] err : Why it was rejected
+ * [in] server_ctx : Context of the local node
+ * [out] *ErrorReply : The reply, nil if none must be sent
+ */
+func rejectionReply(data []byte, err error, server_ctx *ServerConfig) *ErrorReply {
+	code, reply := errorCodeFor(err)
+	if !reply {
+		return nil
+	}
+	payload, _, _, _ := splitSignature(data)
+	header, herr := decodeMessageHeader(payload)
+	if herr != nil || isReplyType(header.MsgType) {
+		return nil
+	}
+	return NewErrorReply(server_ctx.node_id, &header, code, rejectionReason(code))
+}
+
+//************** MESSAGE SERIALIZATION-DESERIALIZATION FUNCTIONS ***************//
+
+func (this *ErrorReply) Header() *BasicMsgHeader { return &this.base_msg }
+
+func (this *ErrorReply) Serialize(writer io.Writer) bool {
+	if !this.base_msg.Serialize(writer) {
+		fmt.Println("ERROR: Failed to serialize ErrorReply header")
+		return false
+	}
+	err := binary.Write(writer, binary.BigEndian, &this.Code)
+	if err != nil || !writeBytesField(writer, []byte(this.Reason)) {
+		fmt.Println("ERROR: Failed to serialize ErrorReply")
+		return false
+	}
+	return true
+}
+
+func (this *ErrorReply) Deserialize(reader io.Reader) bool {
+	err := binary.Read(reader, binary.BigEndian, &this.Code)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize ErrorReply code")
+		return false
+	}
+	reason, ok := readBytesField(reader)
+	if !ok || len(reason) > maxErrorReasonLen {
+		fmt.Println("ERROR: Failed to deserialize ErrorReply reason")
+		return false
+	}
+	this.Reason = string(reason)
+	return true
+}
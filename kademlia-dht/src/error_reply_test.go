@@ -0,0 +1,64 @@
+package kadht
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestErrorReplyUnknownType(t *testing.T) {
+	a := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	b := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	defer a.close()
+	defer b.close()
+
+	// A request of a type b does not know about
+	header := BasicMsgHeader{
+		Version:  WIRE_VERSION_BINARY,
+		MsgType:  MSG_USER_START + 0x42,
+		SenderId: a.ctx.node_id,
+		RandomId: generateRandomNodeId(),
+	}
+	var buf bytes.Buffer
+	header.Serialize(&buf)
+	a.transport.WriteTo(buf.Bytes(), b.addr)
+
+	if msg, _ := ConsumePacket(b.transport, b.ctx); msg != nil {
+		t.Fatal("Unknown message type accepted")
+	}
+	msg, mtype := ConsumePacket(a.transport, a.ctx)
+	if mtype != ERROR_RESP {
+		t.Fatal("Error reply not received")
+	}
+	reply := msg.(*ErrorReply)
+	if reply.Code != ERR_CODE_UNKNOWN_TYPE || reply.Header().RandomId != header.RandomId {
+		t.Error("Wrong error reply: ", reply)
+	}
+}
+
+func TestNoErrorReplyToReplies(t *testing.T) {
+	ctx := NewServerConfig(generateRandomNodeId())
+	data, _ := EncodeMessage(NewPingReply(generateRandomNodeId(), NewPingRequest(ctx.node_id)))
+	data = append(data, 0x00) // Malformed extensions
+
+	_, err := DecodeDatagram(data, ctx)
+	if err == nil {
+		t.Fatal("Malformed reply accepted")
+	}
+	if rejectionReply(data, err, ctx) != nil {
+		t.Error("Error reply built for a reply")
+	}
+
+	req, _ := EncodeMessage(NewPingRequest(generateRandomNodeId()))
+	req = append(req, 0x00)
+	_, err = DecodeDatagram(req, ctx)
+	reply := rejectionReply(req, err, ctx)
+	if reply == nil || reply.Code != ERR_CODE_MALFORMED {
+		t.Fatal("No error reply for a malformed request")
+	}
+	if reply.Reason != rejectionReason(ERR_CODE_MALFORMED) {
+		t.Error("Decoding error sent to the requester: ", reply.Reason)
+	}
+	if rejectionReply(req, errReplayedMessage, ctx) != nil {
+		t.Error("Error reply built for a replayed request")
+	}
+}
@@ -0,0 +1,135 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+ * Message extensions.
+ * Any message can carry a list of type-length-value fields after its
+ * fixed body. In the binary format they are written as:
+ *
+ *   [ 0xE7 ]{ [ type (uint16) ][ length (uint16) ][ value ] }...
+ *
+ * up to the end of the message (the signature trailer, if any, comes
+ * after them). Nodes which do not know an extension type keep it in
+ * the header as is, and nodes predating the extensions stop reading
+ * after the fixed body, so new fields can be added as extensions
+ * without breaking deployed peers.
+ */
+
+const (
+	extensionsMarker = 0xE7
+	// Extension types at or above this value are free for application use
+	EXT_USER_START = 0x8000
+	// Max number of extensions on a message
+	maxExtensions = 64
+)
+
+/*
+ * Extension : A single type-length-value field of a message
+ */
+type Extension struct {
+	Type  uint16
+	Value []byte
+}
+
+/*
+ * GetExtension : Finds the value of the extension type in the header.
+ * Parameters:
+ * [in] ext_type : The extension type
+ * [out] []byte : The value of the extension
+ * [out] bool : 'true' if the header has the extension
+ */
+func (this *BasicMsgHeader) GetExtension(ext_type uint16) ([]byte, bool) {
+	for idx := range this.Extensions {
+		if this.Extensions[idx].Type == ext_type {
+			return this.Extensions[idx].Value, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * SetExtension : Adds the extension to the header, replacing any
+ * previous value of the same type.
+ */
+func (this *BasicMsgHeader) SetExtension(ext_type uint16, value []byte) {
+	for idx := range this.Extensions {
+		if this.Extensions[idx].Type == ext_type {
+			this.Extensions[idx].Value = value
+			return
+		}
+	}
+	this.Extensions = append(this.Extensions, Extension{Type: ext_type, Value: value})
+}
+
+/*
+ * RemoveExtension : Removes the extension type from the header.
+ */
+func (this *BasicMsgHeader) RemoveExtension(ext_type uint16) {
+	for idx := range this.Extensions {
+		if this.Extensions[idx].Type == ext_type {
+			this.Extensions = append(this.Extensions[:idx], this.Extensions[idx+1:]...)
+			if len(this.Extensions) == 0 {
+				this.Extensions = nil
+			}
+			return
+		}
+	}
+}
+
+// appendExtensions: Appends the binary extension block of the
+// header to the encoded message.
+func appendExtensions(data []byte, header *BasicMsgHeader) ([]byte, error) {
+	if len(header.Extensions) == 0 {
+		return data, nil
+	}
+	if len(header.Extensions) > maxExtensions {
+		return nil, fmt.Errorf("Too many message extensions: %d", len(header.Extensions))
+	}
+
+	data = append(data, extensionsMarker)
+	for _, ext := range header.Extensions {
+		if len(ext.Value) > maxBytesFieldLen {
+			return nil, fmt.Errorf("Extension %d too large: %d bytes", ext.Type, len(ext.Value))
+		}
+		var tl [4]byte
+		binary.BigEndian.PutUint16(tl[0:], ext.Type)
+		binary.BigEndian.PutUint16(tl[2:], uint16(len(ext.Value)))
+		data = append(data, tl[:]...)
+		data = append(data, ext.Value...)
+	}
+	return data, nil
+}
+
+// parseExtensions: Parses the binary extension block found after
+// the fixed body of a message.
+func parseExtensions(data []byte) ([]Extension, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[0] != extensionsMarker {
+		return nil, errors.New("Unexpected data after the message body")
+	}
+	data = data[1:]
+
+	var extensions []Extension
+	for len(data) > 0 {
+		if len(data) < 4 || len(extensions) == maxExtensions {
+			return nil, errors.New("Malformed message extensions")
+		}
+		ext_type := binary.BigEndian.Uint16(data[0:])
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, errors.New("Truncated message extension")
+		}
+		value := make([]byte, length)
+		copy(value, data[4:4+length])
+		extensions = append(extensions, Extension{Type: ext_type, Value: value})
+		data = data[4+length:]
+	}
+	return extensions, nil
+}
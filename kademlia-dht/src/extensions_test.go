@@ -0,0 +1,84 @@
+package kadht
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const (
+	testKnownExt   = EXT_USER_START + 1
+	testUnknownExt = EXT_USER_START + 2
+)
+
+func TestExtensionsRoundTrip(t *testing.T) {
+	for _, version := range []uint32{WIRE_VERSION_BINARY, WIRE_VERSION_JSON} {
+		msg := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+		msg.Header().Version = version
+		msg.Header().SetExtension(testKnownExt, []byte("value"))
+		msg.Header().SetExtension(testUnknownExt, []byte{})
+
+		data, err := EncodeMessage(msg)
+		if err != nil {
+			t.Fatal("Failed to encode: ", err)
+		}
+		decoded, err := DecodeMessage(data)
+		if err != nil {
+			t.Fatal("Failed to decode: ", err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Error("Extensions did not survive the round trip: ", decoded.Header().Extensions)
+		}
+
+		value, found := decoded.Header().GetExtension(testKnownExt)
+		if !found || string(value) != "value" {
+			t.Error("Extension not found after decoding")
+		}
+	}
+}
+
+func TestExtensionsSkippedByOldParser(t *testing.T) {
+	msg := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	msg.Header().SetExtension(testKnownExt, []byte("new field"))
+	data, _ := EncodeMessage(msg)
+
+	// Parsing stops after the fixed body, as deployed nodes do
+	parsed, mtype := ParseMessage(bytes.NewReader(data))
+	if mtype != FIND_NODE_REQ || parsed.(*FindNodeRequest).LookupNodeId != msg.LookupNodeId {
+		t.Error("Message with extensions not readable by the old parser")
+	}
+}
+
+func TestExtensionsForwarded(t *testing.T) {
+	msg := NewPingRequest(generateRandomNodeId())
+	msg.Header().SetExtension(testUnknownExt, []byte{1, 2, 3})
+	data, _ := EncodeMessage(msg)
+
+	// A node which does not know the extension re-encodes it as is
+	decoded, _ := DecodeMessage(data)
+	again, _ := EncodeMessage(decoded)
+	if !bytes.Equal(again, data) {
+		t.Error("Unknown extension not preserved")
+	}
+
+	decoded.Header().RemoveExtension(testUnknownExt)
+	if decoded.Header().Extensions != nil {
+		t.Error("Extension not removed")
+	}
+}
+
+func TestMalformedExtensions(t *testing.T) {
+	data, _ := EncodeMessage(NewPingRequest(generateRandomNodeId()))
+
+	invalid := [][]byte{
+		{0x00},                                  // no marker
+		{extensionsMarker, 0x80},                // truncated type and length
+		{extensionsMarker, 0x80, 0x01, 0, 5, 1}, // truncated value
+	}
+	for _, tail := range invalid {
+		datagram := append(append([]byte{}, data...), tail...)
+		if _, err := DecodeMessage(datagram); err == nil {
+			t.Error("Malformed extensions accepted: ", tail)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Fragmentation of large datagrams.
+ *
+ * A datagram larger than MaxUnfragmentedSize (typically a STORE request
+ * or a FIND_VALUE reply carrying a large value) is sent as a series of
+ * FragmentData messages, all sharing the RandomId of the transfer.
+ * The receiver puts them back together and decodes the result as if it
+ * had been received in one piece, so the signature, session and replay
+ * checks all apply to the complete message.
+ *
+ * Lost fragments are recovered by the receiver: a transfer which makes
+ * no progress for fragmentNackInterval is answered with a FragmentNack
+ * listing the missing fragments, which the sender then sends again from
+ * the copy it keeps for fragmentRetainTime. Only the peer the transfer
+ * was sent to can request fragments, and only fragmentMaxNacks times,
+ * so that a spoofed FragmentNack cannot turn the node into a reflector.
+ *
+ * Fragments and their requests are always in the binary format, so
+ * they can be recognized without decoding them.
+ */
+
+const (
+	// Datagrams up to this size are sent as is. Keeps clear of IP
+	// fragmentation on common paths.
+	MaxUnfragmentedSize = 1200
+	// Bytes of the datagram carried by one fragment
+	fragmentDataSize = 1100
+	// Default max size of a datagram sent or received in fragments
+	DefaultMaxTransferSize = 1 << 20
+	// Max number of transfers being reassembled at once
+	maxReassemblies = 64
+	// Time without progress before missing fragments are requested
+	fragmentNackInterval = 500 * time.Millisecond
+	// Number of requests for missing fragments before giving up
+	fragmentMaxNacks = 4
+	// Time the sender keeps the fragments for retransmission
+	fragmentRetainTime = 10 * time.Second
+	// Max bytes the sender keeps for retransmission
+	maxRetainedBytes = 16 << 20
+)
+
+var (
+	errFragmentPending  = errors.New("Fragment received, message not complete yet")
+	errTransferTooLarge = errors.New("Message larger than the allowed transfer size")
+)
+
+func init() {
+	registerBuiltinMessageType(FRAGMENT_DATA, "FRAGMENT_DATA", func(header BasicMsgHeader) IMessage {
+		return &FragmentData{base_msg: header}
+	})
+	registerBuiltinMessageType(FRAGMENT_NACK, "FRAGMENT_NACK", func(header BasicMsgHeader) IMessage {
+		return &FragmentNack{base_msg: header}
+	})
+}
+
+/*
+ * FragmentData : One piece of a large datagram. The RandomId of the
+ * header identifies the transfer.
+ */
+type FragmentData struct {
+	base_msg BasicMsgHeader
+	Index    uint16 // Position of this fragment
+	Count    uint16 // Number of fragments of the transfer
+	TotalLen uint32 // Size of the complete datagram
+	Data     []byte
+}
+
+/*
+ * FragmentNack : Requests the missing fragments of a transfer.
+ * The RandomId of the header identifies the transfer.
+ */
+type FragmentNack struct {
+	base_msg BasicMsgHeader
+	Missing  []uint16 // Indexes of the missing fragments
+}
+
+// isFragmentDatagram: If the datagram is a FragmentData or a FragmentNack
+func isFragmentDatagram(data []byte) bool {
+	if len(data) < 8 || binary.BigEndian.Uint32(data) != WIRE_VERSION_BINARY {
+		return false
+	}
+	mtype := binary.BigEndian.Uint32(data[4:])
+	return mtype == FRAGMENT_DATA || mtype == FRAGMENT_NACK
+}
+
+//************************* SENDER SIDE *************************//
+
+// Fragments of a datagram kept for retransmission
+type sentTransfer struct {
+	transfer_id NodeId
+	to          string // Address of the peer
+	peer_id     NodeId // SenderId of its first FragmentNack
+	nacks       int    // FragmentNacks answered
+	fragments   []*FragmentData
+	size        int
+	sent_time   time.Time
+}
+
+/*
+ * Fragmenter : Splits large datagrams and keeps their fragments
+ * until they can no longer be requested.
+ */
+type Fragmenter struct {
+	lock           sync.Mutex
+	transfers      map[NodeId]*sentTransfer
+	order          []*sentTransfer // Oldest first
+	retained_bytes int
+}
+
+func NewFragmenter() *Fragmenter {
+	return &Fragmenter{
+		transfers: make(map[NodeId]*sentTransfer),
+	}
+}
+
+/*
+ * Split : Splits a datagram into fragments.
+ * Parameters:
+ * [in] local_id : Node Id of the local node
+ * [in] to : Address of the peer, the only one allowed to request
+ *           the fragments again
+ * [in] datagram : The complete datagram
+ * [out] []*FragmentData : The fragments to send
+ */
+func (this *Fragmenter) Split(local_id NodeId, to string, datagram []byte) []*FragmentData {
+	transfer_id := generateRandomNodeId()
+	count := (len(datagram) + fragmentDataSize - 1) / fragmentDataSize
+	transfer := &sentTransfer{
+		transfer_id: transfer_id,
+		to:          to,
+		fragments:   make([]*FragmentData, count),
+		size:        len(datagram),
+		sent_time:   time.Now(),
+	}
+	for idx := range transfer.fragments {
+		end := (idx + 1) * fragmentDataSize
+		if end > len(datagram) {
+			end = len(datagram)
+		}
+		transfer.fragments[idx] = &FragmentData{
+			base_msg: *NewBasicMsgHeader(FRAGMENT_DATA, local_id, transfer_id),
+			Index:    uint16(idx),
+			Count:    uint16(count),
+			TotalLen: uint32(len(datagram)),
+			Data:     datagram[idx*fragmentDataSize : end],
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.expire(transfer.sent_time, transfer.size)
+	this.transfers[transfer_id] = transfer
+	this.order = append(this.order, transfer)
+	this.retained_bytes += transfer.size
+	return transfer.fragments
+}
+
+// expire: Forgets the transfers which are too old, and the oldest
+// ones until 'needed' more bytes can be retained.
+func (this *Fragmenter) expire(now time.Time, needed int) {
+	for len(this.order) > 0 {
+		oldest := this.order[0]
+		if now.Sub(oldest.sent_time) < fragmentRetainTime &&
+			this.retained_bytes+needed <= maxRetainedBytes {
+			break
+		}
+		delete(this.transfers, oldest.transfer_id)
+		this.retained_bytes -= oldest.size
+		this.order = this.order[1:]
+	}
+}
+
+/*
+ * Retransmit : Finds the fragments requested by a FragmentNack.
+ * Parameters:
+ * [in] nack : The received request
+ * [in] from : Address the request came from
+ * [out] []*FragmentData : The fragments to send again to 'from', none
+ *                         if the transfer is unknown, already forgotten,
+ *                         or was not sent to the requester
+ */
+func (this *Fragmenter) Retransmit(nack *FragmentNack, from net.Addr) []*FragmentData {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.expire(time.Now(), 0)
+	transfer, found := this.transfers[nack.base_msg.RandomId]
+	if !found || from.String() != transfer.to || transfer.nacks >= fragmentMaxNacks {
+		return nil
+	}
+	sender_id := nack.base_msg.SenderId
+	if transfer.nacks > 0 && sender_id != transfer.peer_id {
+		return nil
+	}
+	transfer.peer_id = sender_id
+	transfer.nacks++
+
+	var fragments []*FragmentData
+	for _, idx := range nack.Missing {
+		if int(idx) < len(transfer.fragments) {
+			fragments = append(fragments, transfer.fragments[idx])
+		}
+	}
+	return fragments
+}
+
+//************************* RECEIVER SIDE *************************//
+
+// Identifies a transfer being reassembled
+type reassemblyKey struct {
+	sender_id   NodeId
+	transfer_id NodeId
+}
+
+// A datagram being reassembled
+type reassembly struct {
+	key           reassemblyKey
+	from          net.Addr // Where missing fragments are requested from
+	data          []byte
+	received      []bool
+	missing       int
+	last_progress time.Time
+	nacks         int
+}
+
+/*
+ * Reassembler : Puts fragmented datagrams back together.
+ */
+type Reassembler struct {
+	lock           sync.Mutex
+	max_size       int
+	reassemblies   map[reassemblyKey]*reassembly
+	buffered_bytes int
+}
+
+/*
+ * NewReassembler : Creates a new reassembler.
+ * Parameters:
+ * [in] max_size : Max size of a reassembled datagram
+ */
+func NewReassembler(max_size int) *Reassembler {
+	return &Reassembler{
+		max_size:     max_size,
+		reassemblies: make(map[reassemblyKey]*reassembly),
+	}
+}
+
+/*
+ * Add : Adds a received fragment.
+ * Parameters:
+ * [in] frag : The fragment
+ * [in] from : Address the fragment came from
+ * [out] []byte : The complete datagram, once all its fragments arrived
+ * [out] error : errFragmentPending while fragments are missing, or why
+ *               the fragment was dropped
+ */
+func (this *Reassembler) Add(frag *FragmentData, from net.Addr) ([]byte, error) {
+	count := int(frag.Count)
+	total := int(frag.TotalLen)
+	if total > this.max_size {
+		return nil, errTransferTooLarge
+	}
+	if count == 0 || count != (total+fragmentDataSize-1)/fragmentDataSize ||
+		int(frag.Index) >= count {
+		return nil, errors.New("Invalid fragment")
+	}
+	offset := int(frag.Index) * fragmentDataSize
+	expected_len := fragmentDataSize
+	if int(frag.Index) == count-1 {
+		expected_len = total - offset
+	}
+	if len(frag.Data) != expected_len {
+		return nil, errors.New("Invalid fragment length")
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := reassemblyKey{sender_id: frag.base_msg.SenderId, transfer_id: frag.base_msg.RandomId}
+	entry, found := this.reassemblies[key]
+	if !found {
+		if len(this.reassemblies) >= maxReassemblies ||
+			this.buffered_bytes+total > maxReassemblies*this.max_size/4 {
+			return nil, errors.New("Too many messages being reassembled")
+		}
+		entry = &reassembly{
+			key:      key,
+			data:     make([]byte, total),
+			received: make([]bool, count),
+			missing:  count,
+		}
+		this.reassemblies[key] = entry
+		this.buffered_bytes += total
+	} else if len(entry.data) != total || len(entry.received) != count {
+		return nil, errors.New("Fragment does not match its transfer")
+	}
+
+	if from != nil {
+		entry.from = from
+	}
+	if entry.received[frag.Index] {
+		return nil, errFragmentPending
+	}
+	copy(entry.data[offset:], frag.Data)
+	entry.received[frag.Index] = true
+	entry.missing--
+	entry.last_progress = time.Now()
+	entry.nacks = 0
+
+	if entry.missing > 0 {
+		return nil, errFragmentPending
+	}
+	this.remove(entry)
+	return entry.data, nil
+}
+
+// Pending: Number of messages being reassembled
+func (this *Reassembler) Pending() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.reassemblies)
+}
+
+func (this *Reassembler) remove(entry *reassembly) {
+	delete(this.reassemblies, entry.key)
+	this.buffered_bytes -= len(entry.data)
+}
+
+/*
+ * Stalled : Builds the requests for the missing fragments of the
+ * transfers which made no progress lately. Transfers still stalled
+ * after fragmentMaxNacks requests are dropped.
+ * Parameters:
+ * [in] local_id : Node Id of the local node
+ * [out] []*FragmentNack : The requests to send
+ * [out] []net.Addr : Where to send each of them
+ */
+func (this *Reassembler) Stalled(local_id NodeId) ([]*FragmentNack, []net.Addr) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var nacks []*FragmentNack
+	var addrs []net.Addr
+	now := time.Now()
+	for _, entry := range this.reassemblies {
+		if now.Sub(entry.last_progress) < fragmentNackInterval*time.Duration(entry.nacks+1) {
+			continue
+		}
+		if entry.nacks >= fragmentMaxNacks || entry.from == nil {
+			this.remove(entry)
+			continue
+		}
+		entry.nacks++
+
+		nack := &FragmentNack{
+			base_msg: *NewBasicMsgHeader(FRAGMENT_NACK, local_id, entry.key.transfer_id),
+		}
+		for idx, received := range entry.received {
+			if !received && len(nack.Missing) < maxListEntries {
+				nack.Missing = append(nack.Missing, uint16(idx))
+			}
+		}
+		nacks = append(nacks, nack)
+		addrs = append(addrs, entry.from)
+	}
+	return nacks, addrs
+}
+
+//************** MESSAGE SERIALIZATION-DESERIALIZATION FUNCTIONS ***************//
+
+func (this *FragmentData) Header() *BasicMsgHeader { return &this.base_msg }
+func (this *FragmentNack) Header() *BasicMsgHeader { return &this.base_msg }
+
+func (this *FragmentData) Serialize(writer io.Writer) bool {
+	if !this.base_msg.Serialize(writer) {
+		fmt.Println("ERROR: Failed to serialize FragmentData header")
+		return false
+	}
+	err := binary.Write(writer, binary.BigEndian, &this.Index)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &this.Count)
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &this.TotalLen)
+	}
+	if err != nil || !writeBytesField(writer, this.Data) {
+		fmt.Println("ERROR: Failed to serialize FragmentData")
+		return false
+	}
+	return true
+}
+
+func (this *FragmentData) Deserialize(reader io.Reader) bool {
+	err := binary.Read(reader, binary.BigEndian, &this.Index)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &this.Count)
+	}
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &this.TotalLen)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize FragmentData")
+		return false
+	}
+	var ok bool
+	this.Data, ok = readBytesField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize FragmentData data")
+	}
+	return ok
+}
+
+func (this *FragmentNack) Serialize(writer io.Writer) bool {
+	if !this.base_msg.Serialize(writer) {
+		fmt.Println("ERROR: Failed to serialize FragmentNack header")
+		return false
+	}
+	total := uint16(len(this.Missing))
+	err := binary.Write(writer, binary.BigEndian, &total)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, this.Missing)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to serialize FragmentNack")
+		return false
+	}
+	return true
+}
+
+func (this *FragmentNack) Deserialize(reader io.Reader) bool {
+	var total uint16
+	err := binary.Read(reader, binary.BigEndian, &total)
+	if err != nil || total > maxListEntries {
+		fmt.Println("ERROR: Failed to deserialize FragmentNack")
+		return false
+	}
+	this.Missing = make([]uint16, total)
+	err = binary.Read(reader, binary.BigEndian, this.Missing)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize FragmentNack missing list")
+		return false
+	}
+	return true
+}
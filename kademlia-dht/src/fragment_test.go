@@ -0,0 +1,155 @@
+package kadht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func testValue(size int) []byte {
+	value := make([]byte, size)
+	for idx := range value {
+		value[idx] = byte(idx)
+	}
+	return value
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	sender_ctx := newSignedTestConfig(t)
+	receiver_ctx := NewServerConfig(generateRandomNodeId())
+	receiver_ctx.RequireSignatures(true)
+	receiver_ctx.EnableReplayProtection(DefaultMaxClockSkew, 0)
+
+	store_req := NewStoreRequest(sender_ctx.node_id, generateRandomNodeId(), testValue(10000), 0)
+	data, _ := EncodeDatagram(store_req, sender_ctx)
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	fragments := sender_ctx.fragmenter.Split(sender_ctx.node_id, to.String(), data)
+	if len(fragments) < 2 {
+		t.Fatal("Datagram not fragmented")
+	}
+
+	// Deliver all but the first one, some twice
+	for _, frag := range append(fragments[1:], fragments[2]) {
+		frag_data, _ := EncodeMessage(frag)
+		if _, err := receiveDatagram(frag_data, from, receiver_ctx); err != errFragmentPending {
+			t.Fatal("Incomplete message not pending: ", err)
+		}
+	}
+
+	// The receiver asks for the missing one once the transfer stalls
+	receiver_ctx.reassembler.reassemblies[reassemblyKey{sender_ctx.node_id,
+		fragments[0].base_msg.RandomId}].last_progress = time.Now().Add(-time.Minute)
+	nacks, addrs := receiver_ctx.reassembler.Stalled(receiver_ctx.node_id)
+	if len(nacks) != 1 || addrs[0] != from || len(nacks[0].Missing) != 1 || nacks[0].Missing[0] != 0 {
+		t.Fatal("Missing fragment not requested: ", nacks)
+	}
+
+	nack_data, _ := EncodeMessage(nacks[0])
+	nack, err := receiveDatagram(nack_data, nil, sender_ctx)
+	if err != nil {
+		t.Fatal("Fragment nack rejected: ", err)
+	}
+	resent := sender_ctx.fragmenter.Retransmit(nack.(*FragmentNack), to)
+	if len(resent) != 1 {
+		t.Fatal("Missing fragment not resent")
+	}
+	frag_data, _ := EncodeMessage(resent[0])
+	msg, err := receiveDatagram(frag_data, from, receiver_ctx)
+	if err != nil {
+		t.Fatal("Reassembled message rejected: ", err)
+	}
+	if !bytes.Equal(msg.(*StoreRequest).Value, store_req.Value) {
+		t.Error("Value corrupted by the reassembly")
+	}
+	if receiver_ctx.reassembler.Pending() != 0 {
+		t.Error("Reassembled message not forgotten")
+	}
+}
+
+func TestFragmentRetransmitOrigin(t *testing.T) {
+	fragmenter := NewFragmenter()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	fragments := fragmenter.Split(generateRandomNodeId(), to.String(), testValue(5000))
+	peer_id := generateRandomNodeId()
+	transfer_id := fragments[0].base_msg.RandomId
+	nack := &FragmentNack{
+		base_msg: *NewBasicMsgHeader(FRAGMENT_NACK, peer_id, transfer_id),
+		Missing:  []uint16{0, 1, 2},
+	}
+
+	// Spoofed requests from other addresses
+	victim := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	if resent := fragmenter.Retransmit(nack, victim); len(resent) != 0 {
+		t.Error("Fragments resent to another address")
+	}
+	if resent := fragmenter.Retransmit(nack, to); len(resent) != 3 {
+		t.Fatal("Fragments not resent to the peer: ", len(resent))
+	}
+	other := &FragmentNack{
+		base_msg: *NewBasicMsgHeader(FRAGMENT_NACK, generateRandomNodeId(), transfer_id),
+		Missing:  []uint16{0},
+	}
+	if resent := fragmenter.Retransmit(other, to); len(resent) != 0 {
+		t.Error("Fragments resent for another node")
+	}
+
+	// A bounded number of times
+	for idx := 1; idx < fragmentMaxNacks; idx++ {
+		fragmenter.Retransmit(nack, to)
+	}
+	if resent := fragmenter.Retransmit(nack, to); len(resent) != 0 {
+		t.Error("Fragments resent too many times")
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	sender_ctx := NewServerConfig(generateRandomNodeId())
+	receiver_ctx := NewServerConfig(generateRandomNodeId())
+	if err := receiver_ctx.SetMaxTransferSize(4000); err != nil {
+		t.Fatal("Failed to set the max transfer size: ", err)
+	}
+
+	store_req := NewStoreRequest(sender_ctx.node_id, generateRandomNodeId(), testValue(5000), 0)
+	data, _ := EncodeDatagram(store_req, sender_ctx)
+	frag_data, _ := EncodeMessage(sender_ctx.fragmenter.Split(sender_ctx.node_id, "127.0.0.1:5000", data)[0])
+	if _, err := DecodeDatagram(frag_data, receiver_ctx); err != errTransferTooLarge {
+		t.Error("Too large message accepted: ", err)
+	}
+	if receiver_ctx.reassembler.Pending() != 0 {
+		t.Error("Too large message buffered")
+	}
+
+	// Fragment inconsistent with the announced size
+	frag := sender_ctx.fragmenter.Split(sender_ctx.node_id, "127.0.0.1:5000", testValue(3000))[0]
+	frag.Count = 5
+	frag_data, _ = EncodeMessage(frag)
+	if _, err := DecodeDatagram(frag_data, receiver_ctx); err == nil || err == errFragmentPending {
+		t.Error("Invalid fragment accepted")
+	}
+}
+
+func TestLargeValueTransfer(t *testing.T) {
+	a := newEncryptedEndpoint(t, false)
+	b := newEncryptedEndpoint(t, false)
+	defer a.close()
+	defer b.close()
+
+	key := generateRandomNodeId()
+	value := testValue(50000)
+	if !SendStoreRequest(a.transport, b.addr, key, value, 0, a.ctx) {
+		t.Fatal("Failed to send store request")
+	}
+	msg, _ := ConsumePacket(b.transport, b.ctx)
+	store_req, ok := msg.(*StoreRequest)
+	if !ok || store_req.Key != key || !bytes.Equal(store_req.Value, value) {
+		t.Fatal("Large store request not received")
+	}
+
+	// Too large for the sender
+	a.ctx.SetMaxTransferSize(10000)
+	if SendStoreRequest(a.transport, b.addr, key, value, 0, a.ctx) {
+		t.Error("Message above the max transfer size sent")
+	}
+}
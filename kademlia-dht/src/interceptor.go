@@ -0,0 +1,84 @@
+package kadht
+
+import (
+	"net"
+)
+
+/*
+ * Interceptors of the RPC server.
+ *
+ * Every message read by the server goes through the chain of inbound
+ * interceptors before it is handled, and every message it sends,
+ * requests, retries and replies, through the chain of outbound
+ * interceptors. So do the error replies to rejected datagrams, the
+ * fragment NACKs and the fragments sent again. A message too large
+ * for one datagram goes through the chain whole, before it is split
+ * in fragments. An interceptor calls 'next' to go on with the message,
+ * and may look at or change the message and its result before and after.
+ * It may also stop the message: an inbound interceptor by returning
+ * its own reply, or nil, without calling next; an outbound one by
+ * returning without calling next, an error to fail the send.
+ *
+ * Interceptors run in the order they were registered, the first one
+ * sees the message first.
+ */
+
+/*
+ * InboundHandler : Handles a received message.
+ * Parameters:
+ * [in] msg : The message
+ * [in] from : Address of the sender
+ * [out] IMessage : The reply to send, nil to send none
+ */
+type InboundHandler func(msg IMessage, from net.Addr) IMessage
+
+/*
+ * InboundInterceptor : Wraps the handling of received messages.
+ * Parameters:
+ * [in] msg : The message
+ * [in] from : Address of the sender
+ * [in] next : Handles the message, the rest of the chain
+ * [out] IMessage : The reply to send, nil to send none
+ */
+type InboundInterceptor func(msg IMessage, from net.Addr, next InboundHandler) IMessage
+
+/*
+ * OutboundSender : Sends a message.
+ * Parameters:
+ * [in] msg : The message
+ * [in] to : Address of the peer
+ * [out] error : If the message could not be sent
+ */
+type OutboundSender func(msg IMessage, to net.Addr) error
+
+/*
+ * OutboundInterceptor : Wraps the sending of messages.
+ * Parameters:
+ * [in] msg : The message
+ * [in] to : Address of the peer
+ * [in] next : Sends the message, the rest of the chain
+ * [out] error : If the message could not be sent
+ */
+type OutboundInterceptor func(msg IMessage, to net.Addr, next OutboundSender) error
+
+// chainInbound: Wraps the handler in the interceptors, first one outermost
+func chainInbound(interceptors []InboundInterceptor, handler InboundHandler) InboundHandler {
+	for idx := len(interceptors) - 1; idx >= 0; idx-- {
+		interceptor, next := interceptors[idx], handler
+		handler = func(msg IMessage, from net.Addr) IMessage {
+			return interceptor(msg, from, next)
+		}
+	}
+	return handler
+}
+
+// chainOutbound: Wraps the sender in the interceptors, first one outermost
+func chainOutbound(interceptors []OutboundInterceptor, sender OutboundSender) OutboundSender {
+	for idx := len(interceptors) - 1; idx >= 0; idx-- {
+		interceptor, next := interceptors[idx], sender
+		sender = func(msg IMessage, to net.Addr) error {
+			return interceptor(msg, to, next)
+		}
+	}
+	return sender
+}
@@ -0,0 +1,127 @@
+package kadht
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInboundInterceptors(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	var lock sync.Mutex
+	var calls []string
+	logger := func(name string) InboundInterceptor {
+		return func(msg IMessage, from net.Addr, next InboundHandler) IMessage {
+			reply := next(msg, from)
+			lock.Lock()
+			defer lock.Unlock()
+			if msg.Header().MsgType == PING_REQ && reply != nil {
+				calls = append(calls, name+" "+MsgType2Str(reply.Header().MsgType))
+			}
+			return reply
+		}
+	}
+	b.InterceptInbound(logger("first"))
+	b.InterceptInbound(logger("second"))
+
+	// Only a is allowed to store
+	allowed := a.server_ctx.node_id
+	b.InterceptInbound(func(msg IMessage, from net.Addr, next InboundHandler) IMessage {
+		if msg.Header().MsgType == STORE_REQ && msg.Header().SenderId != allowed {
+			return NewErrorReply(b.server_ctx.node_id, msg.Header(), ERR_CODE_UNAUTHORIZED, "Not allowed to store")
+		}
+		return next(msg, from)
+	})
+
+	if _, _, err := a.Ping(context.Background(), b.LocalAddr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	lock.Lock()
+	// b may have pinged a back meanwhile, to verify its address
+	if len(calls) < 2 || calls[0] != "second PING_RESP" || calls[1] != "first PING_RESP" {
+		t.Error("Interceptors not called in order: ", calls)
+	}
+	lock.Unlock()
+
+	key := generateRandomNodeId()
+	if err := a.Store(context.Background(), b.LocalAddr(), key, []byte("value"), 0); err != nil {
+		t.Error("Allowed store rejected: ", err)
+	}
+	allowed = generateRandomNodeId()
+	err := a.Store(context.Background(), b.LocalAddr(), key, []byte("other"), 0)
+	if error_reply, ok := err.(*ErrorReply); !ok || error_reply.Code != ERR_CODE_UNAUTHORIZED {
+		t.Error("Store not rejected by the interceptor: ", err)
+	}
+	if value, _ := b.lookupValue(key); string(value) != "value" {
+		t.Error("Rejected store applied")
+	}
+}
+
+func TestOutboundInterceptorsRejections(t *testing.T) {
+	a := newTestServer(t)
+	defer a.Close()
+	var lock sync.Mutex
+	var sent []uint32
+	a.InterceptOutbound(func(msg IMessage, to net.Addr, next OutboundSender) error {
+		lock.Lock()
+		sent = append(sent, msg.Header().MsgType)
+		lock.Unlock()
+		return next(msg, to)
+	})
+
+	conn, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer conn.Close()
+	data, _ := EncodeMessage(NewPingRequest(generateRandomNodeId()))
+	conn.WriteTo(append(data, 0x00), a.LocalAddr())
+
+	if !waitFor(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(sent) == 1 && sent[0] == ERROR_RESP
+	}) {
+		t.Error("Error reply to a malformed request not intercepted")
+	}
+}
+
+func TestOutboundInterceptors(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	a.tracker = NewPendingTracker(20*time.Millisecond, 2)
+
+	// Drop the first lookup sent
+	var lock sync.Mutex
+	sent := 0
+	a.InterceptOutbound(func(msg IMessage, to net.Addr, next OutboundSender) error {
+		if msg.Header().MsgType != FIND_NODE_REQ {
+			return next(msg, to)
+		}
+		lock.Lock()
+		sent++
+		first := sent == 1
+		lock.Unlock()
+		if first {
+			return nil
+		}
+		return next(msg, to)
+	})
+
+	if _, err := a.FindNode(context.Background(), b.LocalAddr(), generateRandomNodeId()); err != nil {
+		t.Fatal("Request not retried after the dropped attempt: ", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if sent != 2 {
+		t.Error("Retry not intercepted: ", sent)
+	}
+}
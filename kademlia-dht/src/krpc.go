@@ -0,0 +1,629 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * KRPC codec for talking to BitTorrent Mainline DHT nodes (BEP 5).
+ * The KRPC queries and responses are mapped onto the kadht messages:
+ *
+ *   ping          : PingRequest / PingReply
+ *   find_node     : FindNodeRequest / FindNodeReply
+ *   get_peers     : FindValueRequest / KrpcGetPeersReply
+ *   announce_peer : KrpcAnnouncePeerRequest / PingReply
+ *
+ * KRPC responses do not carry the query name, so the codec remembers
+ * the outstanding queries it encoded by their transaction ID and the
+ * address of the queried node. A response from any other address does
+ * not answer the query, transaction IDs being easy to guess.
+ */
+
+const (
+	// Message types specific to the Mainline DHT which have
+	// no equivalent in the kadht protocol.
+	MSG_KRPC_START = 0x100 + iota
+	KRPC_GET_PEERS_RESP
+	KRPC_ANNOUNCE_PEER_REQ
+)
+
+const (
+	krpcCompactNodeLen = bytesPerNodeiId + 6
+	krpcCompactPeerLen = 6
+	// Max length of a transaction ID of a remote query that
+	// can be kept in the RandomId of the message header.
+	krpcMaxTidLen = bytesPerNodeiId - 1
+	// Outstanding queries not answered within this time are forgotten
+	krpcPendingTimeout = 60 * time.Second
+)
+
+func init() {
+	registerBuiltinMessageType(KRPC_GET_PEERS_RESP, "KRPC_GET_PEERS_RESP", func(header BasicMsgHeader) IMessage {
+		return &KrpcGetPeersReply{base_msg: header}
+	})
+	registerBuiltinMessageType(KRPC_ANNOUNCE_PEER_REQ, "KRPC_ANNOUNCE_PEER_REQ", func(header BasicMsgHeader) IMessage {
+		return &KrpcAnnouncePeerRequest{base_msg: header}
+	})
+}
+
+/*
+ * KrpcGetPeersReply : Answer to a get_peers query. Carries either
+ * the peers of the torrent or the nodes closest to the info hash.
+ */
+type KrpcGetPeersReply struct {
+	base_msg BasicMsgHeader
+	Token    []byte       // Write token required for announce_peer
+	Values   []Ipv4Addr   // Peers of the torrent
+	Nodes    []RemoteNode // Closest nodes, if no peers are known
+}
+
+/*
+ * KrpcAnnouncePeerRequest : Announces that the sender is a peer
+ * of the torrent identified by InfoHash.
+ */
+type KrpcAnnouncePeerRequest struct {
+	base_msg    BasicMsgHeader
+	InfoHash    NodeId
+	Port        uint16
+	ImpliedPort bool   // Use the UDP source port instead of Port
+	Token       []byte // Token received in the get_peers reply
+}
+
+/*
+ * KrpcError : Error message received from a Mainline DHT node.
+ */
+type KrpcError struct {
+	Code    int64
+	Message string
+}
+
+func (this *KrpcError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", this.Code, this.Message)
+}
+
+/*
+ * NewKrpcGetPeersReply : Create a new get_peers reply.
+ * Parameters:
+ * [in] sender_id : Node Id of the sending node.
+ * [in] req : The get_peers query, decoded as FindValueRequest.
+ * [in] token : Write token handed to the querying node.
+ * [in] values : Known peers of the torrent.
+ * [in] nodes : Closest nodes, used when no peers are known.
+ * [out] *KrpcGetPeersReply : Pointer to the newly created reply
+ */
+func NewKrpcGetPeersReply(sender_id NodeId, req *FindValueRequest, token []byte,
+	values []Ipv4Addr, nodes []RemoteNode) *KrpcGetPeersReply {
+	return &KrpcGetPeersReply{
+		base_msg: *NewBasicMsgHeader(KRPC_GET_PEERS_RESP, sender_id, req.base_msg.RandomId),
+		Token:    token,
+		Values:   values,
+		Nodes:    nodes,
+	}
+}
+
+/*
+ * NewKrpcAnnouncePeerRequest : Create a new announce_peer query.
+ */
+func NewKrpcAnnouncePeerRequest(sender_id, info_hash NodeId, port uint16,
+	implied_port bool, token []byte) *KrpcAnnouncePeerRequest {
+	return &KrpcAnnouncePeerRequest{
+		base_msg:    *NewBasicMsgHeader(KRPC_ANNOUNCE_PEER_REQ, sender_id, generateRandomNodeId()),
+		InfoHash:    info_hash,
+		Port:        port,
+		ImpliedPort: implied_port,
+		Token:       token,
+	}
+}
+
+//************************* KRPC CODEC *************************//
+
+// Key of an outstanding query: transaction ID and address of the
+// queried node
+type krpcPendingKey struct {
+	tid  string
+	addr string
+}
+
+// An outstanding query encoded by the codec
+type krpcPending struct {
+	method    string
+	random_id NodeId
+	sent_time time.Time
+}
+
+/*
+ * KrpcCodec : Translates between kadht messages and KRPC packets.
+ * A single codec must be used for all the packets exchanged on a
+ * socket, since responses are decoded using the state kept while
+ * encoding the queries.
+ */
+type KrpcCodec struct {
+	lock     sync.Mutex
+	next_tid uint16
+	pending  map[krpcPendingKey]krpcPending
+}
+
+func NewKrpcCodec() *KrpcCodec {
+	return &KrpcCodec{
+		pending: make(map[krpcPendingKey]krpcPending),
+	}
+}
+
+/*
+ * Encode : Encodes a kadht message as a KRPC packet.
+ * Parameters:
+ * [in] msg : The message to encode. Replies must have been created
+ *            from a query decoded by Decode.
+ * [in] to : Address the packet is sent to
+ * [out] []byte : The bencoded packet
+ * [out] error : If the message has no KRPC equivalent
+ */
+func (this *KrpcCodec) Encode(msg IMessage, to net.Addr) ([]byte, error) {
+	header := msg.Header()
+	args := map[string]interface{}{
+		"id": string(header.SenderId[:]),
+	}
+
+	switch m := msg.(type) {
+	case *PingRequest:
+		return this.encodeQuery("ping", to, header, args)
+
+	case *FindNodeRequest:
+		args["target"] = string(m.LookupNodeId[:])
+		return this.encodeQuery("find_node", to, header, args)
+
+	case *FindValueRequest:
+		args["info_hash"] = string(m.LookupValueId[:])
+		return this.encodeQuery("get_peers", to, header, args)
+
+	case *KrpcAnnouncePeerRequest:
+		args["info_hash"] = string(m.InfoHash[:])
+		args["port"] = m.Port
+		args["token"] = m.Token
+		if m.ImpliedPort {
+			args["implied_port"] = 1
+		}
+		return this.encodeQuery("announce_peer", to, header, args)
+
+	case *PingReply:
+		return encodeKrpcResponse(header, args)
+
+	case *FindNodeReply:
+		args["nodes"] = encodeCompactNodes(m.Nodes)
+		return encodeKrpcResponse(header, args)
+
+	case *KrpcGetPeersReply:
+		args["token"] = m.Token
+		if len(m.Values) > 0 {
+			values := make([]interface{}, len(m.Values))
+			for idx := range m.Values {
+				values[idx] = encodeCompactPeer(m.Values[idx])
+			}
+			args["values"] = values
+		}
+		if len(m.Nodes) > 0 {
+			args["nodes"] = encodeCompactNodes(m.Nodes)
+		}
+		return encodeKrpcResponse(header, args)
+
+	default:
+		return nil, fmt.Errorf("No KRPC equivalent for %s", MsgType2Str(header.MsgType))
+	}
+}
+
+func (this *KrpcCodec) encodeQuery(method string, to net.Addr, header *BasicMsgHeader,
+	args map[string]interface{}) ([]byte, error) {
+
+	this.lock.Lock()
+	now := time.Now()
+	for key, pending := range this.pending {
+		if now.Sub(pending.sent_time) > krpcPendingTimeout {
+			delete(this.pending, key)
+		}
+	}
+	var raw_tid [2]byte
+	binary.BigEndian.PutUint16(raw_tid[:], this.next_tid)
+	this.next_tid++
+	tid := string(raw_tid[:])
+	this.pending[krpcPendingKey{tid, to.String()}] = krpcPending{
+		method: method, random_id: header.RandomId, sent_time: now}
+	this.lock.Unlock()
+
+	return BencodeMarshal(map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+}
+
+func encodeKrpcResponse(header *BasicMsgHeader, args map[string]interface{}) ([]byte, error) {
+	tid, ok := unpackKrpcTid(header.RandomId)
+	if !ok {
+		return nil, errors.New("Reply does not answer a KRPC query")
+	}
+	return BencodeMarshal(map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": args,
+	})
+}
+
+/*
+ * Decode : Decodes a KRPC packet into a kadht message.
+ * Parameters:
+ * [in] data : The bencoded packet
+ * [in] from : Address the packet was received from
+ * [out] IMessage : The decoded message
+ * [out] error : If the packet is malformed, answers no outstanding query
+ *               to its sender or is a KRPC error message (returned as
+ *               *KrpcError)
+ */
+func (this *KrpcCodec) Decode(data []byte, from net.Addr) (IMessage, error) {
+	value, err := BencodeUnmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("KRPC packet is not a dictionary")
+	}
+	tid, ok := dict["t"].(string)
+	if !ok {
+		return nil, errors.New("KRPC packet without transaction ID")
+	}
+
+	switch dict["y"] {
+	case "q":
+		return decodeKrpcQuery(tid, dict)
+	case "r":
+		pending, found := this.takePending(tid, from)
+		if !found {
+			return nil, fmt.Errorf("KRPC response %x answers no query to %s", tid, from)
+		}
+		return decodeKrpcResponse(pending, dict)
+	case "e":
+		this.takePending(tid, from)
+		return nil, decodeKrpcError(dict)
+	default:
+		return nil, fmt.Errorf("Invalid KRPC message kind: %v", dict["y"])
+	}
+}
+
+func (this *KrpcCodec) takePending(tid string, from net.Addr) (krpcPending, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := krpcPendingKey{tid, from.String()}
+	pending, found := this.pending[key]
+	if found {
+		delete(this.pending, key)
+	}
+	return pending, found
+}
+
+func decodeKrpcQuery(tid string, dict map[string]interface{}) (IMessage, error) {
+	random_id, ok := packKrpcTid(tid)
+	if !ok {
+		return nil, fmt.Errorf("KRPC transaction ID too long: %d bytes", len(tid))
+	}
+	args, ok := dict["a"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("KRPC query without arguments")
+	}
+	sender_id, err := krpcNodeIdArg(args, "id")
+	if err != nil {
+		return nil, err
+	}
+	method, _ := dict["q"].(string)
+
+	switch method {
+	case "ping":
+		return &PingRequest{
+			base_msg: *NewBasicMsgHeader(PING_REQ, sender_id, random_id),
+		}, nil
+
+	case "find_node":
+		target, err := krpcNodeIdArg(args, "target")
+		if err != nil {
+			return nil, err
+		}
+		return &FindNodeRequest{
+			base_msg:     *NewBasicMsgHeader(FIND_NODE_REQ, sender_id, random_id),
+			LookupNodeId: target,
+		}, nil
+
+	case "get_peers":
+		info_hash, err := krpcNodeIdArg(args, "info_hash")
+		if err != nil {
+			return nil, err
+		}
+		return &FindValueRequest{
+			base_msg:      *NewBasicMsgHeader(FIND_VALUE_REQ, sender_id, random_id),
+			LookupValueId: info_hash,
+		}, nil
+
+	case "announce_peer":
+		info_hash, err := krpcNodeIdArg(args, "info_hash")
+		if err != nil {
+			return nil, err
+		}
+		port, ok := args["port"].(int64)
+		if !ok || port < 0 || port > 0xffff {
+			return nil, errors.New("announce_peer with invalid port")
+		}
+		token, ok := args["token"].(string)
+		if !ok {
+			return nil, errors.New("announce_peer without token")
+		}
+		implied, _ := args["implied_port"].(int64)
+		return &KrpcAnnouncePeerRequest{
+			base_msg:    *NewBasicMsgHeader(KRPC_ANNOUNCE_PEER_REQ, sender_id, random_id),
+			InfoHash:    info_hash,
+			Port:        uint16(port),
+			ImpliedPort: implied != 0,
+			Token:       []byte(token),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported KRPC query: %q", method)
+	}
+}
+
+func decodeKrpcResponse(pending krpcPending, dict map[string]interface{}) (IMessage, error) {
+	args, ok := dict["r"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("KRPC response without return values")
+	}
+	sender_id, err := krpcNodeIdArg(args, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	switch pending.method {
+	case "ping", "announce_peer":
+		return &PingReply{
+			base_msg: *NewBasicMsgHeader(PING_RESP, sender_id, pending.random_id),
+		}, nil
+
+	case "find_node":
+		nodes, err := decodeCompactNodes(args["nodes"])
+		if err != nil {
+			return nil, err
+		}
+		return &FindNodeReply{
+			base_msg:   *NewBasicMsgHeader(FIND_NODE_RESP, sender_id, pending.random_id),
+			TotalNodes: int32(len(nodes)),
+			Nodes:      nodes,
+		}, nil
+
+	case "get_peers":
+		reply := &KrpcGetPeersReply{
+			base_msg: *NewBasicMsgHeader(KRPC_GET_PEERS_RESP, sender_id, pending.random_id),
+		}
+		if token, ok := args["token"].(string); ok {
+			reply.Token = []byte(token)
+		}
+		if values, ok := args["values"].([]interface{}); ok {
+			for _, value := range values {
+				peer, ok := value.(string)
+				if !ok || len(peer) != krpcCompactPeerLen {
+					return nil, errors.New("get_peers reply with invalid peer")
+				}
+				reply.Values = append(reply.Values, decodeCompactPeer(peer))
+			}
+		}
+		if args["nodes"] != nil {
+			reply.Nodes, err = decodeCompactNodes(args["nodes"])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("Unsupported KRPC query: %q", pending.method)
+}
+
+func decodeKrpcError(dict map[string]interface{}) error {
+	list, ok := dict["e"].([]interface{})
+	if !ok || len(list) != 2 {
+		return errors.New("Malformed KRPC error message")
+	}
+	code, _ := list[0].(int64)
+	message, _ := list[1].(string)
+	return &KrpcError{Code: code, Message: message}
+}
+
+func krpcNodeIdArg(args map[string]interface{}, name string) (NodeId, error) {
+	var id NodeId
+	value, ok := args[name].(string)
+	if !ok || len(value) != bytesPerNodeiId {
+		return id, fmt.Errorf("KRPC argument %q is not a node id", name)
+	}
+	copy(id[:], value)
+	return id, nil
+}
+
+// packKrpcTid: Keeps the transaction ID of a remote query in the
+// RandomId of the decoded message, so that replies created from
+// it with the usual constructors carry it back.
+// Layout: first byte is the length, followed by the ID itself.
+func packKrpcTid(tid string) (NodeId, bool) {
+	var id NodeId
+	if len(tid) > krpcMaxTidLen {
+		return id, false
+	}
+	id[0] = byte(len(tid))
+	copy(id[1:], tid)
+	return id, true
+}
+
+func unpackKrpcTid(id NodeId) (string, bool) {
+	length := int(id[0])
+	if length > krpcMaxTidLen {
+		return "", false
+	}
+	for _, b := range id[1+length:] {
+		if b != 0 {
+			return "", false
+		}
+	}
+	return string(id[1 : 1+length]), true
+}
+
+func encodeCompactPeer(addr Ipv4Addr) string {
+	var buf [krpcCompactPeerLen]byte
+	copy(buf[:4], addr.IP[:])
+	binary.BigEndian.PutUint16(buf[4:], addr.Port)
+	return string(buf[:])
+}
+
+func decodeCompactPeer(peer string) Ipv4Addr {
+	var addr Ipv4Addr
+	copy(addr.IP[:], peer[:4])
+	addr.Port = binary.BigEndian.Uint16([]byte(peer[4:]))
+	return addr
+}
+
+func encodeCompactNodes(nodes []RemoteNode) string {
+	buf := make([]byte, 0, len(nodes)*krpcCompactNodeLen)
+	for idx := range nodes {
+		buf = append(buf, nodes[idx].Id[:]...)
+		buf = append(buf, encodeCompactPeer(nodes[idx].Addr)...)
+	}
+	return string(buf)
+}
+
+func decodeCompactNodes(value interface{}) ([]RemoteNode, error) {
+	compact, ok := value.(string)
+	if !ok || len(compact)%krpcCompactNodeLen != 0 {
+		return nil, errors.New("Invalid compact node info")
+	}
+	nodes := make([]RemoteNode, len(compact)/krpcCompactNodeLen)
+	for idx := range nodes {
+		entry := compact[idx*krpcCompactNodeLen : (idx+1)*krpcCompactNodeLen]
+		copy(nodes[idx].Id[:], entry[:bytesPerNodeiId])
+		nodes[idx].Addr = decodeCompactPeer(entry[bytesPerNodeiId:])
+	}
+	return nodes, nil
+}
+
+//************** MESSAGE SERIALIZATION-DESERIALIZATION FUNCTIONS ***************//
+
+func (this *KrpcGetPeersReply) Header() *BasicMsgHeader       { return &this.base_msg }
+func (this *KrpcAnnouncePeerRequest) Header() *BasicMsgHeader { return &this.base_msg }
+
+func (this *KrpcGetPeersReply) Serialize(writer io.Writer) bool {
+	ret := this.base_msg.Serialize(writer)
+	if !ret {
+		fmt.Println("ERROR: Failed to serialize KrpcGetPeersReply header")
+		return false
+	}
+	if !writeBytesField(writer, this.Token) {
+		fmt.Println("ERROR: Failed to serialize KrpcGetPeersReply token")
+		return false
+	}
+	total_values := int32(len(this.Values))
+	total_nodes := int32(len(this.Nodes))
+	err := binary.Write(writer, binary.BigEndian, &total_values)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, this.Values)
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &total_nodes)
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, this.Nodes)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to serialize KrpcGetPeersReply: ", err)
+		return false
+	}
+	return true
+}
+
+func (this *KrpcGetPeersReply) Deserialize(reader io.Reader) bool {
+	var ok bool
+	this.Token, ok = readBytesField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize KrpcGetPeersReply token")
+		return false
+	}
+	var total_values, total_nodes int32
+	err := binary.Read(reader, binary.BigEndian, &total_values)
+	if err == nil && (total_values < 0 || total_values > maxListEntries) {
+		err = errors.New("too many peers")
+	}
+	if err == nil {
+		this.Values = make([]Ipv4Addr, total_values)
+		err = binary.Read(reader, binary.BigEndian, this.Values)
+	}
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &total_nodes)
+	}
+	if err == nil && (total_nodes < 0 || total_nodes > maxListEntries) {
+		err = errors.New("too many nodes")
+	}
+	if err == nil {
+		this.Nodes = make([]RemoteNode, total_nodes)
+		err = binary.Read(reader, binary.BigEndian, this.Nodes)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize KrpcGetPeersReply: ", err)
+		return false
+	}
+	return true
+}
+
+func (this *KrpcAnnouncePeerRequest) Serialize(writer io.Writer) bool {
+	ret := this.base_msg.Serialize(writer)
+	if !ret {
+		fmt.Println("ERROR: Failed to serialize KrpcAnnouncePeerRequest header")
+		return false
+	}
+	var implied uint8
+	if this.ImpliedPort {
+		implied = 1
+	}
+	err := binary.Write(writer, binary.BigEndian, &this.InfoHash)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &this.Port)
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &implied)
+	}
+	if err != nil || !writeBytesField(writer, this.Token) {
+		fmt.Println("ERROR: Failed to serialize KrpcAnnouncePeerRequest")
+		return false
+	}
+	return true
+}
+
+func (this *KrpcAnnouncePeerRequest) Deserialize(reader io.Reader) bool {
+	var implied uint8
+	err := binary.Read(reader, binary.BigEndian, &this.InfoHash)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &this.Port)
+	}
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &implied)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize KrpcAnnouncePeerRequest")
+		return false
+	}
+	this.ImpliedPort = implied != 0
+
+	var ok bool
+	this.Token, ok = readBytesField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize KrpcAnnouncePeerRequest token")
+	}
+	return ok
+}
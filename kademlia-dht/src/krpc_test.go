@@ -0,0 +1,216 @@
+package kadht
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Packets recorded from the BEP 5 examples, plus a find_node
+// response carrying two nodes.
+func readKrpcFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "krpc", name+".bencode"))
+	if err != nil {
+		t.Fatal("Failed to read fixture: ", err)
+	}
+	return data
+}
+
+func nodeIdFromString(s string) (id NodeId) {
+	copy(id[:], s)
+	return id
+}
+
+// Address of the node the fixtures are exchanged with
+var krpcPeerAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+// expectKrpcQuery: Makes the codec believe it has sent the query
+// with transaction ID "aa", as the fixtures use, to krpcPeerAddr.
+func expectKrpcQuery(codec *KrpcCodec, method string, random_id NodeId) {
+	codec.pending[krpcPendingKey{"aa", krpcPeerAddr.String()}] = krpcPending{
+		method: method, random_id: random_id, sent_time: time.Now()}
+}
+
+func TestKrpcPing(t *testing.T) {
+	codec := NewKrpcCodec()
+
+	msg, err := codec.Decode(readKrpcFixture(t, "ping_query"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode ping query: ", err)
+	}
+	req, ok := msg.(*PingRequest)
+	if !ok {
+		t.Fatal("ping was not decoded as PingRequest")
+	}
+	if req.Header().SenderId != nodeIdFromString("abcdefghij0123456789") {
+		t.Error("Wrong sender id: ", req.Header().SenderId)
+	}
+
+	reply := NewPingReply(nodeIdFromString("mnopqrstuvwxyz123456"), req)
+	data, err := codec.Encode(reply, krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to encode ping reply: ", err)
+	}
+	if string(data) != string(readKrpcFixture(t, "ping_response")) {
+		t.Error("Unexpected ping response: ", string(data))
+	}
+}
+
+func TestKrpcEncodeQuery(t *testing.T) {
+	codec := NewKrpcCodec()
+	codec.next_tid = 0x6161 // "aa"
+
+	req := NewFindNodeRequest(nodeIdFromString("abcdefghij0123456789"),
+		nodeIdFromString("mnopqrstuvwxyz123456"))
+	data, err := codec.Encode(req, krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to encode find_node: ", err)
+	}
+	if string(data) != string(readKrpcFixture(t, "find_node_query")) {
+		t.Error("Unexpected find_node query: ", string(data))
+	}
+
+	// The recorded response answers the query just encoded
+	msg, err := codec.Decode(readKrpcFixture(t, "find_node_response"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode find_node response: ", err)
+	}
+	reply, ok := msg.(*FindNodeReply)
+	if !ok {
+		t.Fatal("find_node response was not decoded as FindNodeReply")
+	}
+	if reply.Header().RandomId != req.Header().RandomId {
+		t.Error("Reply not correlated with the request")
+	}
+	if reply.TotalNodes != 2 || reply.Nodes[1].Id != nodeIdFromString("zyxwvutsrqponmlkjihg") {
+		t.Fatal("Wrong nodes decoded: ", reply.Nodes)
+	}
+	if reply.Nodes[0].Addr != (Ipv4Addr{IP: [4]byte{127, 0, 0, 1}, Port: 6881}) {
+		t.Error("Wrong node address decoded: ", reply.Nodes[0].Addr)
+	}
+
+	// A second response for the same transaction answers nothing
+	if _, err := codec.Decode(readKrpcFixture(t, "find_node_response"), krpcPeerAddr); err == nil {
+		t.Error("Duplicate response accepted")
+	}
+}
+
+func TestKrpcGetPeers(t *testing.T) {
+	codec := NewKrpcCodec()
+
+	msg, err := codec.Decode(readKrpcFixture(t, "get_peers_query"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode get_peers query: ", err)
+	}
+	req, ok := msg.(*FindValueRequest)
+	if !ok {
+		t.Fatal("get_peers was not decoded as FindValueRequest")
+	}
+	if req.LookupValueId != nodeIdFromString("mnopqrstuvwxyz123456") {
+		t.Error("Wrong info hash: ", req.LookupValueId)
+	}
+
+	random_id := generateRandomNodeId()
+	expectKrpcQuery(codec, "get_peers", random_id)
+	msg, err = codec.Decode(readKrpcFixture(t, "get_peers_response_values"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode get_peers response: ", err)
+	}
+	reply, ok := msg.(*KrpcGetPeersReply)
+	if !ok {
+		t.Fatal("get_peers response was not decoded as KrpcGetPeersReply")
+	}
+	if string(reply.Token) != "aoeusnth" || len(reply.Values) != 2 || len(reply.Nodes) != 0 {
+		t.Error("Wrong get_peers response: ", reply)
+	}
+	if reply.Values[0] != (Ipv4Addr{IP: [4]byte{'a', 'x', 'j', 'e'}, Port: 0x2e75}) {
+		t.Error("Wrong peer decoded: ", reply.Values[0])
+	}
+
+	// Encoding it back as the answer to the query gives the same packet
+	reply.Header().RandomId = req.Header().RandomId
+	data, err := codec.Encode(reply, krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to encode get_peers response: ", err)
+	}
+	if string(data) != string(readKrpcFixture(t, "get_peers_response_values")) {
+		t.Error("Unexpected get_peers response: ", string(data))
+	}
+}
+
+func TestKrpcAnnouncePeer(t *testing.T) {
+	codec := NewKrpcCodec()
+
+	msg, err := codec.Decode(readKrpcFixture(t, "announce_peer_query"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode announce_peer query: ", err)
+	}
+	req, ok := msg.(*KrpcAnnouncePeerRequest)
+	if !ok {
+		t.Fatal("announce_peer was not decoded as KrpcAnnouncePeerRequest")
+	}
+	if req.Port != 6881 || !req.ImpliedPort || string(req.Token) != "aoeusnth" {
+		t.Error("Wrong announce_peer arguments: ", req)
+	}
+
+	codec.next_tid = 0x6161
+	data, err := codec.Encode(req, krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to encode announce_peer: ", err)
+	}
+	if string(data) != string(readKrpcFixture(t, "announce_peer_query")) {
+		t.Error("Unexpected announce_peer query: ", string(data))
+	}
+
+	// announce_peer is answered with a plain reply
+	msg, err = codec.Decode(readKrpcFixture(t, "ping_response"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Failed to decode announce_peer response: ", err)
+	}
+	if _, ok := msg.(*PingReply); !ok {
+		t.Error("announce_peer response was not decoded as PingReply")
+	}
+}
+
+func TestKrpcError(t *testing.T) {
+	codec := NewKrpcCodec()
+	expectKrpcQuery(codec, "ping", generateRandomNodeId())
+
+	_, err := codec.Decode(readKrpcFixture(t, "error"), krpcPeerAddr)
+	krpc_err, ok := err.(*KrpcError)
+	if !ok {
+		t.Fatal("Error message not decoded as KrpcError: ", err)
+	}
+	if krpc_err.Code != 201 || krpc_err.Message != "A Generic Error Occured" {
+		t.Error("Wrong error decoded: ", krpc_err)
+	}
+	if len(codec.pending) != 0 {
+		t.Error("Failed query still pending")
+	}
+}
+
+func TestKrpcResponseFromOtherNode(t *testing.T) {
+	codec := NewKrpcCodec()
+	codec.next_tid = 0x6161 // "aa"
+	req := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	if _, err := codec.Encode(req, krpcPeerAddr); err != nil {
+		t.Fatal("Failed to encode find_node: ", err)
+	}
+
+	// Same transaction ID, from another address
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+	if _, err := codec.Decode(readKrpcFixture(t, "find_node_response"), other); err == nil {
+		t.Error("Response from another node accepted")
+	}
+	// Nor does an error from it cancel the query
+	codec.Decode(readKrpcFixture(t, "error"), other)
+	msg, err := codec.Decode(readKrpcFixture(t, "find_node_response"), krpcPeerAddr)
+	if err != nil {
+		t.Fatal("Response from the queried node rejected: ", err)
+	}
+	if msg.Header().RandomId != req.Header().RandomId {
+		t.Error("Reply not correlated with the request")
+	}
+}
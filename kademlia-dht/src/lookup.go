@@ -0,0 +1,200 @@
+package kadht
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+/*
+ * Iterative node lookup.
+ *
+ * The lookup keeps a shortlist of the contacts known closest to the
+ * target, seeded from the routing table. Every round queries, in
+ * parallel, the 'alpha' closest contacts of the shortlist not queried
+ * yet, and merges the contacts they return by XOR distance. Contacts
+ * which do not answer are dropped from the shortlist.
+ * When a round does not change the k closest contacts, the ones among
+ * them not queried yet are queried in a last round, as the kademlia
+ * paper prescribes, and the lookup ends with the k closest contacts
+ * which answered.
+ */
+
+const (
+	// Default number of contacts queried in parallel by a lookup
+	DefaultLookupAlpha = 3
+)
+
+var errNoContacts = errors.New("No contacts to start the lookup from")
+
+/*
+ * LookupStats : Statistics of a lookup
+ */
+type LookupStats struct {
+	Rounds  int // Rounds of parallel queries
+	Queried int // Contacts queried
+	Failed  int // Contacts which did not answer
+}
+
+// State of a contact of the shortlist
+const (
+	candidateNew = iota
+	candidateQueried
+	candidateFailed
+)
+
+type lookupCandidate struct {
+	node  RemoteNode
+	state int
+}
+
+/*
+ * lookupQuery : Queries one contact during a lookup.
+ * Parameters:
+ * [in] ctx : Bounds the query
+ * [in] node : The contact
+ * [out] []RemoteNode : Contacts closer to the target
+ * [out] bool : 'true' to end the lookup now
+ * [out] error : If the contact did not answer
+ */
+type lookupQuery func(ctx context.Context, node RemoteNode) ([]RemoteNode, bool, error)
+
+// Result of a query
+type lookupResult struct {
+	candidate *lookupCandidate
+	nodes     []RemoteNode
+	done      bool
+	err       error
+}
+
+/*
+ * FindNode : Finds the k contacts closest to the target in the network.
+ * Parameters:
+ * [in] ctx : Bounds the lookup
+ * [in] target : The ID looked up
+ * [out] []RemoteNode : The contacts, closest first
+ * [out] LookupStats : Statistics of the lookup
+ * [out] error : If the routing table is empty or the context ended
+ */
+func (this *DHT) FindNode(ctx context.Context, target NodeId) ([]RemoteNode, LookupStats, error) {
+	return this.iterativeLookup(ctx, target, func(ctx context.Context, node RemoteNode) ([]RemoteNode, bool, error) {
+		nodes, err := this.server.FindNode(ctx, node.Addr.UDPAddr(), target)
+		return nodes, false, err
+	})
+}
+
+// iterativeLookup: Runs a lookup, asking each contact with 'query'
+func (this *DHT) iterativeLookup(ctx context.Context, target NodeId, query lookupQuery) ([]RemoteNode, LookupStats, error) {
+	var stats LookupStats
+	k := this.config.BucketSize
+	alpha := this.config.Alpha
+
+	// The routing table gives the contacts with their IDs, closest first
+	seeds := this.routing_table.LookupClosestContacts(target, k)
+	if len(seeds) == 0 {
+		return nil, stats, errNoContacts
+	}
+	seen := make(map[NodeId]bool)
+	seen[this.Id()] = true
+	var shortlist []*lookupCandidate
+	merge := func(nodes []RemoteNode) {
+		for _, node := range nodes {
+			if !seen[node.Id] {
+				seen[node.Id] = true
+				shortlist = append(shortlist, &lookupCandidate{node: node})
+			}
+		}
+		sort.Slice(shortlist, func(i, j int) bool {
+			return compareDistance(target, shortlist[i].node.Id, shortlist[j].node.Id) < 0
+		})
+	}
+	merge(seeds)
+
+	// closest: The k closest contacts which did not fail
+	closest := func() []*lookupCandidate {
+		var result []*lookupCandidate
+		for _, candidate := range shortlist {
+			if candidate.state != candidateFailed {
+				result = append(result, candidate)
+				if len(result) == k {
+					break
+				}
+			}
+		}
+		return result
+	}
+
+	last_round := false
+	for {
+		var batch []*lookupCandidate
+		for _, candidate := range closest() {
+			if candidate.state == candidateNew {
+				batch = append(batch, candidate)
+				if !last_round && len(batch) == alpha {
+					break
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		before := closest()
+		stats.Rounds++
+		stats.Queried += len(batch)
+		results := make(chan lookupResult, len(batch))
+		for _, candidate := range batch {
+			go func(candidate *lookupCandidate) {
+				nodes, done, err := query(ctx, candidate.node)
+				results <- lookupResult{candidate: candidate, nodes: nodes, done: done, err: err}
+			}(candidate)
+		}
+
+		done := false
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				result.candidate.state = candidateFailed
+				stats.Failed++
+				continue
+			}
+			result.candidate.state = candidateQueried
+			merge(result.nodes)
+			done = done || result.done
+		}
+		if done {
+			return answered(closest()), stats, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return answered(closest()), stats, err
+		}
+		if last_round {
+			break
+		}
+		last_round = sameCandidates(before, closest())
+	}
+	return answered(closest()), stats, nil
+}
+
+// answered: The contacts of the candidates which answered a query
+func answered(candidates []*lookupCandidate) []RemoteNode {
+	var nodes []RemoteNode
+	for _, candidate := range candidates {
+		if candidate.state == candidateQueried {
+			nodes = append(nodes, candidate.node)
+		}
+	}
+	return nodes
+}
+
+func sameCandidates(a, b []*lookupCandidate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package kadht
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestCluster: Nodes on their own network, each knowing all the
+// others its buckets have room for
+func newTestCluster(t *testing.T, size int, config Config) []*DHT {
+	network := NewMemNetwork()
+	nodes := make([]*DHT, size)
+	for idx := range nodes {
+		transport, err := network.Listen(nil)
+		if err != nil {
+			t.Fatal("Failed to listen: ", err)
+		}
+		config.Transport = transport
+		nodes[idx], err = New(config)
+		if err != nil {
+			t.Fatal("Failed to create the DHT: ", err)
+		}
+	}
+	for _, node := range nodes {
+		for _, other := range nodes {
+			if other != node {
+				node.RoutingTable().AddEntryOnly(CreateNode(other.Addr().(*net.UDPAddr), other.Id()))
+			}
+		}
+		if err := node.Start(); err != nil {
+			t.Fatal("Failed to start the DHT: ", err)
+		}
+	}
+	return nodes
+}
+
+func stopCluster(nodes []*DHT) {
+	for _, node := range nodes {
+		node.Stop()
+	}
+}
+
+// closestIds: The IDs of the 'count' nodes closest to the target
+func closestIds(nodes []*DHT, target NodeId, count int) []NodeId {
+	var ids []NodeId
+	for _, node := range nodes {
+		ids = append(ids, node.Id())
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return compareDistance(target, ids[i], ids[j]) < 0
+	})
+	if len(ids) > count {
+		ids = ids[:count]
+	}
+	return ids
+}
+
+func TestIterativeFindNode(t *testing.T) {
+	config := Config{BucketSize: 4, RequestTimeout: 50 * time.Millisecond}
+	nodes := newTestCluster(t, 30, config)
+	defer stopCluster(nodes)
+
+	target := generateRandomNodeId()
+	found, stats, err := nodes[0].FindNode(context.Background(), target)
+	if err != nil {
+		t.Fatal("Lookup failed: ", err)
+	}
+	expected := closestIds(nodes[1:], target, config.BucketSize)
+	if len(found) != len(expected) {
+		t.Fatal("Wrong number of contacts: ", len(found))
+	}
+	for idx := range expected {
+		if found[idx].Id != expected[idx] {
+			t.Error("Closest contacts not found at ", idx)
+		}
+	}
+	if stats.Rounds == 0 || stats.Queried < len(found) || stats.Failed != 0 {
+		t.Error("Wrong stats: ", stats)
+	}
+}
+
+func TestIterativeFindNodeFailures(t *testing.T) {
+	config := Config{BucketSize: 4, RequestTimeout: 20 * time.Millisecond, RequestRetries: -1}
+	nodes := newTestCluster(t, 20, config)
+	defer stopCluster(nodes)
+
+	// The two nodes closest to the target are gone
+	target := generateRandomNodeId()
+	dead := closestIds(nodes[1:], target, 2)
+	var alive []*DHT
+	for _, node := range nodes {
+		if node.Id() == dead[0] || node.Id() == dead[1] {
+			node.Stop()
+		} else {
+			alive = append(alive, node)
+		}
+	}
+
+	found, stats, err := nodes[0].FindNode(context.Background(), target)
+	if err != nil {
+		t.Fatal("Lookup failed: ", err)
+	}
+	expected := closestIds(alive[1:], target, config.BucketSize)
+	for idx := range expected {
+		if idx >= len(found) || found[idx].Id != expected[idx] {
+			t.Error("Closest live contacts not found at ", idx)
+		}
+	}
+	if stats.Failed < 2 {
+		t.Error("Failed contacts not counted: ", stats)
+	}
+}
+
+func TestFindNodeWithoutContacts(t *testing.T) {
+	node := newTestDHT(t, Config{})
+	defer node.Stop()
+	if _, _, err := node.FindNode(context.Background(), generateRandomNodeId()); err != errNoContacts {
+		t.Error("Lookup without contacts did not fail: ", err)
+	}
+}
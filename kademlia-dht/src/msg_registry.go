@@ -0,0 +1,129 @@
+package kadht
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Message types below this value are reserved for
+	// the kadht protocol itself. Applications adding their
+	// own RPCs must pick a type at or above it.
+	MSG_USER_START = 0x1000
+)
+
+/*
+ * MessageCtor : Creates an empty message of a registered type.
+ * The header has already been read from the wire and must be
+ * stored in the returned message, the body is read afterwards
+ * through the Deserialize interface API.
+ */
+type MessageCtor func(header BasicMsgHeader) IMessage
+
+// Entry of the message registry
+type msgTypeInfo struct {
+	name string
+	ctor MessageCtor
+}
+
+var errUnknownMessageType = errors.New("Invalid message type")
+
+var (
+	msgRegistryLock sync.RWMutex
+	msgRegistry     = make(map[uint32]msgTypeInfo)
+)
+
+func init() {
+	registerBuiltinMessageType(PING_REQ, "PING_REQ", func(header BasicMsgHeader) IMessage {
+		return &PingRequest{base_msg: header}
+	})
+	registerBuiltinMessageType(PING_RESP, "PING_RESP", func(header BasicMsgHeader) IMessage {
+		return &PingReply{base_msg: header}
+	})
+	registerBuiltinMessageType(FIND_NODE_REQ, "FIND_NODE_REQ", func(header BasicMsgHeader) IMessage {
+		return &FindNodeRequest{base_msg: header}
+	})
+	registerBuiltinMessageType(FIND_NODE_RESP, "FIND_NODE_RESP", func(header BasicMsgHeader) IMessage {
+		return &FindNodeReply{base_msg: header}
+	})
+	registerBuiltinMessageType(FIND_VALUE_REQ, "FIND_VALUE_REQ", func(header BasicMsgHeader) IMessage {
+		return &FindValueRequest{base_msg: header}
+	})
+	registerBuiltinMessageType(FIND_VALUE_RESP, "FIND_VALUE_RESP", func(header BasicMsgHeader) IMessage {
+		return &FindValueReply{base_msg: header}
+	})
+	registerBuiltinMessageType(STORE_REQ, "STORE_REQ", func(header BasicMsgHeader) IMessage {
+		return &StoreRequest{base_msg: header}
+	})
+	registerBuiltinMessageType(STORE_RESP, "STORE_RESP", func(header BasicMsgHeader) IMessage {
+		return &StoreReply{base_msg: header}
+	})
+}
+
+/*
+ * RegisterMessageType : Registers an application defined message type.
+ * Once registered, the type is parsed by ConsumePacket like any of
+ * the built-in messages.
+ * Parameters:
+ * [in] mtype : The message type identifier. Must be >= MSG_USER_START.
+ * [in] name : Human readable name of the message, used by MsgType2Str.
+ * [in] ctor : Constructor creating an empty message of this type.
+ * [out] error : If the type is reserved or already registered.
+ */
+func RegisterMessageType(mtype uint32, name string, ctor MessageCtor) error {
+	if mtype < MSG_USER_START {
+		return fmt.Errorf("Message type %d is reserved for built-in messages", mtype)
+	}
+	if ctor == nil {
+		return errors.New("Message constructor must not be nil")
+	}
+	return registerMessageType(mtype, name, ctor)
+}
+
+// registerBuiltinMessageType: Registers a message type of the kadht
+// protocol itself. Failing to do so is a programming error.
+func registerBuiltinMessageType(mtype uint32, name string, ctor MessageCtor) {
+	err := registerMessageType(mtype, name, ctor)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+func registerMessageType(mtype uint32, name string, ctor MessageCtor) error {
+	msgRegistryLock.Lock()
+	defer msgRegistryLock.Unlock()
+
+	if info, found := msgRegistry[mtype]; found {
+		return fmt.Errorf("Message type %d already registered as %s", mtype, info.name)
+	}
+	msgRegistry[mtype] = msgTypeInfo{name: name, ctor: ctor}
+	return nil
+}
+
+// lookupMessageType: Finds the registry entry for the message type.
+func lookupMessageType(mtype uint32) (msgTypeInfo, bool) {
+	msgRegistryLock.RLock()
+	defer msgRegistryLock.RUnlock()
+
+	info, found := msgRegistry[mtype]
+	return info, found
+}
+
+/*
+ * NewMessage : Creates an empty message for the type found in the header.
+ * Parameters:
+ * [in] header : The already parsed message header.
+ * [out] IMessage : The message, ready to deserialize its body into.
+ * [out] error : If the message type is unknown or has no body defined.
+ */
+func NewMessage(header BasicMsgHeader) (IMessage, error) {
+	info, found := lookupMessageType(header.MsgType)
+	if !found {
+		return nil, fmt.Errorf("%w: %d", errUnknownMessageType, header.MsgType)
+	}
+	if info.ctor == nil {
+		return nil, fmt.Errorf("No message defined for type: %s", info.name)
+	}
+	return info.ctor(header), nil
+}
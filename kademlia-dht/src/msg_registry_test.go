@@ -0,0 +1,93 @@
+package kadht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+const testEchoMsgType = MSG_USER_START + 1
+
+// Application defined message used by the registry tests
+type echoMessage struct {
+	header  BasicMsgHeader
+	Counter uint32
+}
+
+func (this *echoMessage) Header() *BasicMsgHeader { return &this.header }
+
+func (this *echoMessage) Serialize(writer io.Writer) bool {
+	if !this.header.Serialize(writer) {
+		return false
+	}
+	return binary.Write(writer, binary.BigEndian, &this.Counter) == nil
+}
+
+func (this *echoMessage) Deserialize(reader io.Reader) bool {
+	return binary.Read(reader, binary.BigEndian, &this.Counter) == nil
+}
+
+func init() {
+	err := RegisterMessageType(testEchoMsgType, "ECHO", func(header BasicMsgHeader) IMessage {
+		return &echoMessage{header: header}
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	ctor := func(header BasicMsgHeader) IMessage { return nil }
+
+	if err := RegisterMessageType(PING_REQ, "MY_PING", ctor); err == nil {
+		t.Error("Registering a built-in message type must fail")
+	}
+	if err := RegisterMessageType(testEchoMsgType, "ECHO_AGAIN", ctor); err == nil {
+		t.Error("Registering a message type twice must fail")
+	}
+	if MsgType2Str(testEchoMsgType) != "ECHO" {
+		t.Error("Wrong name for registered type: ", MsgType2Str(testEchoMsgType))
+	}
+	if MsgType2Str(PING_RESP) != "PING_RESP" {
+		t.Error("Wrong name for built-in type: ", MsgType2Str(PING_RESP))
+	}
+	// Must not panic for types nobody knows about
+	if MsgType2Str(MSG_USER_START+999) != "UNKNOWN(5095)" {
+		t.Error("Wrong name for unknown type: ", MsgType2Str(MSG_USER_START+999))
+	}
+}
+
+func TestParseCustomMessage(t *testing.T) {
+	msg := &echoMessage{
+		header:  *NewBasicMsgHeader(testEchoMsgType, generateRandomNodeId(), generateRandomNodeId()),
+		Counter: 42,
+	}
+	var buf bytes.Buffer
+	if !msg.Serialize(&buf) {
+		t.Fatal("Failed to serialize custom message")
+	}
+
+	parsed, mtype := ParseMessage(&buf)
+	if mtype != testEchoMsgType {
+		t.Fatal("Wrong message type parsed: ", mtype)
+	}
+	echo, ok := parsed.(*echoMessage)
+	if !ok {
+		t.Fatal("Parsed message is not an echoMessage")
+	}
+	if echo.Counter != 42 || echo.Header().RandomId != msg.header.RandomId {
+		t.Error("Custom message did not survive the round trip")
+	}
+}
+
+func TestParseUnknownMessage(t *testing.T) {
+	header := BasicMsgHeader{Version: 1, MsgType: MSG_USER_START + 999}
+	var buf bytes.Buffer
+	header.Serialize(&buf)
+
+	msg, mtype := ParseMessage(&buf)
+	if msg != nil || mtype != -1 {
+		t.Error("Parsing an unknown message type must fail")
+	}
+}
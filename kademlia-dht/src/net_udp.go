@@ -0,0 +1,72 @@
+package kadht
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+ * UdpTransport : Transport over a UDP socket, the one used by
+ * deployed nodes.
+ */
+type UdpTransport struct {
+	port    int
+	ip_addr string
+	// Internal Members
+	addr *net.UDPAddr
+	conn *net.UDPConn
+}
+
+/*
+ * NewUdpTransport : Opens the UDP socket of a node.
+ * Parameters:
+ * [in] addr : Local IP address to listen on
+ * [in] port : Local port, 0 to pick any free port
+ * [out] *UdpTransport : Pointer to the newly created UdpTransport
+ * [out] error : If the socket could not be opened
+ */
+func NewUdpTransport(addr string, port int) (*UdpTransport, error) {
+	transport := &UdpTransport{ip_addr: addr, port: port}
+	err := transport.setup()
+	if err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// setup: Resolves the local address and opens the socket
+func (this *UdpTransport) setup() error {
+	udp_addr := net.JoinHostPort(this.ip_addr, strconv.Itoa(this.port))
+	addr, err := net.ResolveUDPAddr("udp", udp_addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	this.conn = conn
+	this.addr = conn.LocalAddr().(*net.UDPAddr)
+	return nil
+}
+
+func (this *UdpTransport) ReadFrom(buf []byte) (int, net.Addr, error) {
+	return this.conn.ReadFrom(buf)
+}
+
+func (this *UdpTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	return this.conn.WriteTo(data, addr)
+}
+
+func (this *UdpTransport) LocalAddr() net.Addr {
+	return this.addr
+}
+
+func (this *UdpTransport) SetReadDeadline(deadline time.Time) error {
+	return this.conn.SetReadDeadline(deadline)
+}
+
+func (this *UdpTransport) Close() error {
+	return this.conn.Close()
+}
@@ -2,6 +2,8 @@ package kadht
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"time"
 )
@@ -79,6 +81,42 @@ func Xor(a, b NodeId) (res NodeId) {
 	return res
 }
 
+// Compares the XOR distances of 2 node Id's to
+// the target. Returns -1 if 'a' is closer, 1 if
+// 'b' is closer and 0 if they are equal.
+func compareDistance(target, a, b NodeId) int {
+	for i := 0; i < bytesPerNodeiId; i++ {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			if da < db {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
 func toString(a NodeId) string {
 	return string(a[:])
 }
+
+// Node ID's are written as hex strings in the
+// text based formats (JSON)
+func (this NodeId) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(this[:])), nil
+}
+
+func (this *NodeId) UnmarshalText(text []byte) error {
+	var id NodeId
+	if len(text) != 2*bytesPerNodeiId {
+		return fmt.Errorf("Node ID must be %d hex digits", 2*bytesPerNodeiId)
+	}
+	_, err := hex.Decode(id[:], text)
+	if err != nil {
+		return err
+	}
+	*this = id
+	return nil
+}
@@ -0,0 +1,331 @@
+package kadht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Request/response correlation.
+ *
+ * Every request sent through a PendingTracker is remembered by its
+ * RandomId and the address of the peer it was sent to. Replies read
+ * from the connection are handed to Deliver, which wakes up the
+ * caller waiting for them. Unanswered requests are sent again after
+ * the timeout, doubling it each time, and fail with errRequestTimeout
+ * once all the retries are used. The timeout of the first attempt is
+ * estimated from the round trip times of the peer, see rtt.go.
+ *
+ * A retry is sent with a new RandomId, since the peer drops a message
+ * it already received (see replay.go). Replies to any of the attempts
+ * are accepted.
+ */
+
+const (
+	// Default time to wait for the reply to the first attempt, until
+	// the round trip time of the peer is known
+	DefaultRequestTimeout = time.Second
+	// Default number of retries after the first attempt
+	DefaultRequestRetries = 2
+)
+
+var (
+	errRequestTimeout   = errors.New("Request timed out")
+	errRequestCancelled = errors.New("Request cancelled")
+)
+
+// Identifies an attempt of a request
+type pendingKey struct {
+	random_id NodeId
+	addr      string
+}
+
+/*
+ * PendingRequest : A request waiting for its reply
+ */
+type PendingRequest struct {
+	tracker   *PendingTracker
+	send_lock sync.Mutex // Serializes the attempts, which modify the request
+	req       IMessage
+	addr      string
+	send      func(IMessage) error
+	keys      []pendingKey // One per attempt
+	sent      []time.Time  // Send time of each attempt
+	attempts  int
+	retries   int // Number of times the request is sent again
+	timer     *time.Timer
+	done      chan struct{} // Closed once the request completed
+	reply     IMessage
+	err       error
+	rtt       time.Duration // Round trip of the attempt answered
+}
+
+/*
+ * PendingTracker : Matches the replies to the requests waiting for them.
+ */
+type PendingTracker struct {
+	lock        sync.Mutex
+	pending     map[pendingKey]*PendingRequest
+	rtt         *RttEstimator
+	max_retries int
+}
+
+/*
+ * NewPendingTracker : Creates a new tracker.
+ * Parameters:
+ * [in] timeout : Time to wait for the reply to the first attempt, for
+ *                peers without round trip time estimate
+ * [in] max_retries : Number of times a request is sent again
+ * [out] *PendingTracker : Pointer to the newly created PendingTracker
+ */
+func NewPendingTracker(timeout time.Duration, max_retries int) *PendingTracker {
+	return &PendingTracker{
+		pending:     make(map[pendingKey]*PendingRequest),
+		rtt:         NewRttEstimator(timeout),
+		max_retries: max_retries,
+	}
+}
+
+/*
+ * Start : Sends a request and tracks it until its reply is delivered.
+ * Parameters:
+ * [in] req : The request
+ * [in] addr : Address of the peer, replies from any other address are ignored
+ * [in] send : Sends the request, called again for every retry
+ * [out] *PendingRequest : The tracked request
+ * [out] error : If the first attempt could not be sent
+ */
+func (this *PendingTracker) Start(req IMessage, addr string, send func(IMessage) error) (*PendingRequest, error) {
+	return this.StartWithRetries(req, addr, this.max_retries, send)
+}
+
+/*
+ * StartWithRetries : Same as Start, sending the request again at most
+ * 'retries' times instead of the default of the tracker.
+ */
+func (this *PendingTracker) StartWithRetries(req IMessage, addr string, retries int,
+	send func(IMessage) error) (*PendingRequest, error) {
+
+	pending := &PendingRequest{
+		tracker: this,
+		req:     req,
+		addr:    addr,
+		send:    send,
+		retries: retries,
+		done:    make(chan struct{}),
+	}
+
+	pending.send_lock.Lock()
+	defer pending.send_lock.Unlock()
+
+	this.lock.Lock()
+	this.track(pending)
+	this.lock.Unlock()
+
+	err := send(req)
+	if err != nil {
+		pending.finish(nil, err)
+		return nil, err
+	}
+	return pending, nil
+}
+
+/*
+ * SendRequest : Sends a request from the transport the replies are
+ * read from, and tracks it.
+ * Parameters:
+ * [in] conn : The transport of the local node
+ * [in] to : Address of the peer
+ * [in] req : The request
+ * [in] server_ctx : Context of the local node
+ * [out] *PendingRequest : The tracked request
+ * [out] error : If the first attempt could not be sent
+ */
+func (this *PendingTracker) SendRequest(conn Transport, to net.Addr, req IMessage,
+	server_ctx *ServerConfig) (*PendingRequest, error) {
+
+	return this.Start(req, to.String(), func(msg IMessage) error {
+		if !sendMessageTo(conn, to, msg, server_ctx) {
+			return errors.New("Failed to send " + MsgType2Str(msg.Header().MsgType))
+		}
+		return nil
+	})
+}
+
+// track: Registers the current attempt of the request and arms its
+// timer. Called with the lock held.
+func (this *PendingTracker) track(pending *PendingRequest) {
+	key := pendingKey{random_id: pending.req.Header().RandomId, addr: pending.addr}
+	pending.keys = append(pending.keys, key)
+	pending.sent = append(pending.sent, time.Now())
+	this.pending[key] = pending
+
+	timeout := this.rtt.Timeout(pending.addr) << uint(pending.attempts)
+	pending.attempts++
+	pending.timer = time.AfterFunc(timeout, pending.expired)
+}
+
+/*
+ * Deliver : Hands a received reply to the request waiting for it.
+ * Parameters:
+ * [in] reply : The received message
+ * [in] addr : Address the message came from
+ * [out] bool : 'true' if a request was waiting for it
+ */
+func (this *PendingTracker) Deliver(reply IMessage, addr string) bool {
+	header := reply.Header()
+	key := pendingKey{random_id: header.RandomId, addr: addr}
+
+	this.lock.Lock()
+	pending, found := this.pending[key]
+	if !found || !isReplyTo(header.MsgType, pending.req.Header().MsgType) {
+		this.lock.Unlock()
+		return false
+	}
+	// Round trip of the attempt answered
+	var rtt time.Duration
+	for idx, attempt := range pending.keys {
+		if attempt == key {
+			rtt = time.Since(pending.sent[idx])
+		}
+	}
+	this.lock.Unlock()
+
+	var err error
+	if error_reply, ok := reply.(*ErrorReply); ok {
+		err = error_reply
+	}
+	if !pending.finishWithRtt(reply, err, rtt) {
+		return false
+	}
+	this.rtt.Sample(addr, rtt)
+	return true
+}
+
+// Estimator: Round trip time estimates of the peers
+func (this *PendingTracker) Estimator() *RttEstimator {
+	return this.rtt
+}
+
+// Pending: Number of requests waiting for their reply
+func (this *PendingTracker) Pending() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	requests := make(map[*PendingRequest]bool)
+	for _, pending := range this.pending {
+		requests[pending] = true
+	}
+	return len(requests)
+}
+
+// isReplyTo: If a message of type 'reply_type' can answer a request
+// of type 'req_type'
+func isReplyTo(reply_type, req_type uint32) bool {
+	if reply_type == ERROR_RESP {
+		return true
+	}
+	switch req_type {
+	case PING_REQ:
+		return reply_type == PING_RESP
+	case FIND_NODE_REQ:
+		return reply_type == FIND_NODE_RESP
+	case FIND_VALUE_REQ:
+		return reply_type == FIND_VALUE_RESP
+	case STORE_REQ:
+		return reply_type == STORE_RESP
+	case SESSION_INIT_REQ:
+		return reply_type == SESSION_INIT_RESP
+	}
+	// Application defined requests, their replies cannot be checked
+	return !isReplyType(req_type)
+}
+
+// expired: Sends the request again, or fails it if no retry is left
+func (this *PendingRequest) expired() {
+	tracker := this.tracker
+	this.send_lock.Lock()
+	defer this.send_lock.Unlock()
+
+	tracker.lock.Lock()
+	select {
+	case <-this.done:
+		tracker.lock.Unlock()
+		return
+	default:
+	}
+	if this.attempts > this.retries {
+		tracker.lock.Unlock()
+		if this.finish(nil, errRequestTimeout) {
+			tracker.rtt.Backoff(this.addr)
+		}
+		return
+	}
+	header := this.req.Header()
+	header.RandomId = generateRandomNodeId()
+	header.EpochTime = time.Now().Unix()
+	tracker.track(this)
+	tracker.lock.Unlock()
+
+	if err := this.send(this.req); err != nil {
+		this.finish(nil, err)
+	}
+}
+
+// finish: Completes the request, once. Returns 'false' if it already was.
+func (this *PendingRequest) finish(reply IMessage, err error) bool {
+	return this.finishWithRtt(reply, err, 0)
+}
+
+func (this *PendingRequest) finishWithRtt(reply IMessage, err error, rtt time.Duration) bool {
+	tracker := this.tracker
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	select {
+	case <-this.done:
+		return false
+	default:
+	}
+	for _, key := range this.keys {
+		delete(tracker.pending, key)
+	}
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+	this.reply = reply
+	this.err = err
+	this.rtt = rtt
+	close(this.done)
+	return true
+}
+
+/*
+ * Wait : Blocks until the request completed.
+ * Parameters:
+ * [out] IMessage : The reply, also set when it is an ErrorReply
+ * [out] error : errRequestTimeout if the peer never replied, the
+ *               ErrorReply if the request was rejected
+ */
+func (this *PendingRequest) Wait() (IMessage, error) {
+	<-this.done
+	return this.reply, this.err
+}
+
+// RoundTrip: Time between the answered attempt and its reply, once completed
+func (this *PendingRequest) RoundTrip() time.Duration {
+	<-this.done
+	return this.rtt
+}
+
+// Done: Closed once the request completed
+func (this *PendingRequest) Done() <-chan struct{} {
+	return this.done
+}
+
+// Cancel: Stops waiting for the reply
+func (this *PendingRequest) Cancel() {
+	this.finish(nil, errRequestCancelled)
+}
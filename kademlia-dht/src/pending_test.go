@@ -0,0 +1,143 @@
+package kadht
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the attempts of a request instead of sending them
+type testSender struct {
+	lock     sync.Mutex
+	attempts []NodeId
+}
+
+func (this *testSender) send(msg IMessage) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.attempts = append(this.attempts, msg.Header().RandomId)
+	return nil
+}
+
+func (this *testSender) count() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.attempts)
+}
+
+func (this *testSender) attempt(idx int) NodeId {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.attempts[idx]
+}
+
+func TestPendingReply(t *testing.T) {
+	tracker := NewPendingTracker(time.Minute, 0)
+	var sender testSender
+	ping := NewPingRequest(generateRandomNodeId())
+	pending, err := tracker.Start(ping, "10.0.0.1:4000", sender.send)
+	if err != nil {
+		t.Fatal("Failed to start request: ", err)
+	}
+
+	reply := NewPingReply(generateRandomNodeId(), ping)
+	if tracker.Deliver(reply, "10.0.0.2:4000") {
+		t.Error("Reply from another address accepted")
+	}
+	find_node_req := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	find_node_req.Header().RandomId = ping.Header().RandomId
+	if tracker.Deliver(NewFindNodeReply(generateRandomNodeId(), nil, find_node_req), "10.0.0.1:4000") {
+		t.Error("Reply of the wrong type accepted")
+	}
+	if !tracker.Deliver(reply, "10.0.0.1:4000") {
+		t.Fatal("Reply not matched")
+	}
+	if msg, err := pending.Wait(); msg != reply || err != nil {
+		t.Error("Wrong reply: ", msg, err)
+	}
+	if tracker.Deliver(reply, "10.0.0.1:4000") || tracker.Pending() != 0 {
+		t.Error("Completed request still tracked")
+	}
+}
+
+func TestPendingErrorReply(t *testing.T) {
+	tracker := NewPendingTracker(time.Minute, 0)
+	var sender testSender
+	store_req := NewStoreRequest(generateRandomNodeId(), generateRandomNodeId(), []byte("value"), 0)
+	pending, _ := tracker.Start(store_req, "10.0.0.1:4000", sender.send)
+
+	error_reply := NewErrorReply(generateRandomNodeId(), store_req.Header(), ERR_CODE_RATE_LIMITED, "slow down")
+	tracker.Deliver(error_reply, "10.0.0.1:4000")
+	if _, err := pending.Wait(); err != error_reply {
+		t.Error("Rejection not reported: ", err)
+	}
+}
+
+func TestPendingRetries(t *testing.T) {
+	tracker := NewPendingTracker(10*time.Millisecond, 2)
+	var sender testSender
+	pending, _ := tracker.Start(NewPingRequest(generateRandomNodeId()), "10.0.0.1:4000", sender.send)
+
+	start := time.Now()
+	if _, err := pending.Wait(); err != errRequestTimeout {
+		t.Fatal("Unanswered request did not time out: ", err)
+	}
+	// 10ms, then 20ms and 40ms of backoff
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Error("Retries without backoff: ", elapsed)
+	}
+	if sender.count() != 3 || sender.attempt(0) == sender.attempt(1) {
+		t.Error("Wrong attempts: ", sender.count())
+	}
+
+	// A late reply to the first attempt completes the request
+	tracker = NewPendingTracker(10*time.Millisecond, 5)
+	sender2 := &testSender{}
+	ping := NewPingRequest(generateRandomNodeId())
+	first := *ping.Header()
+	pending, _ = tracker.Start(ping, "10.0.0.1:4000", sender2.send)
+	time.Sleep(15 * time.Millisecond)
+
+	reply := NewPingReply(generateRandomNodeId(), &PingRequest{base_msg: first})
+	if !tracker.Deliver(reply, "10.0.0.1:4000") {
+		t.Fatal("Reply to an earlier attempt not matched")
+	}
+	if _, err := pending.Wait(); err != nil {
+		t.Error("Request failed: ", err)
+	}
+	if sender2.attempt(0) != first.RandomId {
+		t.Error("First attempt not sent with the request RandomId")
+	}
+}
+
+func TestPendingOverNetwork(t *testing.T) {
+	a := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	b := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	defer a.close()
+	defer b.close()
+
+	// b answers pings from its only socket
+	go func() {
+		msg, from, err := ReceiveMessage(b.transport, b.ctx)
+		if err == nil {
+			sendMessageTo(b.transport, from, NewPingReply(b.ctx.node_id, msg.(*PingRequest)), b.ctx)
+		}
+	}()
+	// a hands what it receives to the tracker
+	tracker := NewPendingTracker(time.Second, 1)
+	go func() {
+		msg, from, err := ReceiveMessage(a.transport, a.ctx)
+		if err == nil {
+			tracker.Deliver(msg, from.String())
+		}
+	}()
+
+	pending, err := tracker.SendRequest(a.transport, b.addr, NewPingRequest(a.ctx.node_id), a.ctx)
+	if err != nil {
+		t.Fatal("Failed to send request: ", err)
+	}
+	reply, err := pending.Wait()
+	if err != nil || reply.Header().SenderId != b.ctx.node_id {
+		t.Error("Ping reply not delivered: ", err)
+	}
+}
@@ -0,0 +1,226 @@
+package kadht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Abuse protection of the RPC server.
+ *
+ * Incoming requests are rate limited with token buckets, one per
+ * source IP and one per SenderId. Requests over the limit are answered
+ * with an ERR_CODE_RATE_LIMITED error, itself rate limited.
+ *
+ * The source address of a UDP request can be spoofed, so a node could
+ * be used to send large replies to a victim. Until a source is verified,
+ * i.e. it answered one of our own requests and so proved it receives
+ * what is sent to its address, replies to it are at most
+ * maxAmplification times larger than its request. The reply is
+ * measured as it goes on the wire, in the version negotiated with the
+ * source, signed and sealed in its session, and the request by its
+ * smallest encoding, unsigned binary. Lists of nodes are
+ * trimmed, and other replies too large, such as found values, are
+ * replaced by an ERR_CODE_UNVERIFIED error.
+ * A PING from an unverified source is answered with a PING of our own,
+ * which verifies it once answered. A requester told ERR_CODE_UNVERIFIED
+ * so pings the node, then sends its request again, see client.go.
+ */
+
+const (
+	// Max ratio of the reply size to the request size for unverified sources
+	maxAmplification = 3
+	// Max number of sources or senders tracked by a RateLimiter
+	maxRateLimitEntries = 65536
+	// Time a source stays verified after its last reply
+	verifiedSourceLifetime = time.Hour
+	// Max number of verified sources remembered
+	maxVerifiedSources = 65536
+)
+
+/*
+ * RateLimit : Configuration of a token bucket
+ */
+type RateLimit struct {
+	Rate  float64 // Requests allowed per second, 0 disables the limit
+	Burst int     // Requests allowed at once
+}
+
+var (
+	// Default limit of the requests from one IP address
+	DefaultSourceRateLimit = RateLimit{Rate: 50, Burst: 100}
+	// Default limit of the requests from one node
+	DefaultSenderRateLimit = RateLimit{Rate: 20, Burst: 50}
+	// Default limit of the error replies sent for rate limited requests
+	defaultErrorRateLimit = RateLimit{Rate: 100, Burst: 100}
+)
+
+// State of the bucket of one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+ * RateLimiter : Token buckets by key
+ */
+type RateLimiter struct {
+	lock    sync.Mutex
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+/*
+ * Allow : Takes a token from the bucket of the key.
+ * Parameters:
+ * [in] key : Source of the request
+ * [out] bool : 'false' if the bucket is empty
+ */
+func (this *RateLimiter) Allow(key string) bool {
+	if this.limit.Rate <= 0 {
+		return true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.now()
+	bucket, found := this.buckets[key]
+	if !found {
+		if len(this.buckets) >= maxRateLimitEntries {
+			this.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: float64(this.limit.Burst), last: now}
+		this.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * this.limit.Rate
+	if bucket.tokens > float64(this.limit.Burst) {
+		bucket.tokens = float64(this.limit.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep: Makes room for new keys. Buckets which refilled since their
+// last use are dropped first, as they would be created full anyway.
+// Called with the lock held.
+func (this *RateLimiter) sweep(now time.Time) {
+	refill := time.Duration(float64(this.limit.Burst) / this.limit.Rate * float64(time.Second))
+	for key, bucket := range this.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(this.buckets, key)
+		}
+	}
+	// Under attack from too many sources, forget some at random
+	for key := range this.buckets {
+		if len(this.buckets) < maxRateLimitEntries {
+			break
+		}
+		delete(this.buckets, key)
+	}
+}
+
+/*
+ * verifiedSources : Addresses which answered our requests
+ */
+type verifiedSources struct {
+	lock    sync.Mutex
+	sources map[string]time.Time // Verification time by address
+}
+
+func newVerifiedSources() *verifiedSources {
+	return &verifiedSources{sources: make(map[string]time.Time)}
+}
+
+func (this *verifiedSources) add(addr net.Addr) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	if len(this.sources) >= maxVerifiedSources {
+		for key, verified := range this.sources {
+			if now.Sub(verified) > verifiedSourceLifetime || len(this.sources) >= maxVerifiedSources {
+				delete(this.sources, key)
+			}
+		}
+	}
+	this.sources[addr.String()] = now
+}
+
+func (this *verifiedSources) contains(addr net.Addr) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	verified, found := this.sources[addr.String()]
+	return found && time.Since(verified) <= verifiedSourceLifetime
+}
+
+// sourceIp: The IP part of the address, shared by all the ports of a host
+func sourceIp(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+/*
+ * limitReply : Fits the reply to an unverified source within
+ * maxAmplification times the size of its request.
+ * Parameters:
+ * [in] req : The request
+ * [in] reply : The reply, its list of nodes may be trimmed
+ * [in] to : Address of the source
+ * [in] server_ctx : Context of the local node
+ * [out] IMessage : The reply to send, an ERR_CODE_UNVERIFIED error reply
+ *                   if it does not fit
+ */
+func limitReply(req, reply IMessage, to net.Addr, server_ctx *ServerConfig) IMessage {
+	// The smallest encoding of the request, whatever it was received in
+	version := req.Header().Version
+	req.Header().Version = WIRE_VERSION_BINARY
+	req_data, err := EncodeMessage(req)
+	req.Header().Version = version
+	if err != nil {
+		return reply
+	}
+	max_size := maxAmplification * len(req_data)
+	fits := func() bool {
+		size, err := wireSize(reply, to.String(), server_ctx)
+		return err == nil && size <= max_size
+	}
+
+	for !fits() {
+		switch m := reply.(type) {
+		case *FindNodeReply:
+			if len(m.Nodes) > 0 {
+				m.Nodes = m.Nodes[:len(m.Nodes)-1]
+				m.TotalNodes = int32(len(m.Nodes))
+				continue
+			}
+		case *FindValueReply:
+			if !m.Found && len(m.Nodes) > 0 {
+				m.Nodes = m.Nodes[:len(m.Nodes)-1]
+				m.TotalNodes = int32(len(m.Nodes))
+				continue
+			}
+		}
+		return NewErrorReply(server_ctx.node_id, req.Header(), ERR_CODE_UNVERIFIED,
+			"Reply too large for an unverified source")
+	}
+	return reply
+}
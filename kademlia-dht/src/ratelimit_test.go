@@ -0,0 +1,217 @@
+package kadht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Rate: 10, Burst: 5})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow("a") {
+			t.Fatal("Burst not allowed")
+		}
+	}
+	if limiter.Allow("a") {
+		t.Fatal("Request over the burst allowed")
+	}
+	if !limiter.Allow("b") {
+		t.Error("Other key limited")
+	}
+
+	// One token every 100ms
+	now = now.Add(250 * time.Millisecond)
+	if !limiter.Allow("a") || !limiter.Allow("a") || limiter.Allow("a") {
+		t.Error("Tokens not refilled at the rate")
+	}
+}
+
+func TestRpcServerRateLimit(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	b.SetRateLimits(RateLimit{Rate: 0.001, Burst: 2}, RateLimit{})
+
+	for i := 0; i < 2; i++ {
+		pending, _ := a.Request(b.LocalAddr(), NewFindNodeRequest(a.server_ctx.node_id, generateRandomNodeId()))
+		if _, err := pending.Wait(); err != nil {
+			t.Fatal("Request within the limit rejected: ", err)
+		}
+	}
+	pending, _ := a.Request(b.LocalAddr(), NewFindNodeRequest(a.server_ctx.node_id, generateRandomNodeId()))
+	_, err := pending.Wait()
+	if error_reply, ok := err.(*ErrorReply); !ok || error_reply.Code != ERR_CODE_RATE_LIMITED {
+		t.Error("Request over the limit not rejected: ", err)
+	}
+}
+
+func TestRpcServerAmplification(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 1; i <= 10; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 4000}
+		b.routing_table.AddEntryOnly(CreateNode(addr, generateRandomNodeId()))
+	}
+
+	// a is not verified, the reply is trimmed
+	req := NewFindNodeRequest(a.server_ctx.node_id, generateRandomNodeId())
+	req_data, _ := EncodeMessage(req)
+	pending, _ := a.Request(b.LocalAddr(), req)
+	reply, err := pending.Wait()
+	if err != nil {
+		t.Fatal("Find node not answered: ", err)
+	}
+	reply_data, _ := EncodeMessage(reply)
+	if len(reply_data) > maxAmplification*len(req_data) {
+		t.Error("Reply to an unverified source too large: ", len(reply_data))
+	}
+	if len(reply.(*FindNodeReply).Nodes) >= alphaNodes {
+		t.Error("Reply to an unverified source not trimmed")
+	}
+
+	// b verifies a by pinging it back
+	pending, _ = a.Request(b.LocalAddr(), NewPingRequest(a.server_ctx.node_id))
+	if _, err := pending.Wait(); err != nil {
+		t.Fatal("Ping not answered: ", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !b.verified.contains(a.LocalAddr()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Source not verified")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pending, _ = a.Request(b.LocalAddr(), NewFindNodeRequest(a.server_ctx.node_id, generateRandomNodeId()))
+	if reply, err = pending.Wait(); err != nil || len(reply.(*FindNodeReply).Nodes) != alphaNodes {
+		t.Error("Full reply not sent to a verified source: ", err)
+	}
+}
+
+func TestLimitReplyWireSize(t *testing.T) {
+	// Signed replies, in JSON: larger on the wire than their encoding
+	ctx := newSignedTestConfig(t)
+	ctx.SetVersionRange(WIRE_VERSION_BINARY, WIRE_VERSION_JSON)
+	ctx.SetRoutingTable(NewRoutingTable(ctx.node_id))
+	to := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 4000}
+	peer_id := generateRandomNodeId()
+	ctx.routing_table.AddEntryOnly(CreateNode(to, peer_id))
+
+	var nodes []RemoteNode
+	for i := 0; i < alphaNodes; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 4000}
+		nodes = append(nodes, RemoteNode{Id: generateRandomNodeId(), Addr: NewIpv4Addr(addr)})
+	}
+	req := NewFindNodeRequest(peer_id, generateRandomNodeId())
+	req_data, _ := EncodeMessage(req)
+	for _, version := range []uint32{WIRE_VERSION_BINARY, WIRE_VERSION_JSON} {
+		ctx.routing_table.SetContactVersion(peer_id, version)
+		reply := limitReply(req, NewFindNodeReply(ctx.node_id, nodes, req), to, ctx)
+		if _, ok := reply.(*ErrorReply); ok {
+			// Even an empty list of nodes is too large in JSON
+			if version == WIRE_VERSION_BINARY {
+				t.Error("Binary reply not trimmed to fit")
+			}
+			continue
+		}
+		size, _ := wireSize(reply, to.String(), ctx)
+		if size > maxAmplification*len(req_data) {
+			t.Errorf("Reply in version %d too large on the wire: %d", version, size)
+		}
+	}
+}
+
+func TestRpcServerUnverifiedValue(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	key := generateRandomNodeId()
+	value := testValue(1000)
+	b.store.Put(key, value, time.Hour)
+
+	// Too large to be sent to a, not verified yet
+	pending, _ := a.Request(b.LocalAddr(), NewFindValueRequest(a.server_ctx.node_id, key))
+	_, err := pending.Wait()
+	if error_reply, ok := err.(*ErrorReply); !ok || error_reply.Code != ERR_CODE_UNVERIFIED {
+		t.Fatal("Large value sent to an unverified source: ", err)
+	}
+
+	// The client call pings b to be verified, then asks again
+	found, _, err := a.FindValue(context.Background(), b.LocalAddr(), key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("Value not found once verified: ", err)
+	}
+}
+
+// readDatagrams: Types of the messages received until no more arrive
+func readDatagrams(endpoint *testEndpoint) []uint32 {
+	var types []uint32
+	buf := make([]byte, 65536)
+	for {
+		endpoint.transport.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := endpoint.transport.ReadFrom(buf)
+		if err != nil {
+			return types
+		}
+		if header, err := decodeMessageHeader(buf[:n]); err == nil {
+			types = append(types, header.MsgType)
+		}
+	}
+}
+
+func TestRpcServerReflection(t *testing.T) {
+	ctx := NewServerConfig(generateRandomNodeId())
+	ctx.RequireSignatures(true)
+	b := NewRpcServer(ctx, NewRoutingTable(ctx.node_id))
+	b.SetRateLimits(RateLimit{Rate: 0.001, Burst: 5}, RateLimit{})
+	b.SetRequestPolicy(20*time.Millisecond, DefaultRequestRetries)
+	transport, _ := testNetwork.Listen(nil)
+	b.SetTransport(transport)
+	b.Start()
+	defer b.Close()
+
+	// The victim gets a few error replies for many rejected requests
+	victim := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	defer victim.close()
+	for i := 0; i < 20; i++ {
+		SendPingRequest(victim.transport, b.LocalAddr(), victim.ctx)
+	}
+	if replies := readDatagrams(victim); len(replies) != 5 {
+		t.Error("Rejected requests not rate limited: ", len(replies))
+	}
+}
+
+func TestRpcServerVerificationPing(t *testing.T) {
+	ctx := NewServerConfig(generateRandomNodeId())
+	b := NewRpcServer(ctx, NewRoutingTable(ctx.node_id))
+	b.SetRequestPolicy(20*time.Millisecond, DefaultRequestRetries)
+	transport, _ := testNetwork.Listen(nil)
+	b.SetTransport(transport)
+	b.Start()
+	defer b.Close()
+
+	// A source which never answers is pinged back once
+	victim := newTestEndpoint(t, NewServerConfig(generateRandomNodeId()))
+	defer victim.close()
+	SendPingRequest(victim.transport, b.LocalAddr(), victim.ctx)
+	pings := 0
+	for _, mtype := range readDatagrams(victim) {
+		if mtype == PING_REQ {
+			pings++
+		}
+	}
+	if pings != 1 {
+		t.Error("Wrong number of verification pings: ", pings)
+	}
+}
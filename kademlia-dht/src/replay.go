@@ -0,0 +1,170 @@
+package kadht
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// Default allowed difference between the EpochTime of a
+	// message and the local clock
+	DefaultMaxClockSkew = 30 * time.Second
+	// Default number of messages remembered for duplicate detection
+	DefaultReplayCacheSize = 65536
+)
+
+var (
+	errStaleMessage    = errors.New("Message outside the clock skew window")
+	errReplayedMessage = errors.New("Replayed message")
+)
+
+/*
+ * ReplayStats : Counters of the messages checked by a ReplayGuard
+ */
+type ReplayStats struct {
+	Accepted  uint64 // Messages accepted
+	Stale     uint64 // Dropped, EpochTime outside the skew window
+	Duplicate uint64 // Dropped, already seen within the window
+	Overflow  uint64 // Dropped, too old to be checked against the cache
+}
+
+// Identifies a message. Replies echo the RandomId of the request,
+// so the sender and type are part of the key.
+type replayKey struct {
+	sender_id NodeId
+	random_id NodeId
+	msg_type  uint32
+}
+
+// A message remembered, ordered by EpochTime in a replayHeap
+type replayEntry struct {
+	key   replayKey
+	epoch int64
+}
+
+// replayHeap: Min-heap of the remembered messages by EpochTime
+type replayHeap []replayEntry
+
+func (this replayHeap) Len() int            { return len(this) }
+func (this replayHeap) Less(i, j int) bool  { return this[i].epoch < this[j].epoch }
+func (this replayHeap) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *replayHeap) Push(x interface{}) { *this = append(*this, x.(replayEntry)) }
+func (this *replayHeap) Pop() interface{} {
+	old := *this
+	entry := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return entry
+}
+
+/*
+ * ReplayGuard : Rejects messages whose EpochTime is outside the
+ * allowed clock skew, and messages already seen within that window
+ * (same sender, type and RandomId).
+ * The memory used is bounded by the cache size. When it is full, the
+ * messages already outside the window are forgotten first, then the
+ * ones with the oldest EpochTime: from then on messages not newer than
+ * any of those are rejected, since they can no longer be told apart
+ * from replays. Dropping by EpochTime rather than arrival order keeps
+ * a message dated in the future from raising that limit above the
+ * time of the legitimate messages.
+ */
+type ReplayGuard struct {
+	lock       sync.Mutex
+	max_skew   time.Duration
+	cache_size int
+	seen       map[replayKey]int64 // By key, EpochTime of the message
+	order      replayHeap          // The keys by EpochTime
+	watermark  int64               // Newest EpochTime dropped from the cache
+	stats      ReplayStats
+	now        func() time.Time
+}
+
+/*
+ * NewReplayGuard : Creates a new replay guard.
+ * Parameters:
+ * [in] max_skew : Max allowed difference between the message time and
+ *                 the local time, in either direction.
+ * [in] cache_size : Max number of messages remembered.
+ * [out] *ReplayGuard : Pointer to the newly created ReplayGuard
+ */
+func NewReplayGuard(max_skew time.Duration, cache_size int) *ReplayGuard {
+	if cache_size <= 0 {
+		cache_size = DefaultReplayCacheSize
+	}
+	return &ReplayGuard{
+		max_skew:   max_skew,
+		cache_size: cache_size,
+		seen:       make(map[replayKey]int64, cache_size),
+		order:      make(replayHeap, 0, cache_size),
+		watermark:  -1 << 63,
+		now:        time.Now,
+	}
+}
+
+/*
+ * Check : Checks the message header and remembers it.
+ * Parameters:
+ * [in] header : Header of the received message
+ * [out] error : If the message must be dropped
+ */
+func (this *ReplayGuard) Check(header *BasicMsgHeader) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.now()
+	msg_time := time.Unix(header.EpochTime, 0)
+	// EpochTime has a resolution of one second
+	oldest := now.Add(-this.max_skew - time.Second)
+	if msg_time.Before(oldest) || msg_time.After(now.Add(this.max_skew)) {
+		this.stats.Stale++
+		return errStaleMessage
+	}
+	if header.EpochTime <= this.watermark {
+		this.stats.Overflow++
+		return errReplayedMessage
+	}
+
+	key := replayKey{
+		sender_id: header.SenderId,
+		random_id: header.RandomId,
+		msg_type:  header.MsgType,
+	}
+	if _, found := this.seen[key]; found {
+		this.stats.Duplicate++
+		return errReplayedMessage
+	}
+
+	if len(this.order) >= this.cache_size {
+		this.evict(oldest.Unix())
+	}
+	heap.Push(&this.order, replayEntry{key: key, epoch: header.EpochTime})
+	this.seen[key] = header.EpochTime
+	this.stats.Accepted++
+	return nil
+}
+
+// evict: Makes room for one message. Those older than 'oldest' are
+// stale, forgetting them does not raise the watermark. Called with the
+// lock held.
+func (this *ReplayGuard) evict(oldest int64) {
+	for len(this.order) > 0 && this.order[0].epoch < oldest {
+		delete(this.seen, heap.Pop(&this.order).(replayEntry).key)
+	}
+	if len(this.order) < this.cache_size {
+		return
+	}
+	entry := heap.Pop(&this.order).(replayEntry)
+	if entry.epoch > this.watermark {
+		this.watermark = entry.epoch
+	}
+	delete(this.seen, entry.key)
+}
+
+// Stats: Returns a snapshot of the counters
+func (this *ReplayGuard) Stats() ReplayStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.stats
+}
@@ -0,0 +1,131 @@
+package kadht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	guard := NewReplayGuard(10*time.Second, 16)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+
+	ping := NewPingRequest(generateRandomNodeId())
+	ping.base_msg.EpochTime = now.Unix()
+	if err := guard.Check(ping.Header()); err != nil {
+		t.Fatal("Fresh message rejected: ", err)
+	}
+	if err := guard.Check(ping.Header()); err != errReplayedMessage {
+		t.Error("Duplicate message accepted: ", err)
+	}
+
+	// The reply echoes the RandomId of the request, it is no replay
+	reply := NewPingReply(generateRandomNodeId(), ping)
+	reply.base_msg.EpochTime = now.Unix()
+	if err := guard.Check(reply.Header()); err != nil {
+		t.Error("Reply rejected: ", err)
+	}
+
+	old := NewPingRequest(ping.base_msg.SenderId)
+	old.base_msg.EpochTime = now.Add(-time.Minute).Unix()
+	if err := guard.Check(old.Header()); err != errStaleMessage {
+		t.Error("Stale message accepted: ", err)
+	}
+	future := NewPingRequest(ping.base_msg.SenderId)
+	future.base_msg.EpochTime = now.Add(time.Minute).Unix()
+	if err := guard.Check(future.Header()); err != errStaleMessage {
+		t.Error("Message from the future accepted: ", err)
+	}
+
+	stats := guard.Stats()
+	if stats.Accepted != 2 || stats.Duplicate != 1 || stats.Stale != 2 {
+		t.Error("Wrong stats: ", stats)
+	}
+}
+
+func TestReplayGuardBounded(t *testing.T) {
+	guard := NewReplayGuard(10*time.Second, 4)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+
+	sender := generateRandomNodeId()
+	first := NewPingRequest(sender)
+	first.base_msg.EpochTime = now.Add(-2 * time.Second).Unix()
+	guard.Check(first.Header())
+
+	// Push the first message out of the cache
+	for i := 0; i < 4; i++ {
+		ping := NewPingRequest(sender)
+		ping.base_msg.EpochTime = now.Unix()
+		if err := guard.Check(ping.Header()); err != nil {
+			t.Fatal("Fresh message rejected: ", err)
+		}
+	}
+	if len(guard.seen) != 4 {
+		t.Error("Cache grew beyond its size: ", len(guard.seen))
+	}
+
+	// Forgotten, but still must not be accepted again
+	if err := guard.Check(first.Header()); err != errReplayedMessage {
+		t.Error("Replay of a forgotten message accepted: ", err)
+	}
+	if guard.Stats().Overflow != 1 {
+		t.Error("Wrong stats: ", guard.Stats())
+	}
+}
+
+func TestReplayGuardFutureMessage(t *testing.T) {
+	guard := NewReplayGuard(10*time.Second, 4)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+
+	// A message dated at the end of the window, then enough to fill the cache
+	sender := generateRandomNodeId()
+	future := NewPingRequest(sender)
+	future.base_msg.EpochTime = now.Add(10 * time.Second).Unix()
+	guard.Check(future.Header())
+	for i := 0; i < 8; i++ {
+		ping := NewPingRequest(sender)
+		ping.base_msg.EpochTime = now.Add(-time.Second).Unix()
+		guard.Check(ping.Header())
+	}
+
+	// Messages of the present are still accepted
+	ping := NewPingRequest(sender)
+	ping.base_msg.EpochTime = now.Unix()
+	if err := guard.Check(ping.Header()); err != nil {
+		t.Error("Fresh message rejected after a message from the future: ", err)
+	}
+	if err := guard.Check(future.Header()); err != errReplayedMessage {
+		t.Error("Replay of the message from the future accepted: ", err)
+	}
+
+	// Messages outside the window are forgotten first
+	later := now.Add(20 * time.Second)
+	guard.now = func() time.Time { return later }
+	for i := 0; i < 3; i++ {
+		ping := NewPingRequest(sender)
+		ping.base_msg.EpochTime = later.Unix()
+		guard.Check(ping.Header())
+	}
+	if guard.watermark != now.Add(-time.Second).Unix() || len(guard.seen) != 4 {
+		t.Error("Watermark raised by stale messages: ", guard.watermark)
+	}
+}
+
+func TestReplayProtectionDecode(t *testing.T) {
+	sender_ctx := NewServerConfig(generateRandomNodeId())
+	receiver_ctx := NewServerConfig(generateRandomNodeId())
+	receiver_ctx.EnableReplayProtection(DefaultMaxClockSkew, 0)
+
+	data, _ := EncodeDatagram(NewPingRequest(sender_ctx.node_id), sender_ctx)
+	if _, err := DecodeDatagram(data, receiver_ctx); err != nil {
+		t.Fatal("Message rejected: ", err)
+	}
+	if _, err := DecodeDatagram(data, receiver_ctx); err != errReplayedMessage {
+		t.Error("Replayed datagram accepted: ", err)
+	}
+	if receiver_ctx.ReplayStats().Duplicate != 1 {
+		t.Error("Dropped message not counted")
+	}
+}
@@ -3,6 +3,8 @@ package kadht
 import (
 	"fmt"
 	"net"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -24,27 +26,43 @@ type Node struct {
 	address        net.UDPAddr // Address of the remote node
 	id             NodeId      // 20 byte ID of the remote node
 	lastAccessTime time.Time   // Last looked up by current node
+	version        uint32      // Highest wire version common with the node, 0 if unknown
 }
 
-// Represents a single bucket in the routing table
+// Represents a single bucket in the routing table.
+// Entries are ordered by the time they were last seen, least
+// recently seen first.
 type Bucket struct {
 	entries []Node
 	used    int
 }
 
 type RoutingTable struct {
-	server_id NodeId
-	slots     []Bucket
+	lock        sync.RWMutex
+	server_id   NodeId
+	slots       []Bucket
+	by_addr     map[string]NodeId // Node IDs by node address
+	bucket_size int               // Max number of entries per bucket
 }
 
 // Create a new Routing Table
 func NewRoutingTable(snode_id NodeId) *RoutingTable {
 	return &RoutingTable{
-		server_id: snode_id,
-		slots:     make([]Bucket, numBuckets),
+		server_id:   snode_id,
+		slots:       make([]Bucket, numBuckets),
+		by_addr:     make(map[string]NodeId),
+		bucket_size: entriesPerBucket,
 	}
 }
 
+// SetBucketSize: Sets the max number of entries per bucket, the 'k'
+// of kademlia. Must be set before any entry is added.
+func (this *RoutingTable) SetBucketSize(size int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.bucket_size = size
+}
+
 func CreateNode(addr *net.UDPAddr, id NodeId) *Node {
 	return &Node{
 		address:        *addr,
@@ -61,16 +79,20 @@ func CreateNode(addr *net.UDPAddr, id NodeId) *Node {
 //              'false' if the bucket is full.
 //
 func (this *RoutingTable) AddEntryOnly(node *Node) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	slot := commonBits(this.server_id, node.id)
 	entry, found := this.findEntry(slot, node.id)
 
 	if !found {
-		if this.slots[slot].used == entriesPerBucket {
+		if this.slots[slot].used >= this.bucket_size {
 			//TODO: Someone should handle the eviction
 			return false
 		}
 		this.slots[slot].entries = append(this.slots[slot].entries, *node)
 		this.slots[slot].used++
+		this.by_addr[node.address.String()] = node.id
 	} else {
 		entry.lastAccessTime = time.Now()
 	}
@@ -83,17 +105,228 @@ func (this *RoutingTable) AddEntryOnly(node *Node) bool {
 // [out] bool : 'true' if successfully removed, 'false' otherwise
 //
 func (this *RoutingTable) RemoveEntry(node *Node) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	slot := commonBits(this.server_id, node.id)
 	index, found := this.findEntryByIndex(slot, node.id)
 
 	if !found {
 		return true
 	}
-	bucket := this.slots[slot].entries
-	bucket = append(bucket[:index], bucket[index+1:]...)
+	this.removeIndex(slot, index)
+	return true
+}
+
+// removeIndex: Removes the entry at 'index' of the bucket. Called with
+// the lock held.
+func (this *RoutingTable) removeIndex(slot, index int) {
+	bucket := &this.slots[slot]
+	delete(this.by_addr, bucket.entries[index].address.String())
+	bucket.entries = append(bucket.entries[:index], bucket.entries[index+1:]...)
+	bucket.used--
+}
+
+// UpdateEntry: Records that a node was seen, as the kademlia paper
+// prescribes. A known node moves to the tail of its bucket, keeping the
+// address it is known at, see MoveEntry. A new one is added at the tail
+// if there is room.
+// Parameters:
+// [in] node : The node seen
+// [out] *Node : If the bucket is full, a copy of its least recently
+//               seen entry, to check before replacing it with ReplaceEntry
+// [out] bool : 'true' if the node is in the routing table
+//
+func (this *RoutingTable) UpdateEntry(node *Node) (*Node, bool) {
+	if node.id == this.server_id {
+		return nil, false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	slot := commonBits(this.server_id, node.id)
+	index, found := this.findEntryByIndex(slot, node.id)
+	if found {
+		seen := this.slots[slot].entries[index]
+		seen.lastAccessTime = time.Now()
+		this.removeIndex(slot, index)
+		this.appendEntry(slot, seen)
+		return nil, true
+	}
+	if this.slots[slot].used >= this.bucket_size {
+		oldest := this.slots[slot].entries[0]
+		return &oldest, false
+	}
+	seen := *node
+	seen.lastAccessTime = time.Now()
+	this.appendEntry(slot, seen)
+	return nil, true
+}
+
+// MoveEntry: Records that a known node was seen at a new address.
+// Parameters:
+// [in] id : ID of the node
+// [in] addr : Its new address
+// [out] bool : 'false' if the node is not in the routing table
+//
+func (this *RoutingTable) MoveEntry(id NodeId, addr *net.UDPAddr) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	slot := commonBits(this.server_id, id)
+	index, found := this.findEntryByIndex(slot, id)
+	if !found {
+		return false
+	}
+	seen := this.slots[slot].entries[index]
+	this.removeIndex(slot, index)
+	seen.address = *addr
+	seen.version = 0
+	seen.lastAccessTime = time.Now()
+	this.appendEntry(slot, seen)
+	return true
+}
+
+// Entry: Finds the entry of a node.
+// Parameters:
+// [in] id : ID of the node
+// [out] Node : A copy of the entry
+// [out] bool : 'false' if the node is not in the routing table
+//
+func (this *RoutingTable) Entry(id NodeId) (Node, bool) {
+	if id == this.server_id {
+		return Node{}, false
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	entry, found := this.findEntry(commonBits(this.server_id, id), id)
+	if !found {
+		return Node{}, false
+	}
+	return *entry, true
+}
+
+// ReplaceEntry: Replaces an unresponsive entry with a new node.
+// Parameters:
+// [in] old_id : ID of the entry to evict
+// [in] node : The node to add in its place
+// [out] bool : 'false' if the entry is gone or the node was not added
+//
+func (this *RoutingTable) ReplaceEntry(old_id NodeId, node *Node) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	slot := commonBits(this.server_id, old_id)
+	index, found := this.findEntryByIndex(slot, old_id)
+	if !found {
+		return false
+	}
+	this.removeIndex(slot, index)
+
+	new_slot := commonBits(this.server_id, node.id)
+	if _, found := this.findEntryByIndex(new_slot, node.id); found ||
+		this.slots[new_slot].used >= this.bucket_size {
+		return false
+	}
+	seen := *node
+	seen.lastAccessTime = time.Now()
+	this.appendEntry(new_slot, seen)
 	return true
 }
 
+// StaleContacts: Finds the entries not seen for 'max_age'.
+// Parameters:
+// [in] max_age : Time since the entries were last seen
+// [out] []*Node : Copies of the entries
+//
+func (this *RoutingTable) StaleContacts(max_age time.Duration) []*Node {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	var stale []*Node
+	now := time.Now()
+	for slot := range this.slots {
+		bucket := &this.slots[slot]
+		for idx := 0; idx < bucket.used; idx++ {
+			if now.Sub(bucket.entries[idx].lastAccessTime) >= max_age {
+				entry := bucket.entries[idx]
+				stale = append(stale, &entry)
+			}
+		}
+	}
+	return stale
+}
+
+// Size: Number of entries in the routing table
+func (this *RoutingTable) Size() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	size := 0
+	for slot := range this.slots {
+		size += this.slots[slot].used
+	}
+	return size
+}
+
+// Contains: If the node is in the routing table
+func (this *RoutingTable) Contains(id NodeId) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	_, found := this.findEntry(commonBits(this.server_id, id), id)
+	return found
+}
+
+// appendEntry: Adds an entry at the tail of the bucket. Called with the
+// lock held.
+func (this *RoutingTable) appendEntry(slot int, node Node) {
+	bucket := &this.slots[slot]
+	bucket.entries = append(bucket.entries, node)
+	bucket.used++
+	this.by_addr[node.address.String()] = node.id
+}
+
+// SetContactVersion: Records the wire version to use with a node.
+// Parameters:
+// [in] id : The Node ID
+// [in] version : Wire version negotiated with the node
+// [out] bool : 'true' if the node is in the routing table
+//
+func (this *RoutingTable) SetContactVersion(id NodeId, version uint32) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, found := this.findEntry(commonBits(this.server_id, id), id)
+	if !found {
+		return false
+	}
+	entry.version = version
+	return true
+}
+
+// ContactVersion: Finds the wire version to use with the node at
+// the address.
+// Parameters:
+// [in] addr : Address of the node
+// [out] uint32 : The recorded version
+// [out] bool : 'false' if the node or its version is unknown
+//
+func (this *RoutingTable) ContactVersion(addr string) (uint32, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	id, found := this.by_addr[addr]
+	if !found {
+		return 0, false
+	}
+	entry, found := this.findEntry(commonBits(this.server_id, id), id)
+	if !found || entry.version == 0 {
+		return 0, false
+	}
+	return entry.version, true
+}
+
 // findEntry: Finds an entry in the routing table.
 // Parameters:
 // [in] slot : The slot index or the bucket ID.
@@ -141,6 +374,9 @@ func (this *RoutingTable) findEntryByIndex(slot int, id NodeId) (int, bool) {
 // [out] []NodeId : List of upto 'alphaNodes' number of Nodes
 //
 func (this *RoutingTable) LookupClosestNodes(lookup_id NodeId) []net.UDPAddr {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	var result []net.UDPAddr
 
 	if lookup_id == this.server_id {
@@ -216,6 +452,34 @@ func (this *RoutingTable) LookupClosestNodes(lookup_id NodeId) []net.UDPAddr {
 	return result
 }
 
+// LookupClosestContacts: Finds the contacts closest to the lookup ID,
+// closest first.
+// Parameters:
+// [in] lookup_id : The ID that needs to be looked up
+// [in] count : Max number of contacts to return
+// [out] []RemoteNode : The contacts, sorted by XOR distance
+//
+func (this *RoutingTable) LookupClosestContacts(lookup_id NodeId, count int) []RemoteNode {
+	this.lock.RLock()
+	var result []RemoteNode
+	for slot := range this.slots {
+		bucket := &this.slots[slot]
+		for idx := 0; idx < bucket.used; idx++ {
+			entry := &bucket.entries[idx]
+			result = append(result, RemoteNode{Id: entry.id, Addr: NewIpv4Addr(&entry.address)})
+		}
+	}
+	this.lock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return compareDistance(lookup_id, result[i].Id, result[j].Id) < 0
+	})
+	if len(result) > count {
+		result = result[:count]
+	}
+	return result
+}
+
 func (this *RoutingTable) printBriefStats() {
 	for i := 0; i < bytesPerNodeiId; i++ {
 		fmt.Println(i, " : ", this.slots[i].used)
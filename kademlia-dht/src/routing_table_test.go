@@ -54,3 +54,49 @@ func TestLookupClosestNode(t *testing.T) {
 		fmt.Println(e.String())
 	}
 }
+
+func TestRemoveEntry(t *testing.T) {
+	rt := NewRoutingTable(generateRandomNodeId())
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	node := CreateNode(addr, generateRandomNodeId())
+	rt.AddEntryOnly(node)
+	if !rt.RemoveEntry(node) || rt.Contains(node.id) {
+		t.Fatal("Entry not removed")
+	}
+	if _, found := rt.ContactVersion(addr.String()); found || len(rt.LookupClosestContacts(node.id, 1)) != 0 {
+		t.Error("Removed entry still found")
+	}
+}
+
+func TestUpdateEntry(t *testing.T) {
+	server_id := generateRandomNodeId()
+	rt := NewRoutingTable(server_id)
+	rt.SetBucketSize(2)
+
+	// Three nodes of the same bucket
+	var nodes []*Node
+	for i := 1; i <= 3; i++ {
+		id := server_id
+		id[bytesPerNodeiId-1] ^= 0x80 | byte(i)
+		nodes = append(nodes, CreateNode(&net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 4000}, id))
+	}
+
+	for _, node := range nodes[:2] {
+		if _, added := rt.UpdateEntry(node); !added {
+			t.Fatal("Node not added")
+		}
+	}
+	oldest, added := rt.UpdateEntry(nodes[2])
+	if added || oldest == nil || oldest.id != nodes[0].id {
+		t.Fatal("Least recently seen entry not returned for a full bucket")
+	}
+
+	// Seen again, the first node is no longer the oldest
+	rt.UpdateEntry(nodes[0])
+	if oldest, _ = rt.UpdateEntry(nodes[2]); oldest.id != nodes[1].id {
+		t.Error("Seen entry not moved to the tail")
+	}
+	if !rt.ReplaceEntry(nodes[1].id, nodes[2]) || rt.Contains(nodes[1].id) || !rt.Contains(nodes[2].id) {
+		t.Error("Entry not replaced")
+	}
+}
@@ -1,13 +1,147 @@
 package kadht
 
 import (
-	"bufio"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
+const (
+	// Largest datagram that can be received
+	maxDatagramSize = 65536
+)
+
+/*
+ * ServerConfig : Context of the local node used while
+ * building and sending messages.
+ */
+type ServerConfig struct {
+	node_id            NodeId
+	wire_version       uint32             // Lowest supported header version (and so codec)
+	max_version        uint32             // Highest supported header version
+	routing_table      *RoutingTable      // Contacts, with the version to use with each
+	signing_key        ed25519.PrivateKey // Signs the sent messages, if set
+	require_signatures bool               // Drop received messages which are not signed
+	sessions           *SessionManager    // Encrypted sessions with peers, if enabled
+	replay_guard       *ReplayGuard       // Drops replayed messages, if enabled
+	max_transfer_size  int                // Max size of a datagram sent or received in fragments
+	fragmenter         *Fragmenter        // Splits large datagrams, fragmentation disabled if nil
+	reassembler        *Reassembler       // Reassembles received fragments
+}
+
+/*
+ * NewServerConfig : Creates the context of a local node which sends
+ * its messages in the binary format.
+ * Parameters:
+ * [in] node_id : Node Id of the local node.
+ * [out] *ServerConfig : Pointer to the newly created ServerConfig
+ */
+func NewServerConfig(node_id NodeId) *ServerConfig {
+	return &ServerConfig{
+		node_id:           node_id,
+		wire_version:      WIRE_VERSION_BINARY,
+		max_version:       WIRE_VERSION_BINARY,
+		max_transfer_size: DefaultMaxTransferSize,
+		fragmenter:        NewFragmenter(),
+		reassembler:       NewReassembler(DefaultMaxTransferSize),
+	}
+}
+
+/*
+ * NewSignedServerConfig : Creates the context of a local node which
+ * signs all the messages it sends. The node ID is derived from the key.
+ * Parameters:
+ * [in] signing_key : The private key of the local node.
+ * [out] *ServerConfig : Pointer to the newly created ServerConfig
+ */
+func NewSignedServerConfig(signing_key ed25519.PrivateKey) *ServerConfig {
+	server_ctx := NewServerConfig(NodeIdFromPublicKey(signing_key.Public().(ed25519.PublicKey)))
+	server_ctx.signing_key = signing_key
+	return server_ctx
+}
+
+/*
+ * RequireSignatures : When enabled, received messages without a
+ * valid signature of their sender are dropped.
+ */
+func (this *ServerConfig) RequireSignatures(require bool) {
+	this.require_signatures = require
+}
+
+/*
+ * EnableEncryption : Enables the encrypted sessions with other nodes.
+ * Messages to peers with an established session are then encrypted.
+ * Requires a signing key, which authenticates the session handshakes.
+ * Parameters:
+ * [in] require : Drop any message received or sent outside of a
+ *                session, except the session handshakes themselves.
+ * [out] error : If the node has no signing key
+ */
+func (this *ServerConfig) EnableEncryption(require bool) error {
+	if this.signing_key == nil {
+		return errors.New("Encrypted sessions require a signing key")
+	}
+	this.sessions = NewSessionManager(require)
+	return nil
+}
+
+/*
+ * EnableReplayProtection : Drops received messages whose EpochTime is
+ * more than 'max_skew' away from the local clock, and messages already
+ * received within that window. At most 'cache_size' messages are
+ * remembered. The dropped messages are counted in ReplayStats.
+ */
+func (this *ServerConfig) EnableReplayProtection(max_skew time.Duration, cache_size int) {
+	this.replay_guard = NewReplayGuard(max_skew, cache_size)
+}
+
+/*
+ * ReplayStats : Counters of the replay protection. All zero if
+ * it is not enabled.
+ */
+func (this *ServerConfig) ReplayStats() ReplayStats {
+	if this.replay_guard == nil {
+		return ReplayStats{}
+	}
+	return this.replay_guard.Stats()
+}
+
+/*
+ * SetMaxTransferSize : Sets the max size of a datagram sent or received
+ * in fragments. Larger messages are refused when sending and dropped
+ * when receiving. Must be set before the node is started.
+ */
+func (this *ServerConfig) SetMaxTransferSize(max_size int) error {
+	if max_size < MaxUnfragmentedSize || max_size > 0xffff*fragmentDataSize {
+		return fmt.Errorf("Max transfer size must be between %d and %d",
+			MaxUnfragmentedSize, 0xffff*fragmentDataSize)
+	}
+	this.max_transfer_size = max_size
+	this.fragmenter = NewFragmenter()
+	this.reassembler = NewReassembler(max_size)
+	return nil
+}
+
+/*
+ * SetWireVersion : Selects the header version, and with it the codec,
+ * used for all the messages sent from now on. Same as a version range
+ * holding only that version.
+ */
+func (this *ServerConfig) SetWireVersion(version uint32) error {
+	return this.SetVersionRange(version, version)
+}
+
+/*
+ * SetRoutingTable : Sets the routing table of the local node, where
+ * the wire version negotiated with each contact is recorded.
+ */
+func (this *ServerConfig) SetRoutingTable(routing_table *RoutingTable) {
+	this.routing_table = routing_table
+}
+
 /*
  * ReadMessageHeader : Reads the Basic message header from the connection.
  * Parameters:
@@ -27,110 +161,474 @@ func ReadMessageHeader(resp_reader io.Reader) (BasicMsgHeader, error) {
 	return msg_header, nil
 }
 
+/*
+ * ParseMessage : Parses a complete message, header and body, from
+ * the reader. The message type found in the header is looked up in
+ * the message registry to create the message class.
+ * Parameters:
+ * [in] reader : io.Reader object to read bytes from.
+ * [out] IMessage : The message class type implementing IMessage interface.
+ * [out] int : The message type, -1 on failure.
+ */
+func ParseMessage(reader io.Reader) (IMessage, int) {
+	msg, err := parseMessage(reader)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		return nil, -1
+	}
+	return msg, int(msg.Header().MsgType)
+}
+
+func parseMessage(reader io.Reader) (IMessage, error) {
+	header, err := ReadMessageHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := NewMessage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := msg.Deserialize(reader)
+	if !ret {
+		return nil, errors.New("Failed to parse " + MsgType2Str(header.MsgType))
+	}
+	return msg, nil
+}
+
+/*
+ * EncodeDatagram : Encodes the message into a datagram ready to be
+ * sent by the local node. The message is encoded in the configured
+ * wire version and signed if the node has a signing key.
+ * Parameters:
+ * [in] msg : The message to send
+ * [in] server_ctx : Context of the local node
+ * [out] []byte : The datagram
+ * [out] error : If the message could not be encoded
+ */
+func EncodeDatagram(msg IMessage, server_ctx *ServerConfig) ([]byte, error) {
+	return appendDatagram(nil, msg, server_ctx.wire_version, server_ctx)
+}
+
+// appendDatagram: Appends the datagram of the message, encoded in
+// 'version', to 'buf'
+func appendDatagram(buf []byte, msg IMessage, version uint32, server_ctx *ServerConfig) ([]byte, error) {
+	if version != 0 {
+		msg.Header().Version = version
+	}
+	data, err := appendMessage(buf, msg)
+	if err != nil {
+		return nil, err
+	}
+	if server_ctx.signing_key != nil {
+		data = signDatagram(data, server_ctx.signing_key)
+	}
+	return data, nil
+}
+
+/*
+ * DecodeDatagram : Decodes a datagram received by the local node,
+ * verifying the signature of the sender if it has one, decrypting
+ * it if it was sent in a session and dropping replays if enabled.
+ * Fragments are kept until the message they are part of is complete.
+ * Parameters:
+ * [in] data : The datagram
+ * [in] server_ctx : Context of the local node
+ * [out] IMessage : The decoded message
+ * [out] error : If the datagram is invalid or was rejected,
+ *               errFragmentPending if it was a fragment
+ */
+func DecodeDatagram(data []byte, server_ctx *ServerConfig) (IMessage, error) {
+	return receiveDatagram(data, nil, server_ctx)
+}
+
+/*
+ * receiveDatagram : Same as DecodeDatagram, 'from' being the address
+ * the datagram was received from. Missing fragments are requested
+ * from there.
+ * FragmentNack messages are returned as is to be answered by the
+ * caller. Fragments and their requests are neither signed nor
+ * encrypted, the complete message is checked once reassembled.
+ */
+func receiveDatagram(data []byte, from net.Addr, server_ctx *ServerConfig) (IMessage, error) {
+	if isFragmentDatagram(data) {
+		msg, err := DecodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		if server_ctx.reassembler == nil {
+			return nil, errors.New("Fragmentation is not enabled")
+		}
+		switch m := msg.(type) {
+		case *FragmentNack:
+			return m, nil
+		case *FragmentData:
+			data, err = server_ctx.reassembler.Add(m, from)
+			if err != nil {
+				return nil, err
+			}
+			if isFragmentDatagram(data) {
+				return nil, errors.New("Fragment inside fragmented message")
+			}
+		}
+	}
+
+	msg, err := decodeDatagram(data, server_ctx)
+	if err != nil {
+		return nil, err
+	}
+	if server_ctx.replay_guard != nil {
+		err = server_ctx.replay_guard.Check(msg.Header())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func decodeDatagram(data []byte, server_ctx *ServerConfig) (IMessage, error) {
+	msg, signed, err := verifyDatagram(data, false)
+	if err != nil {
+		return nil, err
+	}
+	// The envelope of a session is not signed, the datagram inside is
+	if server_ctx.require_signatures && !signed && msg.Header().MsgType != SESSION_DATA {
+		return nil, errUnsignedMessage
+	}
+	sessions := server_ctx.sessions
+
+	switch m := msg.(type) {
+	case *SessionData:
+		if sessions == nil {
+			return nil, errNoSession
+		}
+		inner, err := sessions.open(m)
+		if err != nil {
+			return nil, err
+		}
+		inner_msg, _, err := verifyDatagram(inner, server_ctx.require_signatures)
+		if err != nil {
+			return nil, err
+		}
+		if inner_msg.Header().SenderId != m.base_msg.SenderId || isHandshakeMessage(inner_msg) {
+			return nil, errors.New("Invalid message inside session")
+		}
+		return inner_msg, nil
+
+	case *SessionInitRequest, *SessionInitReply:
+		if sessions == nil {
+			return nil, errNoSession
+		}
+		if !signed {
+			return nil, errUnsignedHandshake
+		}
+		if reply, ok := m.(*SessionInitReply); ok {
+			err = sessions.completeHandshake(reply)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return msg, nil
+	}
+
+	// Error replies are accepted in clear, the peer may not have
+	// been able to open a session to tell why it rejected ours
+	if sessions != nil && sessions.require_encryption && msg.Header().MsgType != ERROR_RESP {
+		return nil, errEncryptionRequired
+	}
+	return msg, nil
+}
+
+/*
+ * encryptDatagram : Encrypts the datagram of the message if the local
+ * node has a session with the peer at 'addr'.
+ */
+func encryptDatagram(msg IMessage, data []byte, addr string, server_ctx *ServerConfig) ([]byte, error) {
+	sessions := server_ctx.sessions
+	if sessions == nil || isHandshakeMessage(msg) {
+		return data, nil
+	}
+	sealed, found := sessions.seal(server_ctx.node_id, addr, data)
+	if !found {
+		if sessions.require_encryption {
+			return nil, errNoSession
+		}
+		return data, nil
+	}
+	sealed.base_msg.Version = msg.Header().Version
+	return EncodeMessage(sealed)
+}
+
 /*
  * ConsumePacket : Consumes the packet and abstracts lots
  * of details of packet parsing.
  * This is the function that must be called for complete message
  * parsing.
+ * Fragments are read until the message they belong to is complete,
+ * requesting the missing ones again when needed, and the requests
+ * for fragments sent by the local node are answered.
+ * Rejected requests are answered with an ErrorReply.
  * Parameters:
- * [in] conn : The connection channel (UDP) from where to read bytes.
+ * [in] conn : The transport from where to read datagrams.
+ * [in] server_ctx : Context of the local node.
  * [out] IMessage : The message class type implementing IMessage interface.
  * [out] int : The message type
- *
- * TODO: This is an absolutely horrible function. Do something!!
  */
-func ConsumePacket(conn *net.UDPConn) (IMessage, int) {
-	resp_reader := bufio.NewReader(conn)
-
-	header, err := ReadMessageHeader(resp_reader)
+func ConsumePacket(conn Transport, server_ctx *ServerConfig) (IMessage, int) {
+	msg, _, err := ReceiveMessage(conn, server_ctx)
 	if err != nil {
-		fmt.Println("ERROR: Parsing failed")
+		fmt.Println("ERROR: ", err)
 		return nil, -1
 	}
+	return msg, int(msg.Header().MsgType)
+}
 
-	deserializer := func(msg IMessage, mtype int) (IMessage, int) {
-		ret := msg.Deserialize(resp_reader)
-		if !ret {
-			return nil, -1
+/*
+ * ReceiveMessage : Same as ConsumePacket, also returning the address
+ * of the sender, to which replies are sent on the same connection.
+ * Parameters:
+ * [in] conn : The transport from where to read datagrams.
+ * [in] server_ctx : Context of the local node.
+ * [out] IMessage : The received message
+ * [out] net.Addr : Address of the sender
+ * [out] error : If reading failed or the message was rejected
+ */
+func ReceiveMessage(conn Transport, server_ctx *ServerConfig) (IMessage, net.Addr, error) {
+	msg, from, err := receiveMessage(conn, server_ctx, directSender{conn, server_ctx})
+	if err == nil {
+		server_ctx.learnPeerVersion(msg)
+	}
+	return msg, from, err
+}
+
+/*
+ * controlSender : Sends the messages ReceiveMessage answers on its own:
+ * the error replies to rejected datagrams, the requests for missing
+ * fragments and the fragments requested again.
+ */
+type controlSender interface {
+	// allowReply: If a datagram from 'to' may be answered, 'error_reply'
+	// if with an ErrorReply
+	allowReply(to net.Addr, error_reply bool) bool
+	// sendControl: Sends the message
+	sendControl(msg IMessage, to net.Addr) error
+}
+
+// directSender: Sends on the transport, without limits
+type directSender struct {
+	conn       Transport
+	server_ctx *ServerConfig
+}
+
+func (this directSender) allowReply(to net.Addr, error_reply bool) bool {
+	return true
+}
+
+func (this directSender) sendControl(msg IMessage, to net.Addr) error {
+	if !sendMessageTo(this.conn, to, msg, this.server_ctx) {
+		return errors.New("Failed to send " + MsgType2Str(msg.Header().MsgType))
+	}
+	return nil
+}
+
+// receiveMessage: ReceiveMessage, answering through 'control'
+func receiveMessage(conn Transport, server_ctx *ServerConfig, control controlSender) (IMessage, net.Addr, error) {
+	// Decoded messages do not refer to the buffer, it can be reused
+	buf_ptr := receiveBufferPool.Get().(*[]byte)
+	defer receiveBufferPool.Put(buf_ptr)
+	buf := *buf_ptr
+	for {
+		reassembling := server_ctx.reassembler != nil && server_ctx.reassembler.Pending() > 0
+		if reassembling {
+			conn.SetReadDeadline(time.Now().Add(fragmentNackInterval))
+		}
+		n, from, err := conn.ReadFrom(buf)
+		if reassembling {
+			conn.SetReadDeadline(time.Time{})
+			if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+				sendFragmentNacks(server_ctx, control)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read packet: %w", err)
+		}
+
+		msg, err := receiveDatagram(buf[:n], from, server_ctx)
+		if err == errFragmentPending {
+			continue
+		}
+		if err != nil {
+			reply := rejectionReply(buf[:n], err, server_ctx)
+			if reply != nil && control.allowReply(from, true) {
+				control.sendControl(reply, from)
+			}
+			return nil, from, err
+		}
+		if nack, ok := msg.(*FragmentNack); ok {
+			if control.allowReply(from, false) {
+				resendFragments(from, nack, server_ctx, control)
+			}
+			continue
+		}
+		return msg, from, nil
+	}
+}
+
+/*
+ * SendFragmentNacks : Requests the missing fragments of the messages
+ * being reassembled which made no progress lately. ConsumePacket does
+ * it while waiting for the next packet, nodes reading the connection
+ * some other way must call it periodically.
+ */
+func SendFragmentNacks(conn Transport, server_ctx *ServerConfig) {
+	sendFragmentNacks(server_ctx, directSender{conn, server_ctx})
+}
+
+func sendFragmentNacks(server_ctx *ServerConfig, control controlSender) {
+	if server_ctx.reassembler == nil {
+		return
+	}
+	nacks, addrs := server_ctx.reassembler.Stalled(server_ctx.node_id)
+	for idx, nack := range nacks {
+		if err := control.sendControl(nack, addrs[idx]); err != nil {
+			fmt.Println("ERROR: Failed to send fragment nack: ", err)
 		}
-		return msg, mtype
 	}
+}
 
-	switch header.MsgType {
-	case PING_REQ:
-		ping_req := new(PingRequest)
-		ping_req.base_msg = header
-		return deserializer(ping_req, PING_REQ)
+// resendFragments: Sends again the fragments requested by the peer,
+// if they were sent to it
+func resendFragments(to net.Addr, nack *FragmentNack, server_ctx *ServerConfig, control controlSender) {
+	if server_ctx.fragmenter == nil {
+		return
+	}
+	for _, frag := range server_ctx.fragmenter.Retransmit(nack, to) {
+		if err := control.sendControl(frag, to); err != nil {
+			fmt.Println("ERROR: Failed to resend fragment: ", err)
+			return
+		}
+	}
+}
 
-	case PING_RESP:
-		ping_resp := new(PingReply)
-		ping_resp.base_msg = header
-		return deserializer(ping_resp, PING_RESP)
+/*
+ * sendMessageTo : Encodes the message in the version negotiated with
+ * the peer and writes it to the transport, in fragments if it is
+ * larger than MaxUnfragmentedSize.
+ */
+func sendMessageTo(conn Transport, to net.Addr, msg IMessage, server_ctx *ServerConfig) bool {
+	err := writeMessage(msg, to.String(), func(data []byte) error {
+		_, err := conn.WriteTo(data, to)
+		return err
+	}, server_ctx)
+	if err != nil {
+		fmt.Println("ERROR: Failed to send ", MsgType2Str(msg.Header().MsgType), ": ", err)
+		return false
+	}
+	return true
+}
 
-	case FIND_NODE_REQ:
-		find_node_req := new(FindNodeRequest)
-		find_node_req.base_msg = header
-		return deserializer(find_node_req, FIND_NODE_REQ)
+// wireSize: Size of the datagram writeMessage sends for the message to
+// the peer at 'addr', before it is split in fragments if too large
+func wireSize(msg IMessage, addr string, server_ctx *ServerConfig) (int, error) {
+	buf := getSendBuffer()
+	encoded, err := appendDatagram(*buf, msg, server_ctx.versionFor(addr), server_ctx)
+	if err != nil {
+		return 0, err
+	}
+	size := len(encoded)
+	putSendBuffer(buf, encoded)
 
-	case FIND_NODE_RESP:
-		find_node_resp := new(FindNodeReply)
-		find_node_resp.base_msg = header
-		return deserializer(find_node_resp, FIND_NODE_RESP)
+	sessions := server_ctx.sessions
+	if sessions != nil && !isHandshakeMessage(msg) {
+		if sealed, found := sessions.sealedSize(server_ctx.node_id, addr, msg.Header().Version, size); found {
+			size = sealed
+		}
+	}
+	return size, nil
+}
+
+// writeMessage: Encodes the message for the peer at 'addr' and hands
+// the datagram, or its fragments, to 'write'. The datagram is in a
+// pooled buffer, 'write' must not keep it.
+func writeMessage(msg IMessage, addr string, write func([]byte) error, server_ctx *ServerConfig) error {
+	switch msg.(type) {
+	case *FragmentData, *FragmentNack:
+		// Sent as they are, see fragment.go
+		data, err := EncodeMessage(msg)
+		if err != nil {
+			return err
+		}
+		return write(data)
+	}
 
-	case FIND_VALUE_REQ:
-		find_value_req := new(FindValueRequest)
-		find_value_req.base_msg = header
-		return deserializer(find_value_req, FIND_VALUE_REQ)
+	buf := getSendBuffer()
+	encoded, err := appendDatagram(*buf, msg, server_ctx.versionFor(addr), server_ctx)
+	data := encoded
+	if err == nil {
+		data, err = encryptDatagram(msg, encoded, addr, server_ctx)
+	}
+	if err != nil {
+		return err
+	}
 
-	default:
-		fmt.Println("ERROR: Invalid message type: ", header.MsgType)
-		panic("Invalid message type")
+	if len(data) <= MaxUnfragmentedSize {
+		err = write(data)
+		putSendBuffer(buf, encoded)
+		return err
 	}
+	// The fragmenter keeps the datagram to resend fragments, the
+	// buffer is not reused
+
+	if server_ctx.fragmenter == nil || len(data) > server_ctx.max_transfer_size {
+		return errTransferTooLarge
+	}
+	for _, frag := range server_ctx.fragmenter.Split(server_ctx.node_id, addr, data) {
+		frag_data, err := EncodeMessage(frag)
+		if err == nil {
+			err = write(frag_data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func SendPingRequest(conn net.Conn, server_ctx *ServerConfig) bool {
+func SendPingRequest(conn Transport, to net.Addr, server_ctx *ServerConfig) bool {
 	ping_req := NewPingRequest(server_ctx.node_id)
-	req_writer := bufio.NewWriter(conn)
+	server_ctx.advertiseVersions(ping_req.Header())
 
-	ret := ping_req.Serialize(req_writer)
+	ret := sendMessageTo(conn, to, ping_req, server_ctx)
 	if !ret {
 		fmt.Println("ERROR: Failed to send ping request")
-		return false
 	}
-
-	req_writer.Flush()
-	return true
+	return ret
 }
 
-func SendPingResponse(conn net.Conn, ping_req *PingRequest, server_ctx *ServerConfig) bool {
+func SendPingResponse(conn Transport, to net.Addr, ping_req *PingRequest, server_ctx *ServerConfig) bool {
 	ping_resp := NewPingReply(server_ctx.node_id, ping_req)
-	resp_writer := bufio.NewWriter(conn)
+	server_ctx.advertiseVersions(ping_resp.Header())
 
-	ret := ping_resp.Serialize(resp_writer)
+	ret := sendMessageTo(conn, to, ping_resp, server_ctx)
 	if !ret {
 		fmt.Println("ERROR: Failed to send ping response")
-		return false
 	}
-
-	resp_writer.Flush()
-	return true
+	return ret
 }
 
-func SendFindNodeRequest(conn net.Conn, lookup_id NodeId, server_ctx *ServerConfig) bool {
+func SendFindNodeRequest(conn Transport, to net.Addr, lookup_id NodeId, server_ctx *ServerConfig) bool {
 	find_node_req := NewFindNodeRequest(server_ctx.node_id, lookup_id)
-	req_writer := bufio.NewWriter(conn)
 
-	ret := find_node_req.Serialize(req_writer)
+	ret := sendMessageTo(conn, to, find_node_req, server_ctx)
 	if !ret {
 		fmt.Println("ERROR: Failed to send find node request")
-		return false
 	}
-
-	req_writer.Flush()
-	return true
+	return ret
 }
 
-func SendFindNodeResponse(conn net.Conn, find_node_req *FindNodeRequest,
+func SendFindNodeResponse(conn Transport, to net.Addr, find_node_req *FindNodeRequest,
 	nodes []RemoteNode, server_ctx *ServerConfig) bool {
 
 	find_node_resp := NewFindNodeReply(server_ctx.node_id, nodes, find_node_req)
@@ -138,14 +636,128 @@ func SendFindNodeResponse(conn net.Conn, find_node_req *FindNodeRequest,
 		fmt.Println("ERROR: Failed to create find node reply")
 		return false
 	}
-	resp_writer := bufio.NewWriter(conn)
 
-	ret := find_node_resp.Serialize(resp_writer)
+	ret := sendMessageTo(conn, to, find_node_resp, server_ctx)
 	if !ret {
 		fmt.Println("ERROR: Failed to serialize find node response")
+	}
+	return ret
+}
+
+func SendFindValueRequest(conn Transport, to net.Addr, key NodeId, server_ctx *ServerConfig) bool {
+	find_value_req := NewFindValueRequest(server_ctx.node_id, key)
+
+	ret := sendMessageTo(conn, to, find_value_req, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send find value request")
+	}
+	return ret
+}
+
+/*
+ * SendFindValueResponse : Replies with the value if it was found,
+ * with the closest nodes known otherwise.
+ */
+func SendFindValueResponse(conn Transport, to net.Addr, find_value_req *FindValueRequest,
+	value []byte, nodes []RemoteNode, server_ctx *ServerConfig) bool {
+
+	find_value_resp := NewFindValueReply(server_ctx.node_id, find_value_req, value, nodes)
+	if find_value_resp == nil {
+		fmt.Println("ERROR: Failed to create find value reply")
 		return false
 	}
 
-	resp_writer.Flush()
-	return true
+	ret := sendMessageTo(conn, to, find_value_resp, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send find value response")
+	}
+	return ret
+}
+
+func SendStoreRequest(conn Transport, to net.Addr, key NodeId, value []byte, ttl uint32, server_ctx *ServerConfig) bool {
+	store_req := NewStoreRequest(server_ctx.node_id, key, value, ttl)
+
+	ret := sendMessageTo(conn, to, store_req, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send store request")
+	}
+	return ret
+}
+
+func SendStoreResponse(conn Transport, to net.Addr, store_req *StoreRequest, stored bool, server_ctx *ServerConfig) bool {
+	store_resp := NewStoreReply(server_ctx.node_id, store_req, stored)
+
+	ret := sendMessageTo(conn, to, store_resp, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send store response")
+	}
+	return ret
+}
+
+/*
+ * SendErrorResponse : Tells the sender of a request why it is rejected.
+ * Parameters:
+ * [in] conn : Transport of the local node
+ * [in] to : Address of the requester
+ * [in] req : The rejected request
+ * [in] code : One of the ERR_CODE_* values
+ * [in] reason : Short explanation
+ * [in] server_ctx : Context of the local node
+ */
+func SendErrorResponse(conn Transport, to net.Addr, req IMessage, code uint16, reason string,
+	server_ctx *ServerConfig) bool {
+
+	error_resp := NewErrorReply(server_ctx.node_id, req.Header(), code, reason)
+
+	ret := sendMessageTo(conn, to, error_resp, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send error response")
+	}
+	return ret
+}
+
+/*
+ * SendSessionInitRequest : Starts a session with a node. Only its reply
+ * signed with the key of 'peer_id' establishes the session.
+ * Parameters:
+ * [in] conn : Transport of the local node
+ * [in] to : Address of the node
+ * [in] peer_id : Node Id of the node
+ * [in] server_ctx : Context of the local node
+ */
+func SendSessionInitRequest(conn Transport, to net.Addr, peer_id NodeId, server_ctx *ServerConfig) bool {
+	if server_ctx.sessions == nil {
+		fmt.Println("ERROR: Encryption is not enabled")
+		return false
+	}
+	init_req, err := server_ctx.sessions.createInitRequest(server_ctx.node_id, peer_id, to.String())
+	if err != nil {
+		fmt.Println("ERROR: Failed to create session init request: ", err)
+		return false
+	}
+
+	ret := sendMessageTo(conn, to, init_req, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send session init request")
+	}
+	return ret
+}
+
+func SendSessionInitResponse(conn Transport, to net.Addr, init_req *SessionInitRequest, server_ctx *ServerConfig) bool {
+	if server_ctx.sessions == nil {
+		fmt.Println("ERROR: Encryption is not enabled")
+		return false
+	}
+	init_resp, err := server_ctx.sessions.acceptInitRequest(server_ctx.node_id, init_req,
+		to.String())
+	if err != nil {
+		fmt.Println("ERROR: Failed to accept session: ", err)
+		return false
+	}
+
+	ret := sendMessageTo(conn, to, init_resp, server_ctx)
+	if !ret {
+		fmt.Println("ERROR: Failed to send session init response")
+	}
+	return ret
 }
@@ -18,28 +18,34 @@ const (
 	FIND_NODE_RESP
 	FIND_VALUE_REQ
 	FIND_VALUE_RESP
+	STORE_REQ
+	STORE_RESP
+	SESSION_INIT_REQ
+	SESSION_INIT_RESP
+	SESSION_DATA
+	FRAGMENT_DATA
+	FRAGMENT_NACK
+	ERROR_RESP
 	// End of all message types, nothing should go beyond this
 	// Mark my words
 	MSG_END
 )
 
+const (
+	// Upper bound on the entries of any list carried in a message
+	maxListEntries = 1024
+	// Upper bound on any variable length byte field of a message
+	maxBytesFieldLen = 0xffff
+	// Upper bound on a value carried in a message
+	maxValueFieldLen = 16 << 20
+)
+
 func MsgType2Str(mtype uint32) string {
-	switch mtype {
-	case PING_REQ:
-		return "PING_REQ"
-	case PING_RESP:
-		return "PING_RESP"
-	case FIND_NODE_REQ:
-		return "FIND_NODE_REQ"
-	case FIND_VALUE_REQ:
-		return "FIND_VALUE_REQ"
-	case FIND_VALUE_RESP:
-		return "FIND_VALUE_RESP"
-	case FIND_NODE_RESP:
-		return "FIND_NODE_RESP"
-	default:
-		panic("Message Type not correct")
+	info, found := lookupMessageType(mtype)
+	if !found {
+		return fmt.Sprintf("UNKNOWN(%d)", mtype)
 	}
+	return info.name
 }
 
 type Ipv4Addr struct {
@@ -62,11 +68,21 @@ func NewIpv4Addr(addr *net.UDPAddr) Ipv4Addr {
 	var raddr Ipv4Addr
 	// TODO: Assume IPv4 address. Would not work
 	// properly with IPv6
-	copy(raddr.IP[:], addr.IP[0:4])
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		copy(raddr.IP[:], ip4)
+	}
 	raddr.Port = uint16(addr.Port)
 	return raddr
 }
 
+// UDPAddr: Converts back to a net address
+func (this Ipv4Addr) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IPv4(this.IP[0], this.IP[1], this.IP[2], this.IP[3]),
+		Port: int(this.Port),
+	}
+}
+
 /*
  * Message interface that every struct implementing a
  * message type must satisfy.
@@ -76,21 +92,40 @@ func NewIpv4Addr(addr *net.UDPAddr) Ipv4Addr {
  *    in binary format.
  *    Returns 'true' if serialization is done successfully
  *    otherwise returns 'false'
+ * 2. Deserialize :
+ *    Reads the message body (everything after the header)
+ *    from the io.Reader.
+ * 3. Header :
+ *    Returns the basic message header of the message.
  */
 type IMessage interface {
 	Serialize(io.Writer) bool
 	Deserialize(io.Reader) bool
+	Header() *BasicMsgHeader
 }
 
 /*
  * Structure of a Basic Message
  */
 type BasicMsgHeader struct {
-	Version   uint32 // The message version. Hard coded to 1
+	Version   uint32 // The message version. Selects the codec (WIRE_VERSION_*)
 	MsgType   uint32 // Type of the request or response message
 	EpochTime int64  // Time at which message was created
 	SenderId  NodeId // Node ID of the sender node
 	RandomId  NodeId // Random ID for matching response with request context
+	// Optional fields written after the message body, see extensions.go
+	Extensions []Extension `json:",omitempty"`
+}
+
+/*
+ * Fixed layout of the header on the wire
+ */
+type basicMsgHeaderWire struct {
+	Version   uint32
+	MsgType   uint32
+	EpochTime int64
+	SenderId  NodeId
+	RandomId  NodeId
 }
 
 /*
@@ -132,6 +167,35 @@ type FindNodeReply struct {
 	Nodes      []RemoteNode // List of nodes
 }
 
+/*
+ * FindValueReply
+ */
+type FindValueReply struct {
+	base_msg   BasicMsgHeader
+	Found      bool         // 'true' if the sender holds the value
+	Value      []byte       // The value, if found
+	TotalNodes int32        // Total number of nodes in the message
+	Nodes      []RemoteNode // Closest nodes to the key, if not found
+}
+
+/*
+ * StoreRequest
+ */
+type StoreRequest struct {
+	base_msg BasicMsgHeader
+	Key      NodeId // The ID of the value
+	Ttl      uint32 // Seconds the value must be kept, 0 for the node default
+	Value    []byte // The value to store
+}
+
+/*
+ * StoreReply
+ */
+type StoreReply struct {
+	base_msg BasicMsgHeader
+	Stored   bool // 'true' if the value was stored
+}
+
 /*
  * NewBasicMsgHeader: Creates the basic message header.
  * Parameters:
@@ -141,13 +205,13 @@ type FindNodeReply struct {
  * [out] *BasicMsgHeader : Pointer to the newly created BasicMsgHeader
  */
 func NewBasicMsgHeader(msg_type uint32, sender_id, random_id NodeId) *BasicMsgHeader {
-	if msg_type <= MSG_START && msg_type >= MSG_END {
-		panic("Received incorrect message type: ")
+	if _, found := lookupMessageType(msg_type); !found {
+		panic("Received incorrect message type: " + MsgType2Str(msg_type))
 	}
 	now := time.Now()
 
 	return &BasicMsgHeader{
-		Version:   1,
+		Version:   WIRE_VERSION_BINARY,
 		MsgType:   msg_type,
 		EpochTime: now.Unix(),
 		SenderId:  sender_id,
@@ -239,8 +303,83 @@ func NewFindNodeReply(sender_id NodeId, nodes []RemoteNode,
 	return find_node_reply
 }
 
+/*
+ * NewFindValueReply : Create a new Find value reply message.
+ * Parameters:
+ * [in] sender_id : Node Id of the sending node.
+ * [in] find_value_req : The corresponding FindValueRequest
+ * [in] value : The value, nil if the sender does not hold it
+ * [in] nodes : The closest nodes to the key, sent if the value is not found
+ * [out] *FindValueReply : Pointer to the newly created FindValueReply
+ */
+func NewFindValueReply(sender_id NodeId, find_value_req *FindValueRequest,
+	value []byte, nodes []RemoteNode) *FindValueReply {
+	if len(nodes) > alphaNodes {
+		fmt.Println("ERROR: More than allowed nodes present: ", len(nodes))
+		return nil
+	}
+	find_value_reply := &FindValueReply{
+		base_msg: *NewBasicMsgHeader(FIND_VALUE_RESP, sender_id, find_value_req.base_msg.RandomId),
+	}
+	if value != nil {
+		find_value_reply.Found = true
+		find_value_reply.Value = value
+		find_value_reply.Nodes = make([]RemoteNode, 0)
+		return find_value_reply
+	}
+	find_value_reply.TotalNodes = int32(len(nodes))
+	find_value_reply.Nodes = make([]RemoteNode, len(nodes))
+	copy(find_value_reply.Nodes, nodes)
+	return find_value_reply
+}
+
+/*
+ * NewStoreRequest : Create a new Store request.
+ * Parameters:
+ * [in] sender_id : Node Id of the sending node.
+ * [in] key : Id of the value.
+ * [in] value : The value to store.
+ * [in] ttl : Seconds the value must be kept, 0 for the default of the node.
+ * [out] *StoreRequest : Pointer to the newly created StoreRequest
+ */
+func NewStoreRequest(sender_id, key NodeId, value []byte, ttl uint32) *StoreRequest {
+	return &StoreRequest{
+		base_msg: *NewBasicMsgHeader(STORE_REQ, sender_id, generateRandomNodeId()),
+		Key:      key,
+		Ttl:      ttl,
+		Value:    value,
+	}
+}
+
+/*
+ * NewStoreReply : Create a new Store reply.
+ * Parameters:
+ * [in] sender_id : Node Id of the sending node.
+ * [in] store_req : The corresponding StoreRequest
+ * [in] stored : 'true' if the value was stored
+ * [out] *StoreReply : Pointer to the newly created StoreReply
+ */
+func NewStoreReply(sender_id NodeId, store_req *StoreRequest, stored bool) *StoreReply {
+	return &StoreReply{
+		base_msg: *NewBasicMsgHeader(STORE_RESP, sender_id, store_req.base_msg.RandomId),
+		Stored:   stored,
+	}
+}
+
 //************** MESSAGE SERIALIZATION-DESERIALIZATION FUNCTIONS ***************//
 
+/*
+ * Implementation of Header interface API for all the message type classes
+ */
+func (this *PingRequest) Header() *BasicMsgHeader      { return &this.base_msg }
+func (this *PingReply) Header() *BasicMsgHeader        { return &this.base_msg }
+func (this *FindNodeRequest) Header() *BasicMsgHeader  { return &this.base_msg }
+func (this *FindValueRequest) Header() *BasicMsgHeader { return &this.base_msg }
+func (this *FindNodeReply) Header() *BasicMsgHeader    { return &this.base_msg }
+func (this *FindValueReply) Header() *BasicMsgHeader   { return &this.base_msg }
+func (this *StoreRequest) Header() *BasicMsgHeader     { return &this.base_msg }
+func (this *StoreReply) Header() *BasicMsgHeader       { return &this.base_msg }
+
 /*
  * Serialize : Implementation of Serialize interface API for Basic message
  * type class
@@ -249,8 +388,15 @@ func NewFindNodeReply(sender_id NodeId, nodes []RemoteNode,
  * [out] bool : Returns 'true' if serialization was successfull otherwise 'false'
  */
 func (this *BasicMsgHeader) Serialize(writer io.Writer) bool {
+	wire := basicMsgHeaderWire{
+		Version:   this.Version,
+		MsgType:   this.MsgType,
+		EpochTime: this.EpochTime,
+		SenderId:  this.SenderId,
+		RandomId:  this.RandomId,
+	}
 	//TODO: determine endian-ness in platform independent way.
-	err := binary.Write(writer, binary.BigEndian, this)
+	err := binary.Write(writer, binary.BigEndian, &wire)
 	if err != nil {
 		fmt.Println("ERROR: ", err)
 		return false
@@ -266,12 +412,19 @@ func (this *BasicMsgHeader) Serialize(writer io.Writer) bool {
  * [out] bool : Returns 'true' if de-serialization was successfull otherwise 'false'
  */
 func (this *BasicMsgHeader) Deserialize(reader io.Reader) bool {
+	var wire basicMsgHeaderWire
 	//TODO: determine endian-ness in a platform independent way.
-	err := binary.Read(reader, binary.BigEndian, this)
+	err := binary.Read(reader, binary.BigEndian, &wire)
 	if err != nil {
 		fmt.Println("ERROR: ", err)
 		return false
 	}
+	this.Version = wire.Version
+	this.MsgType = wire.MsgType
+	this.EpochTime = wire.EpochTime
+	this.SenderId = wire.SenderId
+	this.RandomId = wire.RandomId
+	this.Extensions = nil
 	return true
 }
 
@@ -416,7 +569,7 @@ func (this *FindNodeReply) Deserialize(reader io.Reader) bool {
 	// Header should have already been deserialized
 	// Read total nodes
 	err := binary.Read(reader, binary.BigEndian, &this.TotalNodes)
-	if err != nil {
+	if err != nil || this.TotalNodes < 0 || this.TotalNodes > maxListEntries {
 		fmt.Println("ERROR: Failed to deserialize FindNodeReply total nodes")
 		return false
 	}
@@ -431,3 +584,188 @@ func (this *FindNodeReply) Deserialize(reader io.Reader) bool {
 	}
 	return true
 }
+
+func (this *FindValueReply) Serialize(writer io.Writer) bool {
+	// First write the header by forwarding the call to basic message
+	ret := this.base_msg.Serialize(writer)
+	if !ret {
+		fmt.Println("ERROR: Failed to serialize FindValueReply header")
+		return false
+	}
+	found := boolToUint8(this.Found)
+	err := binary.Write(writer, binary.BigEndian, &found)
+	if err != nil || !writeValueField(writer, this.Value) {
+		fmt.Println("ERROR: Failed to serialize FindValueReply value")
+		return false
+	}
+	err = binary.Write(writer, binary.BigEndian, &this.TotalNodes)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, this.Nodes)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to serialize FindValueReply nodes: ", err)
+		return false
+	}
+	return true
+}
+
+func (this *FindValueReply) Deserialize(reader io.Reader) bool {
+	// Header should have already been deserialized
+	var found uint8
+	err := binary.Read(reader, binary.BigEndian, &found)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize FindValueReply found flag")
+		return false
+	}
+	this.Found = found != 0
+
+	var ok bool
+	this.Value, ok = readValueField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize FindValueReply value")
+		return false
+	}
+	if !this.Found {
+		this.Value = nil
+	}
+	err = binary.Read(reader, binary.BigEndian, &this.TotalNodes)
+	if err != nil || this.TotalNodes < 0 || this.TotalNodes > maxListEntries {
+		fmt.Println("ERROR: Failed to deserialize FindValueReply total nodes")
+		return false
+	}
+	this.Nodes = make([]RemoteNode, this.TotalNodes)
+	err = binary.Read(reader, binary.BigEndian, this.Nodes)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize FindValueReply nodes")
+		return false
+	}
+	return true
+}
+
+func (this *StoreRequest) Serialize(writer io.Writer) bool {
+	// First write the header by forwarding the call to basic message
+	ret := this.base_msg.Serialize(writer)
+	if !ret {
+		fmt.Println("ERROR: Failed to serialize StoreRequest header")
+		return false
+	}
+	err := binary.Write(writer, binary.BigEndian, &this.Key)
+	if err == nil {
+		err = binary.Write(writer, binary.BigEndian, &this.Ttl)
+	}
+	if err != nil || !writeValueField(writer, this.Value) {
+		fmt.Println("ERROR: Failed to serialize StoreRequest")
+		return false
+	}
+	return true
+}
+
+func (this *StoreRequest) Deserialize(reader io.Reader) bool {
+	// Header should have already been deserialized
+	err := binary.Read(reader, binary.BigEndian, &this.Key)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &this.Ttl)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize StoreRequest key")
+		return false
+	}
+	var ok bool
+	this.Value, ok = readValueField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize StoreRequest value")
+	}
+	return ok
+}
+
+func (this *StoreReply) Serialize(writer io.Writer) bool {
+	// First write the header by forwarding the call to basic message
+	ret := this.base_msg.Serialize(writer)
+	if !ret {
+		fmt.Println("ERROR: Failed to serialize StoreReply header")
+		return false
+	}
+	stored := boolToUint8(this.Stored)
+	err := binary.Write(writer, binary.BigEndian, &stored)
+	if err != nil {
+		fmt.Println("ERROR: Failed to serialize StoreReply")
+		return false
+	}
+	return true
+}
+
+func (this *StoreReply) Deserialize(reader io.Reader) bool {
+	// Header should have already been deserialized
+	var stored uint8
+	err := binary.Read(reader, binary.BigEndian, &stored)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize StoreReply")
+		return false
+	}
+	this.Stored = stored != 0
+	return true
+}
+
+func boolToUint8(value bool) uint8 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * writeBytesField : Writes a variable length byte field, prefixed
+ * by its length as uint16.
+ */
+func writeBytesField(writer io.Writer, data []byte) bool {
+	if len(data) > maxBytesFieldLen {
+		return false
+	}
+	length := uint16(len(data))
+	if binary.Write(writer, binary.BigEndian, &length) != nil {
+		return false
+	}
+	_, err := writer.Write(data)
+	return err == nil
+}
+
+/*
+ * readBytesField : Reads a byte field written by writeBytesField.
+ */
+func readBytesField(reader io.Reader) ([]byte, bool) {
+	var length uint16
+	if binary.Read(reader, binary.BigEndian, &length) != nil {
+		return nil, false
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err == nil
+}
+
+/*
+ * writeValueField : Writes a value, prefixed by its length as uint32.
+ */
+func writeValueField(writer io.Writer, data []byte) bool {
+	if len(data) > maxValueFieldLen {
+		return false
+	}
+	length := uint32(len(data))
+	if binary.Write(writer, binary.BigEndian, &length) != nil {
+		return false
+	}
+	_, err := writer.Write(data)
+	return err == nil
+}
+
+/*
+ * readValueField : Reads a value written by writeValueField.
+ */
+func readValueField(reader io.Reader) ([]byte, bool) {
+	var length uint32
+	if binary.Read(reader, binary.BigEndian, &length) != nil || length > maxValueFieldLen {
+		return nil, false
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err == nil
+}
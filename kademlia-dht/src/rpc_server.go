@@ -0,0 +1,433 @@
+package kadht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * RPC server.
+ *
+ * The server owns the transport of the local node. It reads datagrams
+ * in a loop, answers the PING, FIND_NODE, FIND_VALUE and STORE requests
+ * from the routing table and the value store, and hands the replies to
+ * the PendingTracker, where the callers of Request wait for them.
+ * Requests and replies are sent from the same transport, so peers
+ * always see the local node at one address.
+ * Requests are rate limited and replies to unverified sources are
+ * size limited, see ratelimit.go. The error replies and fragments
+ * ReceiveMessage sends on its own are rate limited too. Applications
+ * can wrap the handling and sending of all messages in interceptors,
+ * see interceptor.go.
+ */
+
+const (
+	// Values stored without TTL are kept this long
+	DefaultValueTtl = 24 * time.Hour
+)
+
+/*
+ * RequestHandler : Answers an application defined request.
+ * Parameters:
+ * [in] server : The server the request was received by
+ * [in] req : The request
+ * [in] from : Address of the requester
+ * [out] IMessage : The reply, nil to send none
+ */
+type RequestHandler func(server *RpcServer, req IMessage, from net.Addr) IMessage
+
+/*
+ * RpcServer : Serves the requests of other nodes
+ */
+type RpcServer struct {
+	server_ctx    *ServerConfig
+	routing_table *RoutingTable
+	tracker       *PendingTracker
+	outbound      *OutboundLimiter
+	transport     Transport
+
+	lock     sync.RWMutex
+	handlers map[uint32]RequestHandler
+	store    Storage
+	evicting map[NodeId]bool // Entries being checked, see checkContact
+
+	inbound_interceptors  []InboundInterceptor
+	outbound_interceptors []OutboundInterceptor
+	inbound_chain         InboundHandler // handle, wrapped in the interceptors
+	outbound_chain        OutboundSender // transmit, wrapped in the interceptors
+
+	source_limiter *RateLimiter // Requests by source IP
+	sender_limiter *RateLimiter // Requests by SenderId
+	error_limiter  *RateLimiter // Error replies to rate limited requests
+	verified       *verifiedSources
+
+	done chan struct{} // Closed when the serve loop exits
+}
+
+/*
+ * NewRpcServer : Creates a new RPC server.
+ * Parameters:
+ * [in] server_ctx : Context of the local node
+ * [in] routing_table : Routing table of the local node
+ * [out] *RpcServer : Pointer to the newly created RpcServer
+ */
+func NewRpcServer(server_ctx *ServerConfig, routing_table *RoutingTable) *RpcServer {
+	server_ctx.SetRoutingTable(routing_table)
+	server := &RpcServer{
+		server_ctx:    server_ctx,
+		routing_table: routing_table,
+		tracker:       NewPendingTracker(DefaultRequestTimeout, DefaultRequestRetries),
+		outbound:      NewOutboundLimiter(DefaultMaxInFlight, DefaultMaxInFlightPerPeer),
+		handlers:      make(map[uint32]RequestHandler),
+		store:         NewMemoryStore(),
+		evicting:      make(map[NodeId]bool),
+
+		source_limiter: NewRateLimiter(DefaultSourceRateLimit),
+		sender_limiter: NewRateLimiter(DefaultSenderRateLimit),
+		error_limiter:  NewRateLimiter(defaultErrorRateLimit),
+		verified:       newVerifiedSources(),
+	}
+	server.inbound_chain = server.handle
+	server.outbound_chain = server.transmit
+	return server
+}
+
+/*
+ * SetRateLimits : Sets the limits of the requests accepted from one
+ * IP address and from one node. Must be set before the server is
+ * started. A zero Rate disables the limit.
+ */
+func (this *RpcServer) SetRateLimits(per_source, per_sender RateLimit) {
+	this.source_limiter = NewRateLimiter(per_source)
+	this.sender_limiter = NewRateLimiter(per_sender)
+}
+
+/*
+ * SetValueStore : Makes the server store values in 'store'. Must be
+ * set before the server is started.
+ */
+func (this *RpcServer) SetValueStore(store Storage) {
+	this.store = store
+}
+
+/*
+ * SetRequestPolicy : Sets the time to wait for the reply to the first
+ * attempt of a request to an unknown peer, and the number of retries.
+ * Must be set before the server is started.
+ */
+func (this *RpcServer) SetRequestPolicy(timeout time.Duration, retries int) {
+	this.tracker = NewPendingTracker(timeout, retries)
+}
+
+/*
+ * SetOutboundLimits : Sets the max number of requests in flight from
+ * the client calls, for the whole node and to one peer. Must be set
+ * before the server is started.
+ */
+func (this *RpcServer) SetOutboundLimits(max_in_flight, max_per_peer int) {
+	this.outbound = NewOutboundLimiter(max_in_flight, max_per_peer)
+}
+
+/*
+ * Listen : Opens the UDP socket of the server.
+ * Parameters:
+ * [in] addr : Local address, "host:port"
+ * [out] error : If the socket could not be opened
+ */
+func (this *RpcServer) Listen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port_num, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	transport, err := NewUdpTransport(host, port_num)
+	if err != nil {
+		return err
+	}
+	this.transport = transport
+	return nil
+}
+
+/*
+ * SetTransport : Makes the server use an already open transport,
+ * instead of opening a UDP socket with Listen.
+ */
+func (this *RpcServer) SetTransport(transport Transport) {
+	this.transport = transport
+}
+
+// LocalAddr: Address the server listens on
+func (this *RpcServer) LocalAddr() net.Addr {
+	return this.transport.LocalAddr()
+}
+
+// Start: Runs the serve loop in its own goroutine
+func (this *RpcServer) Start() error {
+	if this.transport == nil {
+		return errors.New("Server is not listening")
+	}
+	this.done = make(chan struct{})
+	go this.Serve()
+	return nil
+}
+
+/*
+ * Serve : Reads and dispatches datagrams until the server is closed.
+ */
+func (this *RpcServer) Serve() {
+	defer close(this.done)
+	for {
+		msg, from, err := receiveMessage(this.transport, this.server_ctx, this)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("ERROR: ", err)
+			continue
+		}
+		this.dispatch(msg, from)
+	}
+}
+
+// Close: Closes the transport and waits for the serve loop to exit
+func (this *RpcServer) Close() error {
+	err := this.transport.Close()
+	if this.done != nil {
+		<-this.done
+	}
+	return err
+}
+
+/*
+ * HandleFunc : Registers the handler of an application defined
+ * request type. Requests of a type without handler are answered
+ * with an ERR_CODE_UNKNOWN_TYPE error.
+ */
+func (this *RpcServer) HandleFunc(mtype uint32, handler RequestHandler) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.handlers[mtype] = handler
+}
+
+/*
+ * InterceptInbound : Adds an interceptor to the handling of the
+ * received messages, after the ones already added.
+ */
+func (this *RpcServer) InterceptInbound(interceptor InboundInterceptor) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.inbound_interceptors = append(this.inbound_interceptors, interceptor)
+	this.inbound_chain = chainInbound(this.inbound_interceptors, this.handle)
+}
+
+/*
+ * InterceptOutbound : Adds an interceptor to the sending of messages,
+ * after the ones already added.
+ */
+func (this *RpcServer) InterceptOutbound(interceptor OutboundInterceptor) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.outbound_interceptors = append(this.outbound_interceptors, interceptor)
+	this.outbound_chain = chainOutbound(this.outbound_interceptors, this.transmit)
+}
+
+/*
+ * Request : Sends a request and tracks it until its reply is received.
+ * The request is sent at once, without taking an outbound slot.
+ * Parameters:
+ * [in] to : Address of the peer
+ * [in] req : The request
+ * [out] *PendingRequest : The tracked request, to wait for the reply on
+ * [out] error : If the request could not be sent
+ */
+func (this *RpcServer) Request(to net.Addr, req IMessage) (*PendingRequest, error) {
+	if req.Header().MsgType == PING_REQ {
+		this.server_ctx.advertiseVersions(req.Header())
+	}
+	return this.tracker.Start(req, to.String(), func(msg IMessage) error {
+		return this.send(msg, to)
+	})
+}
+
+/*
+ * RoundTripTime : Smoothed round trip time of the requests to a peer.
+ * Parameters:
+ * [in] addr : Address of the peer
+ * [out] time.Duration : The estimate
+ * [out] bool : 'false' if the peer never answered
+ */
+func (this *RpcServer) RoundTripTime(addr net.Addr) (time.Duration, bool) {
+	srtt, _, found := this.tracker.Estimator().Estimate(addr.String())
+	return srtt, found
+}
+
+// send: Sends a message through the outbound interceptors
+func (this *RpcServer) send(msg IMessage, to net.Addr) error {
+	this.lock.RLock()
+	outbound := this.outbound_chain
+	this.lock.RUnlock()
+	return outbound(msg, to)
+}
+
+// transmit: Sends a message on the transport, end of the outbound chain
+func (this *RpcServer) transmit(msg IMessage, to net.Addr) error {
+	if !sendMessageTo(this.transport, to, msg, this.server_ctx) {
+		return errors.New("Failed to send " + MsgType2Str(msg.Header().MsgType))
+	}
+	return nil
+}
+
+// reply: Sends the reply to a request
+func (this *RpcServer) reply(to net.Addr, msg IMessage) {
+	this.send(msg, to)
+}
+
+// dispatch: Hands a message to the inbound interceptors, and sends the
+// reply they return
+func (this *RpcServer) dispatch(msg IMessage, from net.Addr) {
+	this.lock.RLock()
+	inbound := this.inbound_chain
+	this.lock.RUnlock()
+	if reply := inbound(msg, from); reply != nil {
+		this.reply(from, reply)
+	}
+}
+
+// handle: Answers a request, or delivers a reply. End of the inbound chain.
+func (this *RpcServer) handle(msg IMessage, from net.Addr) IMessage {
+	header := msg.Header()
+	if isReplyType(header.MsgType) {
+		if this.tracker.Deliver(msg, from.String()) {
+			// It received our request, the address is not spoofed
+			this.verified.add(from)
+			this.learnContact(header.SenderId, from)
+			this.server_ctx.learnPeerVersion(msg)
+		}
+		return nil
+	}
+
+	local_id := this.server_ctx.node_id
+	if !this.source_limiter.Allow(sourceIp(from)) || !this.sender_limiter.Allow(string(header.SenderId[:])) {
+		if this.error_limiter.Allow("") {
+			return NewErrorReply(local_id, header, ERR_CODE_RATE_LIMITED, "Too many requests")
+		}
+		return nil
+	}
+	// The version is recorded in the entry of the contact
+	this.learnContact(header.SenderId, from)
+	this.server_ctx.learnPeerVersion(msg)
+
+	reply := this.answer(msg, from)
+	if reply == nil {
+		return nil
+	}
+	if !this.verified.contains(from) {
+		reply = limitReply(msg, reply, from, this.server_ctx)
+		if header.MsgType == PING_REQ {
+			this.verify(from)
+		}
+	}
+	return reply
+}
+
+// verify: Pings a source, verified once it answers. The ping is sent
+// once, a spoofed source gets no more than the reply to its request.
+func (this *RpcServer) verify(to net.Addr) {
+	ping_req := NewPingRequest(this.server_ctx.node_id)
+	this.server_ctx.advertiseVersions(ping_req.Header())
+	this.tracker.StartWithRetries(ping_req, to.String(), 0, func(msg IMessage) error {
+		return this.send(msg, to)
+	})
+}
+
+// allowReply: Rate limits the replies ReceiveMessage sends on its own
+// like the replies to requests, so that spoofed datagrams cannot make
+// the node flood their source
+func (this *RpcServer) allowReply(to net.Addr, error_reply bool) bool {
+	if !this.source_limiter.Allow(sourceIp(to)) {
+		return false
+	}
+	return !error_reply || this.error_limiter.Allow("")
+}
+
+// sendControl: Sends a message ReceiveMessage answers with, through
+// the outbound interceptors
+func (this *RpcServer) sendControl(msg IMessage, to net.Addr) error {
+	return this.send(msg, to)
+}
+
+// answer: Builds the reply to a request, nil to send none
+func (this *RpcServer) answer(msg IMessage, from net.Addr) IMessage {
+	local_id := this.server_ctx.node_id
+	switch req := msg.(type) {
+	case *PingRequest:
+		ping_resp := NewPingReply(local_id, req)
+		this.server_ctx.advertiseVersions(ping_resp.Header())
+		return ping_resp
+
+	case *FindNodeRequest:
+		nodes := this.routing_table.LookupClosestContacts(req.LookupNodeId, alphaNodes)
+		return NewFindNodeReply(local_id, nodes, req)
+
+	case *FindValueRequest:
+		value, found := this.lookupValue(req.LookupValueId)
+		if found {
+			return NewFindValueReply(local_id, req, value, nil)
+		}
+		nodes := this.routing_table.LookupClosestContacts(req.LookupValueId, alphaNodes)
+		return NewFindValueReply(local_id, req, nil, nodes)
+
+	case *StoreRequest:
+		return NewStoreReply(local_id, req, this.storeValue(req))
+
+	case *SessionInitRequest:
+		if this.server_ctx.sessions == nil {
+			return nil
+		}
+		init_resp, err := this.server_ctx.sessions.acceptInitRequest(local_id, req, from.String())
+		if err != nil {
+			fmt.Println("ERROR: Failed to accept session: ", err)
+			return nil
+		}
+		return init_resp
+	}
+
+	header := msg.Header()
+	this.lock.RLock()
+	handler, found := this.handlers[header.MsgType]
+	this.lock.RUnlock()
+	if !found {
+		return NewErrorReply(local_id, header, ERR_CODE_UNKNOWN_TYPE,
+			"No handler for "+MsgType2Str(header.MsgType))
+	}
+	return handler(this, msg, from)
+}
+
+// lookupValue: Finds a value stored for other nodes
+func (this *RpcServer) lookupValue(key NodeId) ([]byte, bool) {
+	value, _, found := this.store.Get(key)
+	return value, found
+}
+
+// storeValue: Stores a value for another node. Returns 'false' if
+// there is no room left.
+func (this *RpcServer) storeValue(req *StoreRequest) bool {
+	ttl := DefaultValueTtl
+	if req.Ttl != 0 && time.Duration(req.Ttl)*time.Second < ttl {
+		ttl = time.Duration(req.Ttl) * time.Second
+	}
+	if err := this.store.Put(req.Key, req.Value, ttl); err != nil {
+		if err != errStorageFull {
+			fmt.Println("ERROR: Failed to store value: ", err)
+		}
+		return false
+	}
+	return true
+}
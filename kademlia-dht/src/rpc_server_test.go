@@ -0,0 +1,119 @@
+package kadht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *RpcServer {
+	ctx := NewServerConfig(generateRandomNodeId())
+	server := NewRpcServer(ctx, NewRoutingTable(ctx.node_id))
+	transport, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	server.SetTransport(transport)
+	if err := server.Start(); err != nil {
+		t.Fatal("Failed to start: ", err)
+	}
+	return server
+}
+
+func TestRpcServer(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	// b knows a few nodes
+	for i := 1; i <= 10; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 4000}
+		b.routing_table.AddEntryOnly(CreateNode(addr, generateRandomNodeId()))
+	}
+
+	pending, err := a.Request(b.LocalAddr(), NewPingRequest(a.server_ctx.node_id))
+	if err != nil {
+		t.Fatal("Failed to send ping: ", err)
+	}
+	if reply, err := pending.Wait(); err != nil || reply.Header().SenderId != b.server_ctx.node_id {
+		t.Fatal("Ping not answered: ", err)
+	}
+
+	lookup_id := generateRandomNodeId()
+	pending, _ = a.Request(b.LocalAddr(), NewFindNodeRequest(a.server_ctx.node_id, lookup_id))
+	reply, err := pending.Wait()
+	if err != nil {
+		t.Fatal("Find node not answered: ", err)
+	}
+	nodes := reply.(*FindNodeReply).Nodes
+	if len(nodes) != alphaNodes {
+		t.Fatal("Wrong number of nodes: ", len(nodes))
+	}
+	for idx := 1; idx < len(nodes); idx++ {
+		if compareDistance(lookup_id, nodes[idx-1].Id, nodes[idx].Id) > 0 {
+			t.Error("Nodes not sorted by distance")
+		}
+	}
+
+	// Value not stored yet, then stored
+	key := generateRandomNodeId()
+	pending, _ = a.Request(b.LocalAddr(), NewFindValueRequest(a.server_ctx.node_id, key))
+	reply, err = pending.Wait()
+	if err != nil || reply.(*FindValueReply).Found || len(reply.(*FindValueReply).Nodes) == 0 {
+		t.Fatal("Missing value not answered with nodes: ", err)
+	}
+	pending, _ = a.Request(b.LocalAddr(), NewStoreRequest(a.server_ctx.node_id, key, []byte("value"), 0))
+	if reply, err = pending.Wait(); err != nil || !reply.(*StoreReply).Stored {
+		t.Fatal("Value not stored: ", err)
+	}
+	pending, _ = a.Request(b.LocalAddr(), NewFindValueRequest(a.server_ctx.node_id, key))
+	reply, err = pending.Wait()
+	if err != nil || !bytes.Equal(reply.(*FindValueReply).Value, []byte("value")) {
+		t.Error("Stored value not found: ", err)
+	}
+}
+
+func TestRpcServerHandlers(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	echo := func() IMessage {
+		return &echoMessage{header: *NewBasicMsgHeader(testEchoMsgType, a.server_ctx.node_id, generateRandomNodeId())}
+	}
+	pending, _ := a.Request(b.LocalAddr(), echo())
+	if _, err := pending.Wait(); err == nil || err.(*ErrorReply).Code != ERR_CODE_UNKNOWN_TYPE {
+		t.Error("Request without handler not rejected: ", err)
+	}
+
+	b.HandleFunc(testEchoMsgType, func(server *RpcServer, req IMessage, from net.Addr) IMessage {
+		return NewErrorReply(server.server_ctx.node_id, req.Header(), ERR_CODE_RATE_LIMITED, "handled")
+	})
+	pending, _ = a.Request(b.LocalAddr(), echo())
+	if _, err := pending.Wait(); err == nil || err.(*ErrorReply).Reason != "handled" {
+		t.Error("Handler not called: ", err)
+	}
+}
+
+func TestRpcServerUdp(t *testing.T) {
+	var servers [2]*RpcServer
+	for idx := range servers {
+		ctx := NewServerConfig(generateRandomNodeId())
+		servers[idx] = NewRpcServer(ctx, NewRoutingTable(ctx.node_id))
+		if err := servers[idx].Listen("127.0.0.1:0"); err != nil {
+			t.Fatal("Failed to listen: ", err)
+		}
+		servers[idx].Start()
+		defer servers[idx].Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, _, err := servers[0].Ping(ctx, servers[1].LocalAddr()); err != nil {
+		t.Error("Ping over UDP failed: ", err)
+	}
+}
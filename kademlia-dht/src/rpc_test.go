@@ -1,223 +1,92 @@
 package kadht
 
 import (
-	"fmt"
 	"net"
-	"runtime"
 	"testing"
-	//"time"
 )
 
-type ServerConfig struct {
-	node_id [20]byte
-}
-
-type signal chan int
-
-const (
-	PING_REQ_SEND = iota
-	PING_REQ_RECV
-	PING_RESP_SEND
-	PING_RESP_RECV
-	FIND_NODE_REQ_SEND
-	FIND_NODE_REQ_RECV
-	FIND_NODE_RESP_SEND
-	FIND_NODE_RESP_RECV
-	SHUTDOWN
-)
-
-func start_node(event_chan signal,
-	master_chan signal,
-	lip, lport string,
-	rip, rport string,
-	node_name string) {
-
-	fmt.Println("Starting node...")
-	remote := rip + ":" + rport
-	local := lip + ":" + lport
-
-	serv_addr, err := net.ResolveUDPAddr("udp", local)
-	if err != nil {
-		fmt.Println("Error in resolve address ", local)
-		return
-	}
-	uconn, err := net.ListenUDP("udp", serv_addr)
+// Two nodes attached to the same in-memory network, so the
+// exchanges below run in order without binding any real port
+func newTestNodes(t *testing.T) (*testEndpoint, *testEndpoint) {
+	network := NewMemNetwork()
+	node_1, err := network.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6789})
 	if err != nil {
-		fmt.Println("Error in net.ListenUDP: ", err)
-		return
+		t.Fatal("Failed to listen: ", err)
 	}
-	defer uconn.Close()
-	var ctx ServerConfig
-	ctx.node_id = generateRandomNodeId()
-
-	// Connect with the other node
-	remote_addr, err := net.ResolveUDPAddr("udp", remote)
-	if err != nil {
-		fmt.Println("ERROR")
-		return
-	}
-	cconn, err := net.DialUDP("udp", nil, remote_addr)
+	node_2, err := network.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6790})
 	if err != nil {
-		fmt.Println("Could not dial remote ", err)
-	}
-	defer cconn.Close()
-
-	for {
-		fmt.Println("Waiting for event")
-		what := <-event_chan
-
-		switch what {
-		case PING_REQ_SEND:
-			fmt.Println("Sending ping request from ", node_name)
-			ret := SendPingRequest(cconn, &ctx)
-			if !ret {
-				fmt.Println("Failed to send ping request ", node_name)
-			}
-		case PING_REQ_RECV:
-			fmt.Println(node_name, " got ping request")
-
-			msg, _ := ConsumePacket(uconn)
-			if msg == nil {
-				fmt.Println("ERROR: Failed to read ping request ", node_name)
-			} else {
-				req, ok := msg.(*PingRequest)
-				if !ok {
-					fmt.Println("ERROR: failed to convert base message to ping reply ", node_name)
-					return
-				}
-				fmt.Println("Version: ", req.base_msg.Version)
-				fmt.Println("MsgType: ", MsgType2Str(req.base_msg.MsgType))
-				fmt.Println("EpochTime: ", req.base_msg.EpochTime)
-				fmt.Println("SenderId: ", req.base_msg.SenderId)
-				fmt.Println("RandomId: ", req.base_msg.RandomId)
-			}
-		case PING_RESP_SEND:
-			fmt.Println("Send ping response from ", node_name)
-			ping_req := NewPingRequest(ctx.node_id)
-			ret := SendPingResponse(cconn, ping_req, &ctx)
-			if !ret {
-				fmt.Println("ERROR: Failed to read ping response ", node_name)
-				fmt.Println("ERROR: failed to send ping response")
-			}
-		case PING_RESP_RECV:
-			fmt.Println("Got ping response ", node_name)
-			msg, _ := ConsumePacket(uconn)
-			if msg == nil {
-				fmt.Println("ERROR: Failed to read ping response ", node_name)
-			} else {
-				req, ok := msg.(*PingReply)
-				if !ok {
-					fmt.Println("ERROR: failed to convert ping response")
-					return
-				}
-				fmt.Println("Version: ", req.base_msg.Version)
-				fmt.Println("MsgType: ", MsgType2Str(req.base_msg.MsgType))
-				fmt.Println("EpochTime: ", req.base_msg.EpochTime)
-				fmt.Println("SenderId: ", req.base_msg.SenderId)
-				fmt.Println("RandomId: ", req.base_msg.RandomId)
-			}
-		case FIND_NODE_REQ_SEND:
-			fmt.Println("Sending find node request ", node_name)
-			ret := SendFindNodeRequest(cconn, generateRandomNodeId(), &ctx)
-			if !ret {
-				fmt.Println("ERROR: Failed to send find node request ", node_name)
-			}
-		case FIND_NODE_REQ_RECV:
-			fmt.Println("Got find node request ", node_name)
-			msg, _ := ConsumePacket(uconn)
-			if msg == nil {
-				fmt.Println("ERROR: Failed to read fin node request")
-			} else {
-				req, ok := msg.(*FindNodeRequest)
-				if !ok {
-					fmt.Println("ERROR: Failed to convert message to find node req")
-					return
-				}
-				fmt.Println("MsgType: ", MsgType2Str(req.base_msg.MsgType))
-				fmt.Println("LookupNodeId: ", req.LookupNodeId)
-
-				// Send Find node Response
-				fmt.Println("Send find node response ", node_name)
-				addr, _ := net.ResolveUDPAddr("udp", "10.0.3.2:8989")
-				node := RemoteNode{
-					Id:   generateRandomNodeId(),
-					Addr: NewIpv4Addr(addr),
-				}
-				nodes := make([]RemoteNode, 1)
-				nodes[0] = node
-				ret := SendFindNodeResponse(cconn, req, nodes, &ctx)
-				if !ret {
-					fmt.Println("ERROR: Failed to send find node response")
-				}
-			}
-		case FIND_NODE_RESP_RECV:
-			fmt.Println("Received find node response ", node_name)
-			msg, _ := ConsumePacket(uconn)
-			if msg == nil {
-				fmt.Println("ERROR: Failed to read find node response")
-			} else {
-				req, ok := msg.(*FindNodeReply)
-				if !ok {
-					fmt.Println("ERROR: failed to convert msg to find node reply")
-				}
-				fmt.Println("TotalNodes: ", req.TotalNodes)
-			}
-
-		default:
-			fmt.Println("Shutting down ", node_name)
-			master_chan <- SHUTDOWN
-			return
-		}
+		t.Fatal("Failed to listen: ", err)
 	}
+	var ctx_1, ctx_2 ServerConfig
+	ctx_1.node_id = generateRandomNodeId()
+	ctx_2.node_id = generateRandomNodeId()
+	return &testEndpoint{ctx: &ctx_1, transport: node_1, addr: node_1.LocalAddr()},
+		&testEndpoint{ctx: &ctx_2, transport: node_2, addr: node_2.LocalAddr()}
 }
 
 func TestPingPong(t *testing.T) {
-	runtime.GOMAXPROCS(5)
-	ch1 := make(chan int, 1)
-	ch2 := make(chan int, 1)
-	my_chan := make(chan int, 2)
-
-	// Start the two nodes
-	go start_node(ch2, my_chan, "127.0.0.1", "6790", "127.0.0.1", "6789", "node-2")
-	go start_node(ch1, my_chan, "127.0.0.1", "6789", "127.0.0.1", "6790", "node-1")
+	node_1, node_2 := newTestNodes(t)
+	defer node_1.close()
+	defer node_2.close()
 
 	// make node-1 send ping request
-	ch1 <- PING_REQ_SEND
-	// make node-2 read ping response
-	ch2 <- PING_REQ_RECV
-
-	ch2 <- PING_RESP_SEND
-	ch1 <- PING_RESP_RECV
-
-	//Shutdown both
-	ch1 <- SHUTDOWN
-	ch2 <- SHUTDOWN
+	if !SendPingRequest(node_1.transport, node_2.addr, node_1.ctx) {
+		t.Fatal("Failed to send ping request")
+	}
+	// make node-2 read it and answer
+	msg, mtype := ConsumePacket(node_2.transport, node_2.ctx)
+	if mtype != PING_REQ {
+		t.Fatal("Failed to read ping request")
+	}
+	req := msg.(*PingRequest)
+	if req.base_msg.SenderId != node_1.ctx.node_id {
+		t.Error("Wrong sender: ", req.base_msg.SenderId)
+	}
+	if !SendPingResponse(node_2.transport, node_1.addr, req, node_2.ctx) {
+		t.Fatal("Failed to send ping response")
+	}
 
-	_ = <-my_chan
-	_ = <-my_chan
+	msg, mtype = ConsumePacket(node_1.transport, node_1.ctx)
+	if mtype != PING_RESP {
+		t.Fatal("Failed to read ping response")
+	}
+	resp := msg.(*PingReply)
+	if resp.base_msg.RandomId != req.base_msg.RandomId || resp.base_msg.SenderId != node_2.ctx.node_id {
+		t.Error("Ping response does not match the request")
+	}
 }
 
 func TestFindNode(t *testing.T) {
-	runtime.GOMAXPROCS(5)
-	ch1 := make(chan int, 1)
-	ch2 := make(chan int, 1)
-	my_chan := make(chan int, 2)
-
-	// Start the two nodes
-	go start_node(ch2, my_chan, "127.0.0.1", "6790", "127.0.0.1", "6789", "node-2")
-	go start_node(ch1, my_chan, "127.0.0.1", "6789", "127.0.0.1", "6790", "node-1")
+	node_1, node_2 := newTestNodes(t)
+	defer node_1.close()
+	defer node_2.close()
 
 	// make node-1 send find node request
-	ch1 <- FIND_NODE_REQ_SEND
-	// make node-2 read the find node request and senf find node response
-	ch2 <- FIND_NODE_REQ_RECV
-
-	ch1 <- FIND_NODE_RESP_RECV
-
-	//Shutdown both
-	ch1 <- SHUTDOWN
-	ch2 <- SHUTDOWN
+	lookup_id := generateRandomNodeId()
+	if !SendFindNodeRequest(node_1.transport, node_2.addr, lookup_id, node_1.ctx) {
+		t.Fatal("Failed to send find node request")
+	}
+	// make node-2 read the find node request and send find node response
+	msg, mtype := ConsumePacket(node_2.transport, node_2.ctx)
+	if mtype != FIND_NODE_REQ {
+		t.Fatal("Failed to read find node request")
+	}
+	req := msg.(*FindNodeRequest)
+	if req.LookupNodeId != lookup_id {
+		t.Error("Wrong lookup ID: ", req.LookupNodeId)
+	}
+	addr, _ := net.ResolveUDPAddr("udp", "10.0.3.2:8989")
+	nodes := []RemoteNode{{Id: generateRandomNodeId(), Addr: NewIpv4Addr(addr)}}
+	if !SendFindNodeResponse(node_2.transport, node_1.addr, req, nodes, node_2.ctx) {
+		t.Fatal("Failed to send find node response")
+	}
 
-	_ = <-my_chan
-	_ = <-my_chan
+	msg, mtype = ConsumePacket(node_1.transport, node_1.ctx)
+	if mtype != FIND_NODE_RESP {
+		t.Fatal("Failed to read find node response")
+	}
+	resp := msg.(*FindNodeReply)
+	if resp.TotalNodes != 1 || resp.Nodes[0] != nodes[0] {
+		t.Error("Wrong nodes: ", resp.Nodes)
+	}
 }
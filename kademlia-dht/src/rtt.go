@@ -0,0 +1,172 @@
+package kadht
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * Round trip time estimation.
+ *
+ * The timeout of a request depends on the peer it is sent to. For every
+ * peer address the RttEstimator keeps a smoothed round trip time (SRTT)
+ * and its mean deviation (RTTVAR), updated from each reply as in
+ * Jacobson/Karels (RFC 6298):
+ *
+ *   RTTVAR = 3/4 * RTTVAR + 1/4 * |SRTT - R|
+ *   SRTT   = 7/8 * SRTT + 1/8 * R
+ *   RTO    = SRTT + 4 * RTTVAR
+ *
+ * Every attempt of a request has its own RandomId, so a reply tells
+ * which attempt it answers and retries give valid samples too.
+ * A request which failed after all its retries doubles the timeout of
+ * the peer until the next sample, so a peer which became slower is not
+ * declared dead at once.
+ */
+
+const (
+	// Smallest timeout, above the scheduling noise of a LAN
+	minRequestTimeout = 20 * time.Millisecond
+	// Largest timeout, however slow the peer is
+	maxRequestTimeout = 10 * time.Second
+	// Max times the timeout of a peer is doubled
+	maxRttBackoff = 4
+	// Max number of peers with an estimate
+	maxRttEntries = 65536
+)
+
+// Estimate of one peer
+type rttEstimate struct {
+	srtt      time.Duration
+	rttvar    time.Duration
+	backoff   uint
+	last_used time.Time
+}
+
+/*
+ * RttEstimator : Round trip time estimates by peer address
+ */
+type RttEstimator struct {
+	lock     sync.Mutex
+	initial  time.Duration // Timeout of peers without sample
+	estimate map[string]*rttEstimate
+}
+
+/*
+ * NewRttEstimator : Creates a new estimator.
+ * Parameters:
+ * [in] initial : Timeout of the peers not sampled yet
+ * [out] *RttEstimator : Pointer to the newly created RttEstimator
+ */
+func NewRttEstimator(initial time.Duration) *RttEstimator {
+	return &RttEstimator{
+		initial:  initial,
+		estimate: make(map[string]*rttEstimate),
+	}
+}
+
+/*
+ * Sample : Updates the estimate of a peer with a measured round trip.
+ * Parameters:
+ * [in] addr : Address of the peer
+ * [in] rtt : Time between the request and its reply
+ */
+func (this *RttEstimator) Sample(addr string, rtt time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	entry, found := this.estimate[addr]
+	if !found {
+		if len(this.estimate) >= maxRttEntries {
+			this.evictOldest()
+		}
+		// First sample, as RFC 6298
+		this.estimate[addr] = &rttEstimate{srtt: rtt, rttvar: rtt / 2, last_used: now}
+		return
+	}
+
+	delta := entry.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	entry.rttvar = (3*entry.rttvar + delta) / 4
+	entry.srtt = (7*entry.srtt + rtt) / 8
+	entry.backoff = 0
+	entry.last_used = now
+}
+
+/*
+ * Backoff : Doubles the timeout of a peer which did not answer,
+ * until its next sample.
+ */
+func (this *RttEstimator) Backoff(addr string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, found := this.estimate[addr]
+	if found && entry.backoff < maxRttBackoff {
+		entry.backoff++
+	}
+}
+
+/*
+ * Timeout : Time to wait for the reply of a peer.
+ * Parameters:
+ * [in] addr : Address of the peer
+ * [out] time.Duration : SRTT + 4 * RTTVAR, or the initial timeout if
+ *                       the peer was never sampled
+ */
+func (this *RttEstimator) Timeout(addr string) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, found := this.estimate[addr]
+	if !found {
+		return this.initial
+	}
+	return clampTimeout((entry.srtt + 4*entry.rttvar) << entry.backoff)
+}
+
+/*
+ * Estimate : Smoothed round trip time of a peer and its deviation.
+ * Parameters:
+ * [in] addr : Address of the peer
+ * [out] time.Duration : SRTT
+ * [out] time.Duration : RTTVAR
+ * [out] bool : 'false' if the peer was never sampled
+ */
+func (this *RttEstimator) Estimate(addr string) (time.Duration, time.Duration, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, found := this.estimate[addr]
+	if !found {
+		return 0, 0, false
+	}
+	return entry.srtt, entry.rttvar, true
+}
+
+// evictOldest: Forgets the peer sampled least recently. Called with
+// the lock held.
+func (this *RttEstimator) evictOldest() {
+	var oldest string
+	var oldest_time time.Time
+	for addr, entry := range this.estimate {
+		if oldest_time.IsZero() || entry.last_used.Before(oldest_time) {
+			oldest = addr
+			oldest_time = entry.last_used
+		}
+	}
+	delete(this.estimate, oldest)
+}
+
+func clampTimeout(timeout time.Duration) time.Duration {
+	if timeout < minRequestTimeout {
+		return minRequestTimeout
+	}
+	if timeout > maxRequestTimeout {
+		return maxRequestTimeout
+	}
+	return timeout
+}
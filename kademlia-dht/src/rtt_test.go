@@ -0,0 +1,69 @@
+package kadht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttEstimator(t *testing.T) {
+	estimator := NewRttEstimator(time.Second)
+	if estimator.Timeout("10.0.0.1:4000") != time.Second {
+		t.Error("Wrong timeout of an unknown peer")
+	}
+
+	estimator.Sample("10.0.0.1:4000", 100*time.Millisecond)
+	if timeout := estimator.Timeout("10.0.0.1:4000"); timeout != 300*time.Millisecond {
+		t.Error("Wrong timeout after the first sample: ", timeout)
+	}
+	estimator.Sample("10.0.0.1:4000", 100*time.Millisecond)
+	srtt, rttvar, found := estimator.Estimate("10.0.0.1:4000")
+	if !found || srtt != 100*time.Millisecond || rttvar != 37500*time.Microsecond {
+		t.Error("Wrong estimate: ", srtt, rttvar)
+	}
+
+	// LAN peer
+	for i := 0; i < 50; i++ {
+		estimator.Sample("10.0.0.2:4000", 500*time.Microsecond)
+	}
+	if timeout := estimator.Timeout("10.0.0.2:4000"); timeout != minRequestTimeout {
+		t.Error("LAN peer timeout not in milliseconds: ", timeout)
+	}
+
+	// Slow WAN peer
+	for i := 0; i < 5; i++ {
+		estimator.Sample("10.0.0.3:4000", 1500*time.Millisecond)
+	}
+	if timeout := estimator.Timeout("10.0.0.3:4000"); timeout <= 1500*time.Millisecond {
+		t.Error("WAN peer timeout below its round trip time: ", timeout)
+	}
+
+	// Backoff until the next sample
+	before := estimator.Timeout("10.0.0.1:4000")
+	estimator.Backoff("10.0.0.1:4000")
+	if estimator.Timeout("10.0.0.1:4000") != 2*before {
+		t.Error("Timeout not doubled")
+	}
+	estimator.Sample("10.0.0.1:4000", 100*time.Millisecond)
+	if estimator.Timeout("10.0.0.1:4000") > before {
+		t.Error("Backoff not reset by a sample")
+	}
+}
+
+func TestPendingRttSample(t *testing.T) {
+	tracker := NewPendingTracker(time.Minute, 0)
+	var sender testSender
+	ping := NewPingRequest(generateRandomNodeId())
+	pending, _ := tracker.Start(ping, "10.0.0.1:4000", sender.send)
+	time.Sleep(5 * time.Millisecond)
+	tracker.Deliver(NewPingReply(generateRandomNodeId(), ping), "10.0.0.1:4000")
+	pending.Wait()
+
+	srtt, _, found := tracker.Estimator().Estimate("10.0.0.1:4000")
+	if !found || srtt < 5*time.Millisecond || srtt > time.Second {
+		t.Fatal("Round trip not sampled: ", srtt)
+	}
+	// The next request to the peer no longer waits a minute
+	if timeout := tracker.Estimator().Timeout("10.0.0.1:4000"); timeout >= time.Minute {
+		t.Error("Timeout not derived from the round trip: ", timeout)
+	}
+}
@@ -0,0 +1,482 @@
+package kadht
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+ * Encrypted node-to-node sessions.
+ *
+ * Handshake: the initiator sends a SessionInitRequest carrying a fresh
+ * X25519 key, the responder answers with a SessionInitReply carrying
+ * its own. Both messages must be signed with the node keys (see
+ * signature.go), which binds the X25519 keys to the node IDs. The
+ * initiator only accepts a reply signed by the node it meant to reach:
+ * the RandomId travels in clear, anyone on the path could answer. The
+ * responder rejects requests outside DefaultMaxClockSkew, and requests
+ * it already accepted within it: a captured request sent again would
+ * replace the session of its initiator, and move it to another address.
+ * Each
+ * side then derives one AES-256-GCM key per direction from the shared
+ * secret with HKDF-SHA256. Using fresh X25519 keys for every session
+ * keeps past traffic safe even if a node key leaks later.
+ *
+ * Every message sent to a peer with a session is then carried as the
+ * ciphertext of a SessionData message. Sessions are cached by peer ID
+ * and found by peer address when sending.
+ */
+
+const (
+	x25519KeyLen = 32
+	// Sessions are renegotiated after this time
+	sessionLifetime = time.Hour
+	// Max number of cached sessions, the oldest is dropped beyond it
+	maxSessions = 4096
+	// Handshakes not completed within this time are forgotten
+	handshakeTimeout = 30 * time.Second
+	// Received messages older than this many messages are rejected
+	sessionReplayWindow = 64
+)
+
+var (
+	errNoSession          = errors.New("No session with the peer")
+	errUnsignedHandshake  = errors.New("Session handshake must be signed")
+	errEncryptionRequired = errors.New("Unencrypted message rejected")
+	errSessionReplay      = errors.New("Replayed session message")
+	errSessionPeer        = errors.New("Session reply from another node than the one asked")
+)
+
+func init() {
+	registerBuiltinMessageType(SESSION_INIT_REQ, "SESSION_INIT_REQ", func(header BasicMsgHeader) IMessage {
+		return &SessionInitRequest{base_msg: header}
+	})
+	registerBuiltinMessageType(SESSION_INIT_RESP, "SESSION_INIT_RESP", func(header BasicMsgHeader) IMessage {
+		return &SessionInitReply{base_msg: header}
+	})
+	registerBuiltinMessageType(SESSION_DATA, "SESSION_DATA", func(header BasicMsgHeader) IMessage {
+		return &SessionData{base_msg: header}
+	})
+}
+
+/*
+ * SessionInitRequest : Starts a session with the receiving node
+ */
+type SessionInitRequest struct {
+	base_msg     BasicMsgHeader
+	EphemeralKey [x25519KeyLen]byte // X25519 public key of the initiator
+}
+
+/*
+ * SessionInitReply : Accepts the session
+ */
+type SessionInitReply struct {
+	base_msg     BasicMsgHeader
+	EphemeralKey [x25519KeyLen]byte // X25519 public key of the responder
+}
+
+/*
+ * SessionData : Carries an encrypted datagram
+ */
+type SessionData struct {
+	base_msg   BasicMsgHeader
+	Counter    uint64 // Message number within the session, used as nonce
+	Ciphertext []byte // The sealed datagram
+}
+
+// Keys of one established session
+type session struct {
+	peer_id      NodeId
+	addr         string
+	send_aead    cipher.AEAD
+	recv_aead    cipher.AEAD
+	send_counter uint64
+	recv_max     uint64 // Highest counter received
+	recv_seen    uint64 // Bitmap of the counters received below recv_max
+	created      time.Time
+}
+
+// Handshake started by the local node
+type pendingHandshake struct {
+	key     *ecdh.PrivateKey
+	req     *SessionInitRequest
+	peer_id NodeId // Node expected to answer
+	addr    string
+	created time.Time
+}
+
+/*
+ * SessionManager : Keeps the sessions of the local node
+ */
+type SessionManager struct {
+	lock               sync.Mutex
+	require_encryption bool
+	sessions           map[NodeId]*session
+	by_addr            map[string]NodeId
+	pending            map[NodeId]*pendingHandshake // By RandomId of the request
+	accepted           *ReplayGuard                 // Requests accepted lately
+}
+
+func NewSessionManager(require_encryption bool) *SessionManager {
+	return &SessionManager{
+		require_encryption: require_encryption,
+		sessions:           make(map[NodeId]*session),
+		by_addr:            make(map[string]NodeId),
+		pending:            make(map[NodeId]*pendingHandshake),
+		accepted:           NewReplayGuard(DefaultMaxClockSkew, maxSessions),
+	}
+}
+
+/*
+ * HasSession : Tells if an established session exists with the peer.
+ */
+func (this *SessionManager) HasSession(peer_id NodeId) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sess, found := this.sessions[peer_id]
+	return found && time.Since(sess.created) < sessionLifetime
+}
+
+// createInitRequest: Starts a handshake with the node 'peer_id' at 'addr'
+func (this *SessionManager) createInitRequest(local_id, peer_id NodeId, addr string) (*SessionInitRequest, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	req := &SessionInitRequest{
+		base_msg: *NewBasicMsgHeader(SESSION_INIT_REQ, local_id, generateRandomNodeId()),
+	}
+	copy(req.EphemeralKey[:], key.PublicKey().Bytes())
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for random_id, pending := range this.pending {
+		if now.Sub(pending.created) > handshakeTimeout {
+			delete(this.pending, random_id)
+		}
+	}
+	this.pending[req.base_msg.RandomId] = &pendingHandshake{
+		key: key, req: req, peer_id: peer_id, addr: addr, created: now}
+	return req, nil
+}
+
+// acceptInitRequest: Answers a handshake of the node at 'addr' and
+// establishes the session on the responder side. Fails with
+// errStaleMessage or errReplayedMessage if the request is not fresh.
+func (this *SessionManager) acceptInitRequest(local_id NodeId, req *SessionInitRequest,
+	addr string) (*SessionInitReply, error) {
+
+	if err := this.accepted.Check(&req.base_msg); err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	reply := &SessionInitReply{
+		base_msg: *NewBasicMsgHeader(SESSION_INIT_RESP, local_id, req.base_msg.RandomId),
+	}
+	copy(reply.EphemeralKey[:], key.PublicKey().Bytes())
+
+	i2r, r2i, err := deriveSessionKeys(key, req.EphemeralKey[:], req, reply)
+	if err != nil {
+		return nil, err
+	}
+	// Responder sends with the responder-to-initiator key
+	this.addSession(req.base_msg.SenderId, addr, r2i, i2r)
+	return reply, nil
+}
+
+// completeHandshake: Establishes the session on the initiator side.
+// A reply from another node leaves the handshake pending, for the
+// reply of the node asked.
+func (this *SessionManager) completeHandshake(reply *SessionInitReply) error {
+	this.lock.Lock()
+	pending, found := this.pending[reply.base_msg.RandomId]
+	if found && pending.peer_id == reply.base_msg.SenderId {
+		delete(this.pending, reply.base_msg.RandomId)
+	}
+	this.lock.Unlock()
+
+	if !found {
+		return errors.New("Session reply answers no handshake")
+	}
+	if pending.peer_id != reply.base_msg.SenderId {
+		return errSessionPeer
+	}
+	i2r, r2i, err := deriveSessionKeys(pending.key, reply.EphemeralKey[:], pending.req, reply)
+	if err != nil {
+		return err
+	}
+	this.addSession(reply.base_msg.SenderId, pending.addr, i2r, r2i)
+	return nil
+}
+
+func (this *SessionManager) addSession(peer_id NodeId, addr string, send_key, recv_key []byte) {
+	sess := &session{
+		peer_id:   peer_id,
+		addr:      addr,
+		send_aead: newSessionAead(send_key),
+		recv_aead: newSessionAead(recv_key),
+		created:   time.Now(),
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if old, found := this.sessions[peer_id]; found {
+		delete(this.by_addr, old.addr)
+	} else if len(this.sessions) >= maxSessions {
+		var oldest *session
+		for _, s := range this.sessions {
+			if oldest == nil || s.created.Before(oldest.created) {
+				oldest = s
+			}
+		}
+		delete(this.sessions, oldest.peer_id)
+		delete(this.by_addr, oldest.addr)
+	}
+	this.sessions[peer_id] = sess
+	this.by_addr[addr] = peer_id
+}
+
+// seal: Encrypts the datagram for the peer at 'addr'.
+// Returns false if there is no session with the peer.
+func (this *SessionManager) seal(local_id NodeId, addr string, data []byte) (*SessionData, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	peer_id, found := this.by_addr[addr]
+	if !found {
+		return nil, false
+	}
+	sess := this.sessions[peer_id]
+	if time.Since(sess.created) >= sessionLifetime {
+		return nil, false
+	}
+	sess.send_counter++
+
+	msg := &SessionData{
+		base_msg: *NewBasicMsgHeader(SESSION_DATA, local_id, generateRandomNodeId()),
+		Counter:  sess.send_counter,
+	}
+	msg.Ciphertext = sess.send_aead.Seal(nil, sessionNonce(msg.Counter), data,
+		sessionAdditionalData(local_id, msg.Counter))
+	return msg, true
+}
+
+// sealedSize: Size of the SessionData message 'seal' would send to the
+// peer at 'addr' for a datagram of 'size' bytes, in 'version'.
+// Returns false if there is no session with the peer.
+func (this *SessionManager) sealedSize(local_id NodeId, addr string, version uint32, size int) (int, bool) {
+	this.lock.Lock()
+	peer_id, found := this.by_addr[addr]
+	if !found {
+		this.lock.Unlock()
+		return 0, false
+	}
+	sess := this.sessions[peer_id]
+	if time.Since(sess.created) >= sessionLifetime {
+		this.lock.Unlock()
+		return 0, false
+	}
+	msg := &SessionData{
+		base_msg:   *NewBasicMsgHeader(SESSION_DATA, local_id, generateRandomNodeId()),
+		Counter:    sess.send_counter + 1,
+		Ciphertext: make([]byte, size+sess.send_aead.Overhead()),
+	}
+	this.lock.Unlock()
+
+	msg.base_msg.Version = version
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		return 0, false
+	}
+	return len(data), true
+}
+
+// open: Decrypts the datagram carried by the message
+func (this *SessionManager) open(msg *SessionData) ([]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sess, found := this.sessions[msg.base_msg.SenderId]
+	if !found || time.Since(sess.created) >= sessionLifetime {
+		return nil, errNoSession
+	}
+	if msg.Counter+sessionReplayWindow <= sess.recv_max {
+		return nil, errSessionReplay
+	}
+	if msg.Counter <= sess.recv_max && sess.recv_seen&(1<<(sess.recv_max-msg.Counter)) != 0 {
+		return nil, errSessionReplay
+	}
+
+	data, err := sess.recv_aead.Open(nil, sessionNonce(msg.Counter), msg.Ciphertext,
+		sessionAdditionalData(msg.base_msg.SenderId, msg.Counter))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only authentic messages move the replay window
+	if msg.Counter > sess.recv_max {
+		shift := msg.Counter - sess.recv_max
+		if shift >= sessionReplayWindow {
+			sess.recv_seen = 0
+		} else {
+			sess.recv_seen <<= shift
+		}
+		sess.recv_max = msg.Counter
+	}
+	sess.recv_seen |= 1 << (sess.recv_max - msg.Counter)
+	return data, nil
+}
+
+// deriveSessionKeys: Computes the keys of both directions.
+// The request and reply provide the transcript binding the keys
+// to both node IDs and both X25519 keys.
+func deriveSessionKeys(local_key *ecdh.PrivateKey, peer_key []byte,
+	req *SessionInitRequest, reply *SessionInitReply) ([]byte, []byte, error) {
+
+	peer_pub, err := ecdh.X25519().NewPublicKey(peer_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := local_key.ECDH(peer_pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := []byte("kadht session v1")
+	info = append(info, req.base_msg.SenderId[:]...)
+	info = append(info, reply.base_msg.SenderId[:]...)
+	info = append(info, req.EphemeralKey[:]...)
+	info = append(info, reply.EphemeralKey[:]...)
+
+	keys := hkdfSha256(shared, req.base_msg.RandomId[:], info, 64)
+	return keys[:32], keys[32:], nil
+}
+
+// hkdfSha256: HKDF (RFC 5869) extract and expand steps
+func hkdfSha256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+func newSessionAead(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic("Invalid session key length")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic("Failed to create GCM cipher")
+	}
+	return aead
+}
+
+func sessionNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func sessionAdditionalData(sender_id NodeId, counter uint64) []byte {
+	ad := make([]byte, bytesPerNodeiId+8)
+	copy(ad, sender_id[:])
+	binary.BigEndian.PutUint64(ad[bytesPerNodeiId:], counter)
+	return ad
+}
+
+// isHandshakeMessage: Handshake messages always travel in clear
+func isHandshakeMessage(msg IMessage) bool {
+	switch msg.(type) {
+	case *SessionInitRequest, *SessionInitReply:
+		return true
+	}
+	return false
+}
+
+//************** MESSAGE SERIALIZATION-DESERIALIZATION FUNCTIONS ***************//
+
+func (this *SessionInitRequest) Header() *BasicMsgHeader { return &this.base_msg }
+func (this *SessionInitReply) Header() *BasicMsgHeader   { return &this.base_msg }
+func (this *SessionData) Header() *BasicMsgHeader        { return &this.base_msg }
+
+func (this *SessionInitRequest) Serialize(writer io.Writer) bool {
+	return serializeSessionKey(writer, &this.base_msg, this.EphemeralKey[:])
+}
+
+func (this *SessionInitRequest) Deserialize(reader io.Reader) bool {
+	_, err := io.ReadFull(reader, this.EphemeralKey[:])
+	return err == nil
+}
+
+func (this *SessionInitReply) Serialize(writer io.Writer) bool {
+	return serializeSessionKey(writer, &this.base_msg, this.EphemeralKey[:])
+}
+
+func (this *SessionInitReply) Deserialize(reader io.Reader) bool {
+	_, err := io.ReadFull(reader, this.EphemeralKey[:])
+	return err == nil
+}
+
+func serializeSessionKey(writer io.Writer, header *BasicMsgHeader, key []byte) bool {
+	if !header.Serialize(writer) {
+		fmt.Println("ERROR: Failed to serialize session handshake header")
+		return false
+	}
+	_, err := writer.Write(key)
+	return err == nil
+}
+
+func (this *SessionData) Serialize(writer io.Writer) bool {
+	if !this.base_msg.Serialize(writer) {
+		fmt.Println("ERROR: Failed to serialize SessionData header")
+		return false
+	}
+	err := binary.Write(writer, binary.BigEndian, &this.Counter)
+	if err != nil || !writeBytesField(writer, this.Ciphertext) {
+		fmt.Println("ERROR: Failed to serialize SessionData")
+		return false
+	}
+	return true
+}
+
+func (this *SessionData) Deserialize(reader io.Reader) bool {
+	err := binary.Read(reader, binary.BigEndian, &this.Counter)
+	if err != nil {
+		fmt.Println("ERROR: Failed to deserialize SessionData counter")
+		return false
+	}
+	var ok bool
+	this.Ciphertext, ok = readBytesField(reader)
+	if !ok {
+		fmt.Println("ERROR: Failed to deserialize SessionData ciphertext")
+	}
+	return ok
+}
@@ -0,0 +1,183 @@
+package kadht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Network shared by the endpoints of all the tests
+var testNetwork = NewMemNetwork()
+
+type testEndpoint struct {
+	ctx       *ServerConfig
+	transport *MemTransport
+	addr      net.Addr
+}
+
+func newEncryptedEndpoint(t *testing.T, require bool) *testEndpoint {
+	ctx := newSignedTestConfig(t)
+	if err := ctx.EnableEncryption(require); err != nil {
+		t.Fatal("Failed to enable encryption: ", err)
+	}
+	return newTestEndpoint(t, ctx)
+}
+
+func newTestEndpoint(t *testing.T, ctx *ServerConfig) *testEndpoint {
+	transport, err := testNetwork.Listen(nil)
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	transport.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return &testEndpoint{ctx: ctx, transport: transport, addr: transport.LocalAddr()}
+}
+
+func (this *testEndpoint) close() {
+	this.transport.Close()
+}
+
+func TestEncryptedSession(t *testing.T) {
+	testEncryptedSession(t, false)
+}
+
+func TestEncryptedSignedSession(t *testing.T) {
+	testEncryptedSession(t, true)
+}
+
+func testEncryptedSession(t *testing.T, require_signatures bool) {
+	a := newEncryptedEndpoint(t, false)
+	b := newEncryptedEndpoint(t, true)
+	defer a.close()
+	defer b.close()
+	a.ctx.RequireSignatures(require_signatures)
+	b.ctx.RequireSignatures(require_signatures)
+
+	// Handshake
+	if !SendSessionInitRequest(a.transport, b.addr, b.ctx.node_id, a.ctx) {
+		t.Fatal("Failed to send session init request")
+	}
+	msg, _ := ConsumePacket(b.transport, b.ctx)
+	init_req, ok := msg.(*SessionInitRequest)
+	if !ok {
+		t.Fatal("Session init request not received")
+	}
+	if !SendSessionInitResponse(b.transport, a.addr, init_req, b.ctx) {
+		t.Fatal("Failed to send session init response")
+	}
+	msg, _ = ConsumePacket(a.transport, a.ctx)
+	if _, ok := msg.(*SessionInitReply); !ok {
+		t.Fatal("Session init reply not received")
+	}
+	if !a.ctx.sessions.HasSession(b.ctx.node_id) || !b.ctx.sessions.HasSession(a.ctx.node_id) {
+		t.Fatal("Session not established")
+	}
+
+	// b only accepts encrypted messages
+	lookup_id := generateRandomNodeId()
+	SendFindNodeRequest(a.transport, b.addr, lookup_id, a.ctx)
+	msg, _ = ConsumePacket(b.transport, b.ctx)
+	req, ok := msg.(*FindNodeRequest)
+	if !ok || req.LookupNodeId != lookup_id {
+		t.Fatal("Encrypted find node request not received")
+	}
+
+	SendFindNodeResponse(b.transport, a.addr, req, nil, b.ctx)
+	msg, _ = ConsumePacket(a.transport, a.ctx)
+	if _, ok := msg.(*FindNodeReply); !ok {
+		t.Fatal("Encrypted find node reply not received")
+	}
+}
+
+func TestSessionReplyFromOtherNode(t *testing.T) {
+	a := newEncryptedEndpoint(t, false)
+	b := newEncryptedEndpoint(t, false)
+	c := newEncryptedEndpoint(t, false)
+	defer a.close()
+	defer b.close()
+	defer c.close()
+
+	SendSessionInitRequest(a.transport, b.addr, b.ctx.node_id, a.ctx)
+	msg, _ := ConsumePacket(b.transport, b.ctx)
+	init_req, ok := msg.(*SessionInitRequest)
+	if !ok {
+		t.Fatal("Session init request not received")
+	}
+
+	// c saw the request on the path, and answers first
+	SendSessionInitResponse(c.transport, a.addr, init_req, c.ctx)
+	if msg, _ := ConsumePacket(a.transport, a.ctx); msg != nil {
+		t.Error("Session reply of another node accepted")
+	}
+	if a.ctx.sessions.HasSession(c.ctx.node_id) {
+		t.Fatal("Session established with another node")
+	}
+
+	SendSessionInitResponse(b.transport, a.addr, init_req, b.ctx)
+	if msg, _ := ConsumePacket(a.transport, a.ctx); msg == nil || !a.ctx.sessions.HasSession(b.ctx.node_id) {
+		t.Error("Session not established with the node asked")
+	}
+}
+
+func TestEncryptionRequired(t *testing.T) {
+	b := newEncryptedEndpoint(t, true)
+	defer b.close()
+
+	ping := NewPingRequest(generateRandomNodeId())
+	data, _ := EncodeDatagram(ping, NewServerConfig(ping.base_msg.SenderId))
+	if _, err := DecodeDatagram(data, b.ctx); err != errEncryptionRequired {
+		t.Error("Unencrypted message accepted: ", err)
+	}
+
+	// Nothing can be sent to a peer without a session either
+	if _, err := encryptDatagram(ping, data, "127.0.0.1:1", b.ctx); err != errNoSession {
+		t.Error("Unencrypted message sent: ", err)
+	}
+}
+
+func TestSessionReplay(t *testing.T) {
+	a := NewSessionManager(false)
+	b := NewSessionManager(false)
+	a_id, b_id := generateRandomNodeId(), generateRandomNodeId()
+
+	req, _ := a.createInitRequest(a_id, b_id, "b")
+	reply, err := b.acceptInitRequest(b_id, req, "a")
+	if err != nil {
+		t.Fatal("Failed to accept session: ", err)
+	}
+	if err := a.completeHandshake(reply); err != nil {
+		t.Fatal("Failed to complete handshake: ", err)
+	}
+
+	// The request cannot be sent again, nor an old one
+	if _, err := b.acceptInitRequest(b_id, req, "c"); err != errReplayedMessage {
+		t.Error("Replayed session request accepted: ", err)
+	}
+	stale, _ := a.createInitRequest(a_id, b_id, "b")
+	stale.base_msg.EpochTime -= int64(2 * DefaultMaxClockSkew / time.Second)
+	if _, err := b.acceptInitRequest(b_id, stale, "c"); err != errStaleMessage {
+		t.Error("Stale session request accepted: ", err)
+	}
+
+	size, _ := a.sealedSize(a_id, "b", WIRE_VERSION_BINARY, len("first"))
+	first, _ := a.seal(a_id, "b", []byte("first"))
+	second, _ := a.seal(a_id, "b", []byte("second"))
+	if data, _ := EncodeMessage(first); len(data) != size {
+		t.Error("Wrong size of the sealed message: ", size, len(data))
+	}
+	if data, err := b.open(second); err != nil || string(data) != "second" {
+		t.Fatal("Failed to open message: ", err)
+	}
+	// Reordered messages within the window are fine, replays are not
+	if data, err := b.open(first); err != nil || string(data) != "first" {
+		t.Fatal("Failed to open reordered message: ", err)
+	}
+	if _, err := b.open(first); err != errSessionReplay {
+		t.Error("Replayed message accepted: ", err)
+	}
+
+	second.Ciphertext[0] ^= 0x01
+	second.Counter = 3
+	if _, err := b.open(second); err == nil {
+		t.Error("Tampered message accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package kadht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+)
+
+/*
+ * Message signatures.
+ * A signed datagram is the encoded message followed by a trailer:
+ *
+ *   [ message ][ public key (32) ][ signature (64) ][ "KSIG" ]
+ *
+ * The signature covers the encoded message. The receiver checks it
+ * and also that the SHA-1 of the public key is the SenderId of the
+ * header, so that nobody can send messages in the name of a node
+ * without holding its private key.
+ */
+
+const (
+	signatureMagic      = "KSIG"
+	signatureTrailerLen = ed25519.PublicKeySize + ed25519.SignatureSize + len(signatureMagic)
+)
+
+var (
+	errBadSignature      = errors.New("Invalid message signature")
+	errSenderKeyMismatch = errors.New("Signing key does not belong to the sender")
+	errUnsignedMessage   = errors.New("Unsigned message rejected")
+)
+
+/*
+ * GenerateSigningKey : Creates a new signing key for a node.
+ * The node ID of a node with a signing key is always derived
+ * from its public key, see NodeIdFromPublicKey.
+ * Parameters:
+ * [out] ed25519.PrivateKey : The generated key. Must be saved in a
+ *                            persistent medium to keep the node ID.
+ * [out] error : If the system random source failed
+ */
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// NodeIdFromPublicKey: The node ID belonging to a public key
+func NodeIdFromPublicKey(pub ed25519.PublicKey) NodeId {
+	return sha1.Sum(pub)
+}
+
+// signDatagram: Appends the signature trailer to the encoded message
+func signDatagram(data []byte, key ed25519.PrivateKey) []byte {
+	payload_len := len(data)
+	data = append(data, key.Public().(ed25519.PublicKey)...)
+	data = append(data, ed25519.Sign(key, data[:payload_len])...)
+	return append(data, signatureMagic...)
+}
+
+// splitSignature: Separates the encoded message from the signature
+// trailer, if there is one.
+// Returns the message, the public key and signature from the
+// trailer and whether the datagram was signed at all.
+func splitSignature(data []byte) ([]byte, ed25519.PublicKey, []byte, bool) {
+	if len(data) < signatureTrailerLen ||
+		!bytes.HasSuffix(data, []byte(signatureMagic)) {
+		return data, nil, nil, false
+	}
+	payload_len := len(data) - signatureTrailerLen
+	pub := ed25519.PublicKey(data[payload_len : payload_len+ed25519.PublicKeySize])
+	sig := data[payload_len+ed25519.PublicKeySize : len(data)-len(signatureMagic)]
+	return data[:payload_len], pub, sig, true
+}
+
+/*
+ * verifyDatagram : Checks the signature of a datagram and decodes it.
+ * Parameters:
+ * [in] data : The received datagram
+ * [in] require_signature : Reject unsigned datagrams
+ * [out] IMessage : The decoded message
+ * [out] bool : 'true' if the message was signed by its sender
+ * [out] error : If the signature is invalid or does not belong to the
+ *               sender, or if the message could not be decoded
+ */
+func verifyDatagram(data []byte, require_signature bool) (IMessage, bool, error) {
+	payload, pub, sig, signed := splitSignature(data)
+	if !signed {
+		if require_signature {
+			return nil, false, errUnsignedMessage
+		}
+		msg, err := DecodeMessage(data)
+		return msg, false, err
+	}
+
+	if !ed25519.Verify(pub, payload, sig) {
+		return nil, false, errBadSignature
+	}
+	msg, err := DecodeMessage(payload)
+	if err != nil {
+		return nil, false, err
+	}
+	if msg.Header().SenderId != NodeIdFromPublicKey(pub) {
+		return nil, false, errSenderKeyMismatch
+	}
+	return msg, true, nil
+}
@@ -0,0 +1,71 @@
+package kadht
+
+import (
+	"testing"
+)
+
+func newSignedTestConfig(t *testing.T) *ServerConfig {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal("Failed to generate signing key: ", err)
+	}
+	return NewSignedServerConfig(key)
+}
+
+func TestSignedMessage(t *testing.T) {
+	sender_ctx := newSignedTestConfig(t)
+	receiver_ctx := newSignedTestConfig(t)
+	receiver_ctx.RequireSignatures(true)
+
+	for _, version := range []uint32{WIRE_VERSION_BINARY, WIRE_VERSION_JSON} {
+		sender_ctx.SetWireVersion(version)
+		req := NewFindNodeRequest(sender_ctx.node_id, generateRandomNodeId())
+		data, err := EncodeDatagram(req, sender_ctx)
+		if err != nil {
+			t.Fatal("Failed to encode: ", err)
+		}
+
+		msg, err := DecodeDatagram(data, receiver_ctx)
+		if err != nil {
+			t.Fatal("Signed message rejected: ", err)
+		}
+		if msg.(*FindNodeRequest).LookupNodeId != req.LookupNodeId {
+			t.Error("Wrong message decoded")
+		}
+
+		// Flip a bit of the message body
+		data[len(data)-signatureTrailerLen-1] ^= 0x01
+		if _, err := DecodeDatagram(data, receiver_ctx); err != errBadSignature {
+			t.Error("Tampered message accepted: ", err)
+		}
+	}
+}
+
+func TestSpoofedSender(t *testing.T) {
+	attacker_ctx := newSignedTestConfig(t)
+	receiver_ctx := newSignedTestConfig(t)
+
+	// Signed with the attacker's own key, in the name of another node
+	victim_id := generateRandomNodeId()
+	reply := NewFindNodeReply(victim_id, nil, NewFindNodeRequest(receiver_ctx.node_id, victim_id))
+	data, _ := EncodeDatagram(reply, attacker_ctx)
+
+	if _, err := DecodeDatagram(data, receiver_ctx); err != errSenderKeyMismatch {
+		t.Error("Message with spoofed sender accepted: ", err)
+	}
+}
+
+func TestUnsignedMessage(t *testing.T) {
+	sender_ctx := NewServerConfig(generateRandomNodeId())
+	receiver_ctx := newSignedTestConfig(t)
+
+	data, _ := EncodeDatagram(NewPingRequest(sender_ctx.node_id), sender_ctx)
+	if _, err := DecodeDatagram(data, receiver_ctx); err != nil {
+		t.Error("Unsigned message rejected by default: ", err)
+	}
+
+	receiver_ctx.RequireSignatures(true)
+	if _, err := DecodeDatagram(data, receiver_ctx); err != errUnsignedMessage {
+		t.Error("Unsigned message accepted: ", err)
+	}
+}
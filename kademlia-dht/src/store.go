@@ -0,0 +1,199 @@
+package kadht
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+ * Local value storage.
+ *
+ * A Storage holds the values other nodes asked the local node to store,
+ * until their TTL runs out. Expired values are not returned, and are
+ * removed by Expire, which the DHT calls periodically, or when room is
+ * needed. Both the number of values and their total size are capped,
+ * whoever may send a STORE must not be able to exhaust the memory or
+ * the disk.
+ *
+ * MemoryStore keeps the values in memory, they are lost on restart.
+ * DiskStore keeps them in a log file, see disk_store.go.
+ */
+
+const (
+	// Max number of values stored for other nodes
+	maxStoredValues = 65536
+	// Default max total size of the values stored for other nodes
+	DefaultMaxStoredBytes = 256 << 20
+)
+
+var errStorageFull = errors.New("No room left to store the value")
+
+/*
+ * ValueMeta : Metadata of a stored value
+ */
+type ValueMeta struct {
+	Stored  time.Time // Time of the last Put
+	Expires time.Time // Time the value is removed
+}
+
+/*
+ * Storage : Values stored for other nodes
+ */
+type Storage interface {
+	// Get: The value of the key, 'false' if it is unknown or expired
+	Get(key NodeId) ([]byte, ValueMeta, bool)
+	// Put: Stores a value kept for 'ttl', replacing the previous one
+	// of the key. Fails with errStorageFull if there is no room left.
+	Put(key NodeId, value []byte, ttl time.Duration) error
+	// Delete: Removes the value of the key, if any
+	Delete(key NodeId) error
+	// Iterate: Calls 'fn' for every value not expired, until it returns
+	// 'false'. 'fn' must not call the other methods of the Storage.
+	Iterate(fn func(key NodeId, value []byte, meta ValueMeta) bool) error
+	// Expire: Removes the expired values, returns how many
+	Expire() int
+	// Len: Number of values stored, expired ones included
+	Len() int
+	// Close: Releases the resources of the Storage
+	Close() error
+}
+
+// A value stored in memory
+type storedValue struct {
+	value []byte
+	meta  ValueMeta
+}
+
+/*
+ * MemoryStore : Values stored for other nodes, in memory
+ */
+type MemoryStore struct {
+	lock      sync.RWMutex
+	values    map[NodeId]storedValue
+	bytes     int64 // Total size of the values
+	max_bytes int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[NodeId]storedValue), max_bytes: DefaultMaxStoredBytes}
+}
+
+// SetMaxBytes: Max total size of the values stored, DefaultMaxStoredBytes
+// by default. Values already stored are kept.
+func (this *MemoryStore) SetMaxBytes(max_bytes int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.max_bytes = max_bytes
+}
+
+/*
+ * Get : Finds a value.
+ * Parameters:
+ * [in] key : ID of the value
+ * [out] []byte : The value
+ * [out] ValueMeta : Its metadata
+ * [out] bool : 'false' if the value is unknown or expired
+ */
+func (this *MemoryStore) Get(key NodeId) ([]byte, ValueMeta, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	stored, found := this.values[key]
+	if !found || time.Now().After(stored.meta.Expires) {
+		return nil, ValueMeta{}, false
+	}
+	return stored.value, stored.meta, true
+}
+
+/*
+ * Put : Stores a value, replacing the previous one of the key.
+ * Parameters:
+ * [in] key : ID of the value
+ * [in] value : The value
+ * [in] ttl : Time the value is kept
+ * [out] error : errStorageFull if there is no room left
+ */
+func (this *MemoryStore) Put(key NodeId, value []byte, ttl time.Duration) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	if !this.hasRoom(key, len(value)) {
+		this.expire(now)
+		if !this.hasRoom(key, len(value)) {
+			return errStorageFull
+		}
+	}
+	this.bytes += int64(len(value) - len(this.values[key].value))
+	this.values[key] = storedValue{value: value, meta: ValueMeta{Stored: now, Expires: now.Add(ttl)}}
+	return nil
+}
+
+// Delete: Removes the value of the key
+func (this *MemoryStore) Delete(key NodeId) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.bytes -= int64(len(this.values[key].value))
+	delete(this.values, key)
+	return nil
+}
+
+// Iterate: Calls 'fn' for every value not expired, until it returns 'false'
+func (this *MemoryStore) Iterate(fn func(key NodeId, value []byte, meta ValueMeta) bool) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	now := time.Now()
+	for key, stored := range this.values {
+		if now.After(stored.meta.Expires) {
+			continue
+		}
+		if !fn(key, stored.value, stored.meta) {
+			break
+		}
+	}
+	return nil
+}
+
+// Expire: Removes the expired values, returns how many
+func (this *MemoryStore) Expire() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.expire(time.Now())
+}
+
+// Len: Number of values stored, expired ones included
+func (this *MemoryStore) Len() int {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return len(this.values)
+}
+
+// Close: Nothing to release
+func (this *MemoryStore) Close() error {
+	return nil
+}
+
+// expire: Called with the lock held
+func (this *MemoryStore) expire(now time.Time) int {
+	removed := 0
+	for key, stored := range this.values {
+		if now.After(stored.meta.Expires) {
+			delete(this.values, key)
+			this.bytes -= int64(len(stored.value))
+			removed++
+		}
+	}
+	return removed
+}
+
+// hasRoom: If a value of 'size' bytes can be stored for the key, in
+// place of its current one. Called with the lock held.
+func (this *MemoryStore) hasRoom(key NodeId, size int) bool {
+	previous, found := this.values[key]
+	if !found && len(this.values) >= maxStoredValues {
+		return false
+	}
+	return this.bytes-int64(len(previous.value))+int64(size) <= this.max_bytes
+}
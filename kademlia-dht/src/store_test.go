@@ -0,0 +1,92 @@
+package kadht
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testStorage: Behaviour common to all the Storage implementations
+func testStorage(t *testing.T, store Storage) {
+	key := generateRandomNodeId()
+	if _, _, found := store.Get(key); found {
+		t.Fatal("Unknown value found")
+	}
+
+	before := time.Now()
+	if err := store.Put(key, []byte("first"), time.Hour); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := store.Put(key, []byte("second"), time.Hour); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	value, meta, found := store.Get(key)
+	if !found || !bytes.Equal(value, []byte("second")) {
+		t.Fatal("Value not replaced: ", string(value))
+	}
+	if meta.Stored.Before(before) || meta.Expires.Sub(meta.Stored) != time.Hour {
+		t.Error("Wrong metadata: ", meta)
+	}
+
+	expired := generateRandomNodeId()
+	store.Put(expired, []byte("expired"), -time.Second)
+	if _, _, found := store.Get(expired); found {
+		t.Error("Expired value found")
+	}
+	count := 0
+	store.Iterate(func(key NodeId, value []byte, meta ValueMeta) bool {
+		if key == expired {
+			t.Error("Expired value iterated")
+		}
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Error("Wrong number of values iterated: ", count)
+	}
+	if store.Expire() != 1 || store.Len() != 1 {
+		t.Error("Expired value not removed: ", store.Len())
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if _, _, found := store.Get(key); found || store.Len() != 0 {
+		t.Error("Deleted value found")
+	}
+}
+
+// testStorageMaxBytes: Checks the cap on the total size of the values.
+// The store is left holding 10 bytes with a cap of 10.
+func testStorageMaxBytes(t *testing.T, store Storage, set_max_bytes func(int64)) {
+	set_max_bytes(10)
+	first, second := generateRandomNodeId(), generateRandomNodeId()
+	if err := store.Put(first, make([]byte, 6), time.Hour); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := store.Put(second, make([]byte, 6), time.Hour); err != errStorageFull {
+		t.Fatal("Put over the cap not rejected: ", err)
+	}
+	// A replaced value does not count twice
+	if err := store.Put(first, make([]byte, 10), time.Hour); err != nil {
+		t.Fatal("Put of a replacement failed: ", err)
+	}
+	store.Delete(first)
+	if err := store.Put(second, make([]byte, 6), time.Hour); err != nil {
+		t.Fatal("Room not freed by Delete: ", err)
+	}
+	// Expired values make room
+	store.Put(generateRandomNodeId(), make([]byte, 4), -time.Second)
+	if err := store.Put(generateRandomNodeId(), make([]byte, 4), time.Hour); err != nil {
+		t.Fatal("Room not freed by expiry: ", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStorage(t, NewMemoryStore())
+}
+
+func TestMemoryStoreMaxBytes(t *testing.T) {
+	store := NewMemoryStore()
+	testStorageMaxBytes(t, store, store.SetMaxBytes)
+}
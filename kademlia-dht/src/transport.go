@@ -0,0 +1,193 @@
+package kadht
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Transport : Sends and receives addressed datagrams for a node.
+ * Implemented by UdpTransport for real networks and by MemTransport
+ * for nodes sharing a process. A *net.UDPConn satisfies it as well.
+ * ReadFrom fails with an error whose Timeout() is 'true' once the
+ * read deadline passed, and with net.ErrClosed once closed.
+ */
+type Transport interface {
+	ReadFrom(buf []byte) (int, net.Addr, error)
+	WriteTo(data []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	SetReadDeadline(deadline time.Time) error
+	Close() error
+}
+
+/*
+ * udpAddrOf : Converts the address of a peer to a UDP address.
+ */
+func udpAddrOf(addr net.Addr) (*net.UDPAddr, error) {
+	if udp_addr, ok := addr.(*net.UDPAddr); ok {
+		return udp_addr, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+//************************* IN-MEMORY TRANSPORT *************************//
+
+const (
+	// Datagrams queued for a MemTransport, more are dropped like
+	// a full socket buffer would
+	memQueueLen = 1024
+)
+
+// A datagram in flight
+type memPacket struct {
+	from net.Addr
+	data []byte
+}
+
+/*
+ * MemNetwork : Delivers datagrams between the MemTransports created
+ * from it. Datagrams to an address nobody listens on are dropped.
+ */
+type MemNetwork struct {
+	lock      sync.Mutex
+	endpoints map[string]*MemTransport
+	next_port int
+	// Drops the datagrams it returns 'true' for, if set
+	filter func(from, to net.Addr, data []byte) bool
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		endpoints: make(map[string]*MemTransport),
+		next_port: 1,
+	}
+}
+
+/*
+ * Listen : Creates a transport attached to the network.
+ * Parameters:
+ * [in] addr : Address of the transport, nil to pick a free one on 127.0.0.1
+ * [out] *MemTransport : Pointer to the newly created MemTransport
+ * [out] error : If the address is already in use
+ */
+func (this *MemNetwork) Listen(addr *net.UDPAddr) (*MemTransport, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if addr == nil {
+		for {
+			addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: this.next_port}
+			this.next_port++
+			if _, used := this.endpoints[addr.String()]; !used {
+				break
+			}
+		}
+	}
+	if _, used := this.endpoints[addr.String()]; used {
+		return nil, errors.New("Address already in use: " + addr.String())
+	}
+	transport := &MemTransport{
+		network: this,
+		addr:    addr,
+		queue:   make(chan memPacket, memQueueLen),
+		closed:  make(chan struct{}),
+	}
+	this.endpoints[addr.String()] = transport
+	return transport, nil
+}
+
+/*
+ * SetFilter : Sets the function deciding which datagrams are lost.
+ * nil delivers all of them.
+ */
+func (this *MemNetwork) SetFilter(filter func(from, to net.Addr, data []byte) bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.filter = filter
+}
+
+// deliver: Queues the datagram for its destination
+func (this *MemNetwork) deliver(from, to net.Addr, data []byte) {
+	this.lock.Lock()
+	dest, found := this.endpoints[to.String()]
+	filter := this.filter
+	this.lock.Unlock()
+
+	if !found || (filter != nil && filter(from, to, data)) {
+		return
+	}
+	packet := memPacket{from: from, data: append([]byte{}, data...)}
+	select {
+	case dest.queue <- packet:
+	default:
+	}
+}
+
+/*
+ * MemTransport : Transport of a node attached to a MemNetwork
+ */
+type MemTransport struct {
+	network *MemNetwork
+	addr    *net.UDPAddr
+	queue   chan memPacket
+	closed  chan struct{}
+
+	lock       sync.Mutex
+	deadline   time.Time
+	close_once sync.Once
+}
+
+func (this *MemTransport) ReadFrom(buf []byte) (int, net.Addr, error) {
+	this.lock.Lock()
+	deadline := this.deadline
+	this.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-this.queue:
+		return copy(buf, packet.data), packet.from, nil
+	case <-this.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (this *MemTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	select {
+	case <-this.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	this.network.deliver(this.addr, addr, data)
+	return len(data), nil
+}
+
+func (this *MemTransport) LocalAddr() net.Addr {
+	return this.addr
+}
+
+func (this *MemTransport) SetReadDeadline(deadline time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.deadline = deadline
+	return nil
+}
+
+func (this *MemTransport) Close() error {
+	this.close_once.Do(func() {
+		this.network.lock.Lock()
+		delete(this.network.endpoints, this.addr.String())
+		this.network.lock.Unlock()
+		close(this.closed)
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+package kadht
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+ * Key-value API of the DHT.
+ *
+ * A value is stored on the k nodes closest to its key, found by a node
+ * lookup, the local node included when it is one of them. It is read
+ * back with an iterative FIND_VALUE lookup, which ends at the first
+ * node holding it.
+ */
+
+var (
+	errValueNotFound     = errors.New("Value not found")
+	errNotEnoughReplicas = errors.New("Not enough replicas stored")
+)
+
+/*
+ * PutOptions : Options of Put. The zero value selects the defaults.
+ */
+type PutOptions struct {
+	Ttl         time.Duration // Time the value is kept, at most DefaultValueTtl
+	MinReplicas int           // Put fails if fewer nodes stored the value, 1 if 0
+}
+
+/*
+ * PutResult : Outcome of Put
+ */
+type PutResult struct {
+	Replicas  int         // Nodes which stored the value
+	Attempted int         // Nodes asked to store it
+	Lookup    LookupStats // Statistics of the lookup of the closest nodes
+}
+
+// KeyOf: The key of a value named 'name', its SHA-1
+func KeyOf(name []byte) NodeId {
+	return sha1.Sum(name)
+}
+
+/*
+ * Put : Stores a value on the k nodes closest to its key.
+ * Parameters:
+ * [in] ctx : Bounds the lookup and the stores
+ * [in] key : Key of the value
+ * [in] value : The value
+ * [in] opts : Options
+ * [out] PutResult : Number of replicas stored
+ * [out] error : If fewer than opts.MinReplicas nodes stored the value
+ */
+func (this *DHT) Put(ctx context.Context, key NodeId, value []byte, opts PutOptions) (PutResult, error) {
+	var result PutResult
+	if opts.MinReplicas <= 0 {
+		opts.MinReplicas = 1
+	}
+	ttl := uint32((opts.Ttl + time.Second - 1) / time.Second)
+	if opts.Ttl <= 0 || opts.Ttl > DefaultValueTtl {
+		ttl = uint32(DefaultValueTtl / time.Second)
+	}
+
+	nodes, stats, err := this.FindNode(ctx, key)
+	result.Lookup = stats
+	if err != nil && err != errNoContacts {
+		return result, err
+	}
+
+	// The local node keeps a replica if it is one of the k closest
+	local := len(nodes) < this.config.BucketSize ||
+		compareDistance(key, this.Id(), nodes[len(nodes)-1].Id) < 0
+	if local && len(nodes) == this.config.BucketSize {
+		nodes = nodes[:len(nodes)-1]
+	}
+
+	var lock sync.Mutex
+	var last_err error
+	var stores sync.WaitGroup
+	for _, node := range nodes {
+		stores.Add(1)
+		go func(node RemoteNode) {
+			defer stores.Done()
+			err := this.server.Store(ctx, node.Addr.UDPAddr(), key, value, ttl)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				last_err = err
+				return
+			}
+			result.Replicas++
+		}(node)
+	}
+	result.Attempted = len(nodes)
+
+	if local {
+		result.Attempted++
+		if this.store.Put(key, value, time.Duration(ttl)*time.Second) == nil {
+			lock.Lock()
+			result.Replicas++
+			lock.Unlock()
+		}
+	}
+	stores.Wait()
+
+	if result.Replicas < opts.MinReplicas {
+		err := fmt.Errorf("%w: %d of %d", errNotEnoughReplicas, result.Replicas, result.Attempted)
+		if last_err != nil {
+			err = fmt.Errorf("%w, last error: %v", err, last_err)
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+/*
+ * Get : Finds a value stored in the network.
+ * Parameters:
+ * [in] ctx : Bounds the lookup
+ * [in] key : Key of the value
+ * [out] []byte : The value
+ * [out] LookupStats : Statistics of the lookup
+ * [out] error : errValueNotFound if no node holds the value
+ */
+func (this *DHT) Get(ctx context.Context, key NodeId) ([]byte, LookupStats, error) {
+	if value, _, found := this.store.Get(key); found {
+		return value, LookupStats{}, nil
+	}
+
+	var lock sync.Mutex
+	var value []byte
+	_, stats, err := this.iterativeLookup(ctx, key, func(ctx context.Context, node RemoteNode) ([]RemoteNode, bool, error) {
+		found, nodes, err := this.server.FindValue(ctx, node.Addr.UDPAddr(), key)
+		if err != nil || found == nil {
+			return nodes, false, err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if value == nil {
+			value = found
+		}
+		return nil, true, nil
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	if value != nil {
+		return value, stats, nil
+	}
+	if err == nil || err == errNoContacts {
+		err = errValueNotFound
+	}
+	return nil, stats, err
+}
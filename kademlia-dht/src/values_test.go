@@ -0,0 +1,84 @@
+package kadht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPutGet(t *testing.T) {
+	testPutGet(t, []byte("value"))
+}
+
+func TestPutGetLargeValue(t *testing.T) {
+	// Fragmented, and too large for the holders to send it to nodes
+	// they did not verify
+	testPutGet(t, testValue(2*MaxUnfragmentedSize))
+}
+
+func testPutGet(t *testing.T, value []byte) {
+	config := Config{BucketSize: 4, RequestTimeout: 50 * time.Millisecond}
+	nodes := newTestCluster(t, 20, config)
+	defer stopCluster(nodes)
+
+	key := KeyOf([]byte("name"))
+	result, err := nodes[0].Put(context.Background(), key, value, PutOptions{Ttl: time.Hour})
+	if err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if result.Replicas != config.BucketSize || result.Attempted != result.Replicas {
+		t.Error("Wrong number of replicas: ", result)
+	}
+
+	// Stored on the nodes closest to the key
+	holders := 0
+	for _, id := range closestIds(nodes, key, config.BucketSize) {
+		for _, node := range nodes {
+			if _, _, found := node.store.Get(key); found && node.Id() == id {
+				holders++
+			}
+		}
+	}
+	if holders != config.BucketSize {
+		t.Error("Value not stored on the closest nodes: ", holders)
+	}
+
+	for _, node := range nodes[1:] {
+		found, _, err := node.Get(context.Background(), key)
+		if err != nil || !bytes.Equal(found, value) {
+			t.Fatal("Value not found: ", err)
+		}
+	}
+}
+
+func TestGetMissingValue(t *testing.T) {
+	config := Config{BucketSize: 4, RequestTimeout: 50 * time.Millisecond}
+	nodes := newTestCluster(t, 10, config)
+	defer stopCluster(nodes)
+
+	_, stats, err := nodes[0].Get(context.Background(), KeyOf([]byte("missing")))
+	if err != errValueNotFound {
+		t.Error("Missing value found: ", err)
+	}
+	if stats.Queried == 0 {
+		t.Error("No node queried: ", stats)
+	}
+}
+
+func TestPutMinReplicas(t *testing.T) {
+	config := Config{BucketSize: 4, RequestTimeout: 50 * time.Millisecond}
+	nodes := newTestCluster(t, 3, config)
+	defer stopCluster(nodes)
+
+	key := KeyOf([]byte("name"))
+	result, err := nodes[0].Put(context.Background(), key, []byte("value"), PutOptions{MinReplicas: 5})
+	if !errors.Is(err, errNotEnoughReplicas) {
+		t.Error("Put with too few replicas did not fail: ", err)
+	}
+	// Two remote nodes and the local one
+	if result.Replicas != 3 {
+		t.Error("Wrong number of replicas: ", result)
+	}
+}
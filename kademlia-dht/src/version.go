@@ -0,0 +1,142 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+ * Wire version negotiation.
+ *
+ * Every node supports a range of wire versions (see codec.go). PING
+ * requests and replies advertise it in the EXT_VERSION_RANGE extension,
+ * and the preferred version supported by both sides is recorded for the
+ * contact in the routing table. Newer versions are preferred, except
+ * the JSON debug format, only used when no other version is common:
+ * nodes debugging the traffic opt in with a range of [JSON, JSON].
+ * Messages to a contact are then encoded in that version, and messages
+ * to nodes whose version is not known yet in the lowest version of the
+ * local range, which every node of a cluster being upgraded understands.
+ *
+ * A rolling upgrade to a new wire version is done by first deploying
+ * nodes supporting [old, new], then nodes supporting only [new, new]
+ * once no node limited to the old version is left.
+ */
+
+const (
+	// Extension advertising the supported versions:
+	// [ min version (uint32) ][ max version (uint32) ]
+	EXT_VERSION_RANGE = 1
+)
+
+/*
+ * SetVersionRange : Sets the wire versions supported by the local node.
+ * Parameters:
+ * [in] min_version : Lowest version, used until a peer's range is known
+ * [in] max_version : Highest version
+ * [out] error : If the range is empty or a version has no codec
+ */
+func (this *ServerConfig) SetVersionRange(min_version, max_version uint32) error {
+	if min_version > max_version {
+		return errors.New("Empty version range")
+	}
+	for version := min_version; version <= max_version; version++ {
+		if _, found := CodecForVersion(version); !found {
+			return fmt.Errorf("No codec for message version %d", version)
+		}
+	}
+	this.wire_version = min_version
+	this.max_version = max_version
+	return nil
+}
+
+// versionRange: The wire versions supported by the local node
+func (this *ServerConfig) versionRange() (uint32, uint32) {
+	min_version := this.wire_version
+	if min_version == 0 {
+		min_version = WIRE_VERSION_BINARY
+	}
+	if this.max_version < min_version {
+		return min_version, min_version
+	}
+	return min_version, this.max_version
+}
+
+// versionFor: The wire version of the messages sent to the node at 'addr'
+func (this *ServerConfig) versionFor(addr string) uint32 {
+	if this.routing_table != nil {
+		if version, found := this.routing_table.ContactVersion(addr); found {
+			return version
+		}
+	}
+	min_version, _ := this.versionRange()
+	return min_version
+}
+
+// advertiseVersions: Adds the supported versions to the header
+func (this *ServerConfig) advertiseVersions(header *BasicMsgHeader) {
+	min_version, max_version := this.versionRange()
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint32(value, min_version)
+	binary.BigEndian.PutUint32(value[4:], max_version)
+	header.SetExtension(EXT_VERSION_RANGE, value)
+}
+
+// versionPreferred: If version 'a' is preferred over version 'b'
+func versionPreferred(a, b uint32) bool {
+	if (a == WIRE_VERSION_JSON) != (b == WIRE_VERSION_JSON) {
+		return b == WIRE_VERSION_JSON
+	}
+	return a > b
+}
+
+/*
+ * commonVersion : Finds the preferred version of both ranges.
+ * Parameters:
+ * [in] header : Header of a message received from the peer
+ * [in] min_version, max_version : The local range
+ * [out] uint32 : The common version
+ * [out] bool : 'false' if the peer advertised no range, or none in common
+ */
+func commonVersion(header *BasicMsgHeader, min_version, max_version uint32) (uint32, bool) {
+	value, found := header.GetExtension(EXT_VERSION_RANGE)
+	if !found || len(value) != 8 {
+		return 0, false
+	}
+	peer_min := binary.BigEndian.Uint32(value)
+	peer_max := binary.BigEndian.Uint32(value[4:])
+	if peer_max < max_version {
+		max_version = peer_max
+	}
+	if peer_min > min_version {
+		min_version = peer_min
+	}
+	if min_version > max_version {
+		return 0, false
+	}
+	best := min_version
+	for version := min_version; version < max_version; {
+		version++
+		if versionPreferred(version, best) {
+			best = version
+		}
+	}
+	return best, true
+}
+
+// learnPeerVersion: Records the version to use with the sender of
+// a received PING request or reply.
+func (this *ServerConfig) learnPeerVersion(msg IMessage) {
+	header := msg.Header()
+	if this.routing_table == nil || (header.MsgType != PING_REQ && header.MsgType != PING_RESP) {
+		return
+	}
+	min_version, max_version := this.versionRange()
+	version, found := commonVersion(header, min_version, max_version)
+	if !found {
+		// Peer predating the negotiation, or no version in common
+		version = min_version
+	}
+	this.routing_table.SetContactVersion(header.SenderId, version)
+}
@@ -0,0 +1,124 @@
+package kadht
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestCommonVersion(t *testing.T) {
+	ctx := NewServerConfig(generateRandomNodeId())
+	tests := []struct {
+		peer_min, peer_max uint32
+		version            uint32
+		found              bool
+	}{
+		{1, 1, 1, true},
+		// Binary preferred over the JSON debug format
+		{1, 2, 1, true},
+		{2, 5, 2, true},
+		{3, 4, 0, false},
+	}
+	for _, test := range tests {
+		peer_ctx := NewServerConfig(generateRandomNodeId())
+		peer_ctx.wire_version, peer_ctx.max_version = test.peer_min, test.peer_max
+		ping := NewPingRequest(peer_ctx.node_id)
+		peer_ctx.advertiseVersions(ping.Header())
+
+		version, found := commonVersion(ping.Header(), 1, 2)
+		if version != test.version || found != test.found {
+			t.Errorf("Range [%d, %d]: got %d %v", test.peer_min, test.peer_max, version, found)
+		}
+	}
+
+	if ctx.SetVersionRange(2, 1) == nil || ctx.SetVersionRange(1, 99) == nil {
+		t.Error("Invalid version range accepted")
+	}
+}
+
+func newVersionedEndpoint(t *testing.T, max_version uint32) *testEndpoint {
+	ctx := NewServerConfig(generateRandomNodeId())
+	if err := ctx.SetVersionRange(WIRE_VERSION_BINARY, max_version); err != nil {
+		t.Fatal("Failed to set the version range: ", err)
+	}
+	ctx.SetRoutingTable(NewRoutingTable(ctx.node_id))
+	return newTestEndpoint(t, ctx)
+}
+
+func (this *testEndpoint) addContact(peer *testEndpoint) {
+	this.ctx.routing_table.AddEntryOnly(
+		CreateNode(peer.addr.(*net.UDPAddr), peer.ctx.node_id))
+}
+
+// pingExchange: 'a' pings 'b' and returns the version of the next
+// request from 'a' to 'b'
+func pingExchange(t *testing.T, a, b *testEndpoint) uint32 {
+	a.addContact(b)
+	b.addContact(a)
+
+	SendPingRequest(a.transport, b.addr, a.ctx)
+	msg, _ := ConsumePacket(b.transport, b.ctx)
+	ping_req, ok := msg.(*PingRequest)
+	if !ok || ping_req.Header().Version != WIRE_VERSION_BINARY {
+		t.Fatal("Ping to a node of unknown version not sent in the lowest version")
+	}
+	SendPingResponse(b.transport, a.addr, ping_req, b.ctx)
+	if msg, _ = ConsumePacket(a.transport, a.ctx); msg == nil {
+		t.Fatal("Ping reply not received")
+	}
+
+	SendFindNodeRequest(a.transport, b.addr, generateRandomNodeId(), a.ctx)
+	msg, _ = ConsumePacket(b.transport, b.ctx)
+	if msg == nil {
+		t.Fatal("Find node request not received")
+	}
+	return msg.Header().Version
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	a := newVersionedEndpoint(t, WIRE_VERSION_JSON)
+	b := newVersionedEndpoint(t, WIRE_VERSION_JSON)
+	c := newVersionedEndpoint(t, WIRE_VERSION_BINARY)
+	// Opted in to the JSON debug format only
+	d := newVersionedEndpoint(t, WIRE_VERSION_JSON)
+	d.ctx.SetVersionRange(WIRE_VERSION_JSON, WIRE_VERSION_JSON)
+	defer a.close()
+	defer b.close()
+	defer c.close()
+	defer d.close()
+
+	if version := pingExchange(t, a, b); version != WIRE_VERSION_BINARY {
+		t.Error("JSON debug format preferred over binary: ", version)
+	}
+	if version := pingExchange(t, a, d); version != WIRE_VERSION_JSON {
+		t.Error("Only common version not used: ", version)
+	}
+	// Mixed cluster, c has not been upgraded
+	if version := pingExchange(t, a, c); version != WIRE_VERSION_BINARY {
+		t.Error("Version not supported by the peer used: ", version)
+	}
+}
+
+func TestVersionNegotiationNewContacts(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	a.server_ctx.SetVersionRange(WIRE_VERSION_BINARY, WIRE_VERSION_JSON)
+	b.server_ctx.SetVersionRange(WIRE_VERSION_BINARY, WIRE_VERSION_JSON)
+
+	// Neither node knows the other before the ping
+	if _, _, err := a.Ping(context.Background(), b.LocalAddr()); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+	// The reply is recorded after Ping returns
+	if !waitFor(func() bool {
+		version, found := a.routing_table.ContactVersion(b.LocalAddr().String())
+		return found && version == WIRE_VERSION_BINARY
+	}) {
+		t.Error("Version of the replying node not recorded")
+	}
+	if version, found := b.routing_table.ContactVersion(a.LocalAddr().String()); !found || version != WIRE_VERSION_BINARY {
+		t.Error("Version of the requester not recorded: ", version)
+	}
+}
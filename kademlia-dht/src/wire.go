@@ -0,0 +1,271 @@
+package kadht
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+/*
+ * Hand written binary encoding of the frequent messages.
+ *
+ * The Serialize/Deserialize interface API goes through io.Writer and
+ * io.Reader, and binary.Write/binary.Read use reflection, which
+ * allocates several times per message. The messages below also
+ * implement wireMessage, which appends the same layout to a byte slice
+ * and parses it in place from the received datagram. The binary codec
+ * uses it when available; other messages keep using the interface API.
+ *
+ * Datagrams are encoded into buffers from a sync.Pool, and read into
+ * buffers from another one. Decoding copies out everything it keeps,
+ * so a receive buffer can be reused once the message is decoded.
+ */
+
+const (
+	// Size of the encoded BasicMsgHeader
+	headerWireLen = 4 + 4 + 8 + bytesPerNodeiId + bytesPerNodeiId
+	// Size of an encoded RemoteNode
+	remoteNodeWireLen = bytesPerNodeiId + 4 + 2
+)
+
+/*
+ * wireMessage : Messages with a hand written binary encoding of their
+ * body, in the layout written by their Serialize interface API.
+ * 1. appendBody :
+ *    Appends the encoded body, returns 'false' if it cannot be encoded.
+ * 2. parseBody :
+ *    Parses the body at the start of data, returns the number of bytes
+ *    used, 'false' if the body is malformed.
+ */
+type wireMessage interface {
+	appendBody(buf []byte) ([]byte, bool)
+	parseBody(data []byte) (int, bool)
+}
+
+var (
+	// Buffers to encode datagrams into
+	sendBufferPool = sync.Pool{New: func() interface{} {
+		buf := make([]byte, 0, MaxUnfragmentedSize)
+		return &buf
+	}}
+	// Buffers to read datagrams into
+	receiveBufferPool = sync.Pool{New: func() interface{} {
+		buf := make([]byte, maxDatagramSize)
+		return &buf
+	}}
+)
+
+// getSendBuffer: An empty buffer from the pool
+func getSendBuffer() *[]byte {
+	buf := sendBufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// putSendBuffer: Returns a buffer to the pool, keeping the storage
+// 'data' was appended to. Oversized buffers are left to the GC.
+func putSendBuffer(buf *[]byte, data []byte) {
+	if cap(data) > maxDatagramSize {
+		return
+	}
+	*buf = data[:0]
+	sendBufferPool.Put(buf)
+}
+
+//************************* HEADER *************************//
+
+func appendHeader(buf []byte, header *BasicMsgHeader) []byte {
+	buf = appendUint32(buf, header.Version)
+	buf = appendUint32(buf, header.MsgType)
+	buf = appendUint64(buf, uint64(header.EpochTime))
+	buf = append(buf, header.SenderId[:]...)
+	return append(buf, header.RandomId[:]...)
+}
+
+// parseHeader: Parses the header at the start of data, returns the
+// number of bytes used
+func parseHeader(data []byte, header *BasicMsgHeader) (int, bool) {
+	if len(data) < headerWireLen {
+		return 0, false
+	}
+	header.Version = binary.BigEndian.Uint32(data)
+	header.MsgType = binary.BigEndian.Uint32(data[4:])
+	header.EpochTime = int64(binary.BigEndian.Uint64(data[8:]))
+	copy(header.SenderId[:], data[16:])
+	copy(header.RandomId[:], data[16+bytesPerNodeiId:])
+	header.Extensions = nil
+	return headerWireLen, true
+}
+
+//************************* MESSAGES *************************//
+
+func (this *PingRequest) appendBody(buf []byte) ([]byte, bool) { return buf, true }
+func (this *PingRequest) parseBody(data []byte) (int, bool)    { return 0, true }
+func (this *PingReply) appendBody(buf []byte) ([]byte, bool)   { return buf, true }
+func (this *PingReply) parseBody(data []byte) (int, bool)      { return 0, true }
+
+func (this *FindNodeRequest) appendBody(buf []byte) ([]byte, bool) {
+	return append(buf, this.LookupNodeId[:]...), true
+}
+
+func (this *FindNodeRequest) parseBody(data []byte) (int, bool) {
+	return parseNodeId(data, &this.LookupNodeId)
+}
+
+func (this *FindValueRequest) appendBody(buf []byte) ([]byte, bool) {
+	return append(buf, this.LookupValueId[:]...), true
+}
+
+func (this *FindValueRequest) parseBody(data []byte) (int, bool) {
+	return parseNodeId(data, &this.LookupValueId)
+}
+
+func (this *FindNodeReply) appendBody(buf []byte) ([]byte, bool) {
+	buf = appendUint32(buf, uint32(this.TotalNodes))
+	return appendRemoteNodes(buf, this.Nodes), true
+}
+
+func (this *FindNodeReply) parseBody(data []byte) (int, bool) {
+	nodes, used, ok := parseRemoteNodes(data)
+	if !ok {
+		return 0, false
+	}
+	this.TotalNodes = int32(len(nodes))
+	this.Nodes = nodes
+	return used, true
+}
+
+func (this *FindValueReply) appendBody(buf []byte) ([]byte, bool) {
+	buf = append(buf, boolToUint8(this.Found))
+	buf, ok := appendValue(buf, this.Value)
+	if !ok {
+		return nil, false
+	}
+	buf = appendUint32(buf, uint32(this.TotalNodes))
+	return appendRemoteNodes(buf, this.Nodes), true
+}
+
+func (this *FindValueReply) parseBody(data []byte) (int, bool) {
+	if len(data) < 1 {
+		return 0, false
+	}
+	this.Found = data[0] != 0
+	value, used, ok := parseValue(data[1:])
+	if !ok {
+		return 0, false
+	}
+	this.Value = nil
+	if this.Found {
+		this.Value = value
+	}
+	nodes, nodes_used, ok := parseRemoteNodes(data[1+used:])
+	if !ok {
+		return 0, false
+	}
+	this.TotalNodes = int32(len(nodes))
+	this.Nodes = nodes
+	return 1 + used + nodes_used, true
+}
+
+func (this *StoreRequest) appendBody(buf []byte) ([]byte, bool) {
+	buf = append(buf, this.Key[:]...)
+	buf = appendUint32(buf, this.Ttl)
+	return appendValue(buf, this.Value)
+}
+
+func (this *StoreRequest) parseBody(data []byte) (int, bool) {
+	if len(data) < bytesPerNodeiId+4 {
+		return 0, false
+	}
+	copy(this.Key[:], data)
+	this.Ttl = binary.BigEndian.Uint32(data[bytesPerNodeiId:])
+	value, used, ok := parseValue(data[bytesPerNodeiId+4:])
+	if !ok {
+		return 0, false
+	}
+	this.Value = value
+	return bytesPerNodeiId + 4 + used, true
+}
+
+func (this *StoreReply) appendBody(buf []byte) ([]byte, bool) {
+	return append(buf, boolToUint8(this.Stored)), true
+}
+
+func (this *StoreReply) parseBody(data []byte) (int, bool) {
+	if len(data) < 1 {
+		return 0, false
+	}
+	this.Stored = data[0] != 0
+	return 1, true
+}
+
+//************************* FIELDS *************************//
+
+func appendUint32(buf []byte, value uint32) []byte {
+	return append(buf, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(value>>32)), uint32(value))
+}
+
+func parseNodeId(data []byte, id *NodeId) (int, bool) {
+	if len(data) < bytesPerNodeiId {
+		return 0, false
+	}
+	copy(id[:], data)
+	return bytesPerNodeiId, true
+}
+
+func appendRemoteNodes(buf []byte, nodes []RemoteNode) []byte {
+	for idx := range nodes {
+		node := &nodes[idx]
+		buf = append(buf, node.Id[:]...)
+		buf = append(buf, node.Addr.IP[:]...)
+		buf = append(buf, byte(node.Addr.Port>>8), byte(node.Addr.Port))
+	}
+	return buf
+}
+
+// parseRemoteNodes: Parses a count prefixed list of nodes
+func parseRemoteNodes(data []byte) ([]RemoteNode, int, bool) {
+	if len(data) < 4 {
+		return nil, 0, false
+	}
+	total := int32(binary.BigEndian.Uint32(data))
+	if total < 0 || total > maxListEntries || len(data)-4 < int(total)*remoteNodeWireLen {
+		return nil, 0, false
+	}
+	nodes := make([]RemoteNode, total)
+	offset := 4
+	for idx := range nodes {
+		node := &nodes[idx]
+		copy(node.Id[:], data[offset:])
+		copy(node.Addr.IP[:], data[offset+bytesPerNodeiId:])
+		node.Addr.Port = binary.BigEndian.Uint16(data[offset+bytesPerNodeiId+4:])
+		offset += remoteNodeWireLen
+	}
+	return nodes, offset, true
+}
+
+// appendValue: Same layout as writeValueField
+func appendValue(buf []byte, value []byte) ([]byte, bool) {
+	if len(value) > maxValueFieldLen {
+		return nil, false
+	}
+	buf = appendUint32(buf, uint32(len(value)))
+	return append(buf, value...), true
+}
+
+// parseValue: Parses a value written by appendValue, into a copy
+func parseValue(data []byte) ([]byte, int, bool) {
+	if len(data) < 4 {
+		return nil, 0, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if length > maxValueFieldLen || uint64(len(data)-4) < uint64(length) {
+		return nil, 0, false
+	}
+	value := make([]byte, length)
+	copy(value, data[4:])
+	return value, 4 + int(length), true
+}
@@ -0,0 +1,139 @@
+package kadht
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestWireMatchesSerialize(t *testing.T) {
+	for _, msg := range testMessages() {
+		if _, ok := msg.(wireMessage); !ok {
+			continue
+		}
+		name := MsgType2Str(msg.Header().MsgType)
+		var serialized bytes.Buffer
+		if !msg.Serialize(&serialized) {
+			t.Fatal("Failed to serialize ", name)
+		}
+		data, err := appendBinaryMessage(nil, msg)
+		if err != nil || !bytes.Equal(data, serialized.Bytes()) {
+			t.Error("Hand written encoding of ", name, " differs: ", err)
+		}
+
+		// Both parsers agree, and reject every truncation
+		parsed, err := parseMessage(bytes.NewReader(data))
+		decoded, decode_err := DecodeMessage(data)
+		if err != nil || decode_err != nil || !reflect.DeepEqual(parsed, decoded) {
+			t.Error("Hand written decoding of ", name, " differs: ", decode_err)
+		}
+		for size := 0; size < len(data); size++ {
+			if _, err := DecodeMessage(data[:size]); err == nil {
+				t.Error("Truncated ", name, " accepted: ", size, " bytes")
+			}
+		}
+	}
+}
+
+func TestWireInvalidNodeCount(t *testing.T) {
+	reply := NewFindNodeReply(generateRandomNodeId(), nil, NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId()))
+	reply.TotalNodes = maxListEntries + 1
+	data, _ := EncodeMessage(reply)
+	if _, err := DecodeMessage(data); err == nil {
+		t.Error("Too many nodes accepted")
+	}
+}
+
+func TestWireAllocations(t *testing.T) {
+	ping := NewPingRequest(generateRandomNodeId())
+	data, _ := EncodeMessage(ping)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf := getSendBuffer()
+		encoded, _ := appendMessage(*buf, ping)
+		putSendBuffer(buf, encoded)
+	})
+	if allocs != 0 {
+		t.Error("Encoding a ping allocates: ", allocs)
+	}
+	// Only the message itself
+	allocs = testing.AllocsPerRun(100, func() {
+		DecodeMessage(data)
+	})
+	if allocs > 1 {
+		t.Error("Decoding a ping allocates: ", allocs)
+	}
+}
+
+func benchmarkEncode(b *testing.B, msg IMessage) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getSendBuffer()
+		data, err := appendMessage(*buf, msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		putSendBuffer(buf, data)
+	}
+}
+
+func benchmarkDecode(b *testing.B, msg IMessage) {
+	data, _ := EncodeMessage(msg)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeMessage(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchFindNodeReply() IMessage {
+	addr, _ := net.ResolveUDPAddr("udp", "10.0.3.2:8989")
+	nodes := make([]RemoteNode, alphaNodes)
+	for idx := range nodes {
+		nodes[idx] = RemoteNode{Id: generateRandomNodeId(), Addr: NewIpv4Addr(addr)}
+	}
+	req := NewFindNodeRequest(generateRandomNodeId(), generateRandomNodeId())
+	return NewFindNodeReply(generateRandomNodeId(), nodes, req)
+}
+
+func BenchmarkEncodePing(b *testing.B) {
+	benchmarkEncode(b, NewPingRequest(generateRandomNodeId()))
+}
+
+func BenchmarkDecodePing(b *testing.B) {
+	benchmarkDecode(b, NewPingRequest(generateRandomNodeId()))
+}
+
+func BenchmarkEncodeFindNodeReply(b *testing.B) {
+	benchmarkEncode(b, benchFindNodeReply())
+}
+
+func BenchmarkDecodeFindNodeReply(b *testing.B) {
+	benchmarkDecode(b, benchFindNodeReply())
+}
+
+// The reflection based interface API, for comparison
+func BenchmarkSerializePing(b *testing.B) {
+	ping := NewPingRequest(generateRandomNodeId())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		ping.Serialize(&buf)
+		ParseMessage(&buf)
+	}
+}
+
+func BenchmarkSendPing(b *testing.B) {
+	ctx := NewServerConfig(generateRandomNodeId())
+	ping := NewPingRequest(ctx.node_id)
+	write := func([]byte) error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := writeMessage(ping, "10.0.0.1:4000", write, ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}